@@ -0,0 +1,233 @@
+// Package admin implements the control socket used to inspect and
+// command a running daemon. The socket is a Unix socket, which is
+// only accessible to its owner; on each connection, a client sends a
+// single JSON request naming a command, and the server replies with
+// a single JSON response.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrUnknownCommand is returned for a request naming a
+	// command the server doesn't have.
+	ErrUnknownCommand = errors.New("admin: unknown command")
+
+	// ErrUsage is returned by handlers given the wrong arguments.
+	ErrUsage = errors.New("admin: wrong number of arguments")
+)
+
+// A Request asks the server to run a command.
+type Request struct {
+	Command string
+	Args    []string `json:",omitempty"`
+}
+
+// A Response carries the result of a command, or the error it
+// failed with.
+type Response struct {
+	Result json.RawMessage `json:",omitempty"`
+	Error  string          `json:",omitempty"`
+}
+
+// A HandlerFunc runs a command with the request's arguments. The
+// result it returns is sent to the client as JSON.
+type HandlerFunc func(args []string) (interface{}, error)
+
+type command struct {
+	help    string
+	handler HandlerFunc
+}
+
+// A Server dispatches requests on the control socket to the
+// registered commands.
+type Server struct {
+	lock     sync.Mutex
+	commands map[string]command
+}
+
+// NewServer returns a server with only the "help" command, which
+// lists the registered commands.
+func NewServer() *Server {
+	srv := &Server{commands: map[string]command{}}
+	srv.Handle("help", "list the available commands", srv.help)
+	return srv
+}
+
+// Handle registers the handler for the named command; help is a
+// short description shown by the "help" command.
+func (srv *Server) Handle(name, help string, handler HandlerFunc) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.commands[name] = command{help: help, handler: handler}
+}
+
+func (srv *Server) help(args []string) (interface{}, error) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	var names []string
+	for name := range srv.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		lines = append(lines, name+": "+srv.commands[name].help)
+	}
+	return lines, nil
+}
+
+// Run runs a single request.
+func (srv *Server) Run(req *Request) *Response {
+	srv.lock.Lock()
+	cmd, ok := srv.commands[req.Command]
+	srv.lock.Unlock()
+	if !ok {
+		return &Response{Error: ErrUnknownCommand.Error()}
+	}
+
+	result, err := cmd.handler(req.Args)
+	if err != nil {
+		return &Response{Error: err.Error()}
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		return &Response{Error: err.Error()}
+	}
+	return &Response{Result: out}
+}
+
+// Listen opens the control socket at path, replacing any stale
+// socket left behind by an earlier run.
+func Listen(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	// The socket is created in a private directory, so that it
+	// isn't accessible to anyone else before it's chmodded, and
+	// then linked into place; unlike a rename, the link won't
+	// replace a file that is already there.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".admin")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(path))
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(tmp, 0600)
+	if err == nil {
+		err = os.Link(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &listener{Listener: l, path: path}, nil
+}
+
+// listener removes the control socket when it is closed, as the
+// socket was moved from where the net package would remove it.
+type listener struct {
+	net.Listener
+	path   string
+	unlink sync.Once
+}
+
+func (l *listener) Close() error {
+	err := l.Listener.Close()
+	l.unlink.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// ListenAndServe opens the control socket at path and serves it.
+func (srv *Server) ListenAndServe(path string) error {
+	l, err := Listen(path)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("serving admin socket", "path", path)
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on the listener, running one request
+// from each. It only returns once the listener is closed.
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			slog.Error("admin accept failed", "error", err)
+			continue
+		}
+
+		go srv.serveConn(conn)
+	}
+}
+
+func (srv *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req Request
+	err := json.NewDecoder(conn).Decode(&req)
+	if err != nil {
+		slog.Warn("bad admin request", "error", err)
+		return
+	}
+
+	resp := srv.Run(&req)
+	if resp.Error != "" {
+		slog.Warn("admin command failed", "command", req.Command,
+			"args", req.Args, "error", resp.Error)
+	} else {
+		slog.Info("admin command", "command", req.Command,
+			"args", req.Args)
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// Call sends a command to the control socket at path, returning
+// the JSON-encoded result.
+func Call(path, command string, args ...string) (json.RawMessage, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(&Request{Command: command, Args: args})
+	if err != nil {
+		return nil, err
+	}
+
+	var resp Response
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
@@ -0,0 +1,120 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCall(t *testing.T) {
+	dir, err := os.MkdirTemp("", "admin")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewServer()
+	srv.Handle("echo", "echo the arguments", func(args []string) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, ErrUsage
+		}
+		return args, nil
+	})
+
+	path := filepath.Join(dir, "admin.sock")
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Listen left %d entries behind", len(entries))
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("control socket has mode %v", fi.Mode().Perm())
+	}
+
+	out, err := Call(path, "echo", "a", "b")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var args []string
+	err = json.Unmarshal(out, &args)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(args) != 2 || args[0] != "a" || args[1] != "b" {
+		t.Fatalf("echo returned %v", args)
+	}
+
+	_, err = Call(path, "echo")
+	if err == nil || err.Error() != ErrUsage.Error() {
+		t.Fatalf("expected %v, have %v", ErrUsage, err)
+	}
+
+	_, err = Call(path, "missing")
+	if err == nil || err.Error() != ErrUnknownCommand.Error() {
+		t.Fatalf("expected %v, have %v", ErrUnknownCommand, err)
+	}
+
+	out, err = Call(path, "help")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var help []string
+	json.Unmarshal(out, &help)
+	if len(help) != 2 {
+		t.Fatalf("help returned %v", help)
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "admin")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "admin.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatalf("failed to replace stale socket: %v", err)
+	}
+	l.Close()
+	if _, err = os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the control socket wasn't removed: %v", err)
+	}
+
+	regular := filepath.Join(dir, "regular")
+	os.WriteFile(regular, nil, 0644)
+	_, err = Listen(regular)
+	if err == nil {
+		t.Fatal("a regular file shouldn't be replaced")
+	}
+	if _, err = os.Stat(regular); errors.Is(err, os.ErrNotExist) {
+		t.Fatal("a regular file was removed")
+	}
+}
@@ -0,0 +1,109 @@
+// Package clock abstracts the passage of time, so that the code that
+// stamps, checks, and schedules packets can be tested without
+// sleeping.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and waits for it to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that receives the time once d has
+	// passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+type system struct{}
+
+func (system) Now() time.Time                         { return time.Now() }
+func (system) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// System is the real clock.
+var System Clock = system{}
+
+// Or returns c, or System if c is nil, so that a zero-valued clock
+// field means the real clock.
+func Or(c Clock) Clock {
+	if c == nil {
+		return System
+	}
+	return c
+}
+
+type waiter struct {
+	when time.Time
+	c    chan time.Time
+}
+
+// A Fake is a clock that only moves when it is told to. It is safe
+// for concurrent use.
+type Fake struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// NewFake returns a fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the fake clock's time.
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+// After returns a channel that receives the time once the clock has
+// been advanced by d. If d isn't positive, it receives it at once.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	w := &waiter{when: f.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- f.now
+	} else {
+		f.waiters = append(f.waiters, w)
+	}
+	return w.c
+}
+
+// Advance moves the clock forward by d, firing the channels whose
+// time has come.
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the clock to t, firing the channels whose time has come.
+// The clock may be moved backwards, but no channel fires early.
+func (f *Fake) Set(t time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = t
+	waiting := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.when.After(t) {
+			waiting = append(waiting, w)
+		} else {
+			w.c <- t
+		}
+	}
+	f.waiters = waiting
+}
+
+// Waiters returns the number of channels waiting for the clock to be
+// advanced, so that a test can tell when a goroutine has gone to
+// sleep.
+func (f *Fake) Waiters() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.waiters)
+}
@@ -0,0 +1,60 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	if !fired(f.After(0)) {
+		t.Fatal("a zero wait should fire at once")
+	}
+
+	short, long := f.After(time.Minute), f.After(time.Hour)
+	if f.Waiters() != 2 {
+		t.Fatalf("expected 2 waiters, have %d", f.Waiters())
+	}
+
+	f.Advance(time.Minute - time.Nanosecond)
+	if fired(short) {
+		t.Fatal("a wait fired early")
+	}
+
+	f.Advance(time.Nanosecond)
+	if !fired(short) || fired(long) {
+		t.Fatal("only the wait that has passed should fire")
+	}
+
+	f.Set(start)
+	if !f.Now().Equal(start) || f.Waiters() != 1 {
+		t.Fatal("moving the clock back should keep the remaining wait")
+	}
+
+	f.Advance(2 * time.Hour)
+	if !fired(long) || f.Waiters() != 0 {
+		t.Fatal("the remaining wait should have fired")
+	}
+}
+
+func TestOr(t *testing.T) {
+	if Or(nil) != System {
+		t.Fatal("a nil clock should be the system clock")
+	}
+
+	f := NewFake(time.Time{})
+	if Or(f) != f {
+		t.Fatal("a clock should be kept")
+	}
+}
@@ -2,18 +2,19 @@ package main
 
 import (
 	"crypto/rand"
-
-	"encoding/pem"
 	"flag"
-	"io/ioutil"
 	"log"
 
 	"code.google.com/p/go.crypto/nacl/box"
+	"github.com/kisom/entropyshare/seal"
+	"github.com/kisom/entropyshare/util"
 )
 
 func main() {
 	armour := flag.Bool("a", false, "armour key")
 	outFile := flag.String("o", "signer", "output file base name")
+	encrypt := flag.Bool("e", false, "seal the private key with a passphrase")
+	passphraseSpec := flag.String("passphrase", "", "read the passphrase from file:PATH or env:VAR instead of the terminal")
 	flag.Parse()
 
 	if *outFile == "" {
@@ -25,21 +26,23 @@ func main() {
 		log.Fatalf("%v", err)
 	}
 
-	dumpPrivate(priv, *outFile, *armour)
-	dumpPublic(pub, *outFile, *armour)
-}
-
-func dumpPrivate(priv *[32]byte, baseName string, armour bool) {
-	out := priv[:]
-	if armour {
-		p := &pem.Block{
-			Type:  "CURVE25519 PRIVATE KEY",
-			Bytes: out,
+	var passphrase seal.Passphrase
+	if *encrypt {
+		passphrase, err = seal.ReadPassphrase(*passphraseSpec, true)
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
-		out = pem.EncodeToMemory(p)
 	}
 
-	err := ioutil.WriteFile(baseName+".key", out, 0600)
+	dumpPrivate(priv, *outFile, *armour, passphrase)
+	dumpPublic(pub, *outFile, *armour)
+}
+
+// dumpPrivate writes the private key; if a passphrase is given, it
+// is sealed with the passphrase, and is always armoured.
+func dumpPrivate(priv *[32]byte, baseName string, armour bool, passphrase seal.Passphrase) {
+	err := util.WritePrivateKey(baseName+".key", "CURVE25519 PRIVATE KEY",
+		priv[:], armour, passphrase)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -47,16 +50,7 @@ func dumpPrivate(priv *[32]byte, baseName string, armour bool) {
 }
 
 func dumpPublic(pub *[32]byte, baseName string, armour bool) {
-	out := pub[:]
-	if armour {
-		p := &pem.Block{
-			Type:  "CURVE25519 PUBLIC KEY",
-			Bytes: out,
-		}
-		out = pem.EncodeToMemory(p)
-	}
-
-	err := ioutil.WriteFile(baseName+".pub", out, 0644)
+	err := util.WritePublicKey(baseName+".pub", "CURVE25519 PUBLIC KEY", pub[:], armour)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -2,22 +2,19 @@ package main
 
 import (
 	"bytes"
-	"crypto/rsa"
-	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+
+	"github.com/kisom/entropyshare/seal"
+	"github.com/kisom/entropyshare/sink"
+	"github.com/kisom/entropyshare/util"
 )
 
-var config struct {
-	Address string
-	Signer  []byte
-	Counter int64
-	Private []byte
-	Drift   int64
-}
+var config sink.Config
 
 func checkError(err error) {
 	if err != nil {
@@ -31,28 +28,27 @@ func main() {
 	keyFile := flag.String("k", "decrypt.key", "key file for decryption")
 	signerFile := flag.String("s", "signer.pub", "signer's public key")
 	flag.Int64Var(&config.Drift, "d", 120, "clock drift value")
+	flag.IntVar(&config.MinChunk, "min", 0, "minimum accepted chunk size")
+	flag.IntVar(&config.MaxChunk, "max", 0, "maximum accepted chunk size")
+	reference := flag.Bool("r", false, "refer to the key file rather than embedding the key")
 	flag.Parse()
 
 	in, err := ioutil.ReadFile(*keyFile)
 	checkError(err)
 
-	if len(in) != 32 {
-		fmt.Fprintf(os.Stderr, "[!] bad Curve25519 private key.\n")
+	// A sealed key can't be embedded without its passphrase, so
+	// the configuration always refers to it.
+	if *reference || seal.IsSealedKey(in) {
+		config.PrivateFile, err = filepath.Abs(*keyFile)
+		checkError(err)
+	} else {
+		config.Private, err = util.ReadPrivateKey(*keyFile, "CURVE25519 PRIVATE KEY")
+		checkError(err)
 	}
-	config.Private = in
-
-	in, err = ioutil.ReadFile(*signerFile)
-	checkError(err)
 
-	pub, err := x509.ParsePKIXPublicKey(in)
+	config.Signer, err = util.ReadPublicKey(*signerFile, "PUBLIC KEY", "RSA PUBLIC KEY")
 	checkError(err)
-
-	if _, ok := pub.(*rsa.PublicKey); !ok {
-		fmt.Fprintf(os.Stderr, "[!] signer isn't a valid DER-encoded PKIX RSA public key")
-		os.Exit(1)
-	}
-
-	config.Signer = in
+	checkError(config.Validate())
 
 	buf := &bytes.Buffer{}
 	out, err := json.Marshal(config)
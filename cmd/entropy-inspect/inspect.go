@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/kisom/entropyshare/common/crypt"
+	"github.com/kisom/entropyshare/inspect"
+	"github.com/kisom/entropyshare/util"
+)
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-k key] [-kem key] [-s signer] packet...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "A packet of - is read from standard input.\n")
+	flag.PrintDefaults()
+}
+
+func readPacket(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+func main() {
+	keyFile := flag.String("k", "", "sink's decryption key")
+	kemFile := flag.String("kem", "", "sink's ML-KEM key, to open packets sealed with the hybrid key agreement")
+	signerFile := flag.String("s", "", "signer's public key")
+	jsonOutput := flag.Bool("json", false, "write the reports as JSON")
+	flag.StringVar(&util.PassphraseSpec, "passphrase", "", "read the passphrase for a sealed key from file:PATH or env:VAR instead of the terminal")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var priv []byte
+	var err error
+	if *keyFile != "" {
+		priv, err = util.ReadPrivateKey(*keyFile, "CURVE25519 PRIVATE KEY")
+		checkError(err)
+	}
+
+	var kemPriv []byte
+	if *kemFile != "" {
+		kemPriv, err = util.ReadPrivateKey(*kemFile, "ML-KEM-768 PRIVATE KEY")
+		checkError(err)
+		if len(kemPriv) != crypt.KEMPrivateKeySize {
+			checkError(crypt.ErrInvalidKEMKey)
+		}
+	}
+
+	var signer *rsa.PublicKey
+	if *signerFile != "" {
+		signer, err = util.ReadSignerPublic(*signerFile)
+		checkError(err)
+	}
+
+	var failed bool
+	for i, path := range flag.Args() {
+		in, err := readPacket(path)
+		checkError(err)
+
+		r := inspect.Packet(in, priv, kemPriv, signer, time.Now())
+		if r.Failed != "" {
+			failed = true
+		}
+
+		if *jsonOutput {
+			out, err := json.Marshal(struct {
+				File string
+				*inspect.Report
+			}{path, r})
+			checkError(err)
+
+			buf := &bytes.Buffer{}
+			checkError(json.Indent(buf, out, "", "\t"))
+			fmt.Printf("%s\n", buf.Bytes())
+			continue
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		if flag.NArg() > 1 {
+			fmt.Printf("%s:\n", path)
+		}
+		r.WriteText(os.Stdout)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,503 @@
+// Package sinkd runs an entropy sink: it receives packets from a
+// source and applies them to its outputs, optionally relaying entropy
+// on to targets of its own.
+package sinkd
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/box"
+	"github.com/kisom/entropyshare/admin"
+	"github.com/kisom/entropyshare/cmd/entropy-source/source"
+	"github.com/kisom/entropyshare/enroll"
+	"github.com/kisom/entropyshare/health"
+	"github.com/kisom/entropyshare/logging"
+	"github.com/kisom/entropyshare/metrics"
+	"github.com/kisom/entropyshare/prng"
+	"github.com/kisom/entropyshare/seal"
+	"github.com/kisom/entropyshare/sink"
+	"github.com/kisom/entropyshare/systemd"
+	"github.com/kisom/entropyshare/util"
+)
+
+// seedSealing holds the flags for sealing the local PRNG's seed
+// file.
+var seedSealing struct {
+	key        string
+	generation string
+}
+
+// startPRNG starts the local Fortuna PRNG used by relays and Fortuna
+// outputs, returning a writer that mixes entropy into it.
+func startPRNG(seedFile string, useTPM bool) io.Writer {
+	if seedSealing.key != "" {
+		kp, err := seal.ParseKeyProvider(seedSealing.key)
+		if err != nil {
+			logging.Fatal("invalid seed key", "key", seedSealing.key, "error", err)
+		}
+
+		generationFile := seedSealing.generation
+		if generationFile == "" {
+			generationFile = seedFile + ".generation"
+		}
+		prng.SealSeed(kp, generationFile)
+	}
+
+	if useTPM {
+		prng.Start(seedFile)
+	} else {
+		prng.StartWithoutTPM(seedFile)
+	}
+	return prng.Relay
+}
+
+// startRelay sets up the sink as a relay: the PRNG's output is
+// delivered to the downstream targets until ctx is done. The relay's
+// scheduler calls heartbeat every interval, if interval isn't 0. The
+// returned channel is closed once the relay has stopped.
+func startRelay(ctx context.Context, relay *sink.RelayConfig, interval time.Duration, heartbeat func()) (*source.Scheduler, <-chan struct{}) {
+	signer := util.ParsePrivateKey(relay.SignerKey)
+	slog.Info("relaying to targets", "file", relay.Targets)
+	scheduler := source.NewScheduler(signer, relay.Targets)
+	scheduler.HeartbeatInterval = interval
+	scheduler.Heartbeat = heartbeat
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scheduler.Run(ctx)
+	}()
+	return scheduler, done
+}
+
+// reload re-reads the sink's configuration file.
+func reload(cfgFile string, srv *sink.Server) error {
+	config, err := sink.LoadConfig(cfgFile)
+	if err != nil {
+		return err
+	}
+	return srv.Reload(config)
+}
+
+// reloadOnHangup reloads the configuration whenever the sink
+// receives a SIGHUP. A relay rescans its targets before systemd is
+// told the reload is done.
+func reloadOnHangup(ctx context.Context, cfgFile string, srv *sink.Server, relay *source.Scheduler) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			slog.Info("reloading configuration", "file", cfgFile)
+			notify(systemd.Reloading)
+			err := reload(cfgFile, srv)
+			if err != nil {
+				slog.Error("failed to reload configuration",
+					"file", cfgFile, "error", err)
+			}
+			if relay != nil {
+				if err = relay.Scan(ctx); err != nil {
+					slog.Error("failed to reload relay targets", "error", err)
+				}
+			}
+			notify(systemd.Ready)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// shutdownOnDone shuts the server down once ctx is done, closing the
+// returned channel once its state has been stored.
+func shutdownOnDone(ctx context.Context, srv *sink.Server) <-chan struct{} {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+
+		slog.Info("shutting down")
+		notify(systemd.Stopping)
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := srv.Shutdown(sctx)
+		if err != nil {
+			slog.Error("failed to shut down sink", "error", err)
+		}
+	}()
+	return stopped
+}
+
+// notify tells systemd about a change in the sink's state, if it is
+// running under systemd.
+func notify(state string) {
+	_, err := systemd.Notify(state)
+	if err != nil {
+		slog.Warn("failed to notify systemd", "state", state, "error", err)
+	}
+}
+
+// watchdogInterval returns the interval at which heartbeats should
+// be sent to systemd, or 0 if its watchdog isn't enabled.
+func watchdogInterval() time.Duration {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		slog.Warn("ignoring systemd watchdog", "error", err)
+		return 0
+	}
+	return interval / 2
+}
+
+// beat calls heartbeat every interval until ctx is done.
+func beat(ctx context.Context, interval time.Duration, heartbeat func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			heartbeat()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serve serves the sink on the sockets passed by systemd, or on the
+// configured address if the sink wasn't socket activated. systemd is
+// told that the sink is ready once it is listening.
+func serve(srv *sink.Server) error {
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+
+	if len(listeners) == 0 {
+		l, err := srv.Listen()
+		if err != nil {
+			return err
+		}
+		listeners = []net.Listener{l}
+	} else {
+		slog.Info("using socket activation", "listeners", len(listeners))
+	}
+
+	for _, l := range listeners[1:] {
+		go srv.Serve(l)
+	}
+	notify(systemd.Ready)
+	return srv.Serve(listeners[0])
+}
+
+// shutdownTimeout is how long the sink waits for the packets being
+// received to be applied when shutting down.
+const shutdownTimeout = 30 * time.Second
+
+// status describes a running sink for the admin socket.
+type status struct {
+	Counter int64
+	Health  health.Stats
+	Outputs []sink.OutputStats
+}
+
+// listenAdmin serves the sink's control socket in the background.
+// The relay and PRNG commands are only available if the sink has a
+// relay or a local PRNG.
+func listenAdmin(path, cfgFile string, srv *sink.Server, outs *sink.Outputs, relay *source.Scheduler, local bool) net.Listener {
+	a := admin.NewServer()
+	if relay != nil {
+		relay.RegisterAdmin(a)
+	}
+	if local {
+		prng.RegisterAdmin(a)
+	}
+
+	a.Handle("status", "show the sink's counter, health tests, and outputs", func([]string) (interface{}, error) {
+		return &status{
+			Counter: srv.Counter(),
+			Health:  srv.Health(),
+			Outputs: outs.Stats(),
+		}, nil
+	})
+	a.Handle("reload", "re-read the configuration file", func([]string) (interface{}, error) {
+		if relay != nil {
+			relay.Reload()
+		}
+		return nil, reload(cfgFile, srv)
+	})
+
+	l, err := admin.Listen(path)
+	if err != nil {
+		logging.Fatal("failed to open admin socket", "path", path, "error", err)
+	}
+
+	slog.Info("serving admin socket", "path", path)
+	go a.Serve(l)
+	return l
+}
+
+// openOutputs sets up the sink's outputs. If none are configured,
+// entropy is written to /dev/random. A relay always mixes received
+// entropy into its PRNG, so a Fortuna output is added if the
+// configuration lacks one.
+func openOutputs(config *sink.Config, seedFile string) (*sink.Outputs, bool) {
+	outputs := config.Outputs
+	if len(outputs) == 0 {
+		outputs = []sink.OutputConfig{{Type: sink.OutputRandom}}
+	}
+
+	var hasFortuna bool
+	for _, o := range outputs {
+		if o.Type == sink.OutputFortuna {
+			hasFortuna = true
+		}
+	}
+
+	if config.Relay != nil && !hasFortuna {
+		outputs = append(outputs, sink.OutputConfig{Type: sink.OutputFortuna})
+		hasFortuna = true
+	}
+
+	var local io.Writer
+	if config.Relay != nil {
+		local = startPRNG(config.Relay.SeedFile, config.Relay.TPM)
+	} else if hasFortuna {
+		local = startPRNG(seedFile, false)
+	}
+
+	outs, err := sink.OpenOutputs(outputs, local)
+	if err != nil {
+		logging.Fatal("failed to open outputs", "error", err)
+	}
+	return outs, local != nil
+}
+
+// Main runs the daemon with the given command line arguments; name
+// is used in usage messages.
+func Main(name string, args []string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	cfgFile := flags.String("f", "config.json", "configuration file")
+	bundleFile := flags.String("import", "", "apply an offline packet bundle and exit")
+	rate := flags.Duration("rate", time.Second, "delay between packets when importing a bundle")
+	seedFile := flags.String("s", "sink.seed", "seed file for a local Fortuna output")
+	metricsAddr := flags.String("metrics", "", "address to serve Prometheus metrics on")
+	logFormat := flags.String("log-format", "text", "log format (text or json)")
+	logLevel := flags.String("log-level", "info", "minimum log level (debug, info, warn, or error)")
+	adminSocket := flags.String("admin", "", "path of the admin control socket")
+	flags.StringVar(&util.PassphraseSpec, "passphrase", "", "read the passphrase for sealed keys from file:PATH or env:VAR instead of the terminal")
+	flags.StringVar(&seedSealing.key, "seed-key", "", "seal the local PRNG's seed file with this key (file:, passphrase:, or tpm2: and a path)")
+	flags.StringVar(&seedSealing.generation, "seed-generation", "", "file recording the sealed seed's generation (default is the seed file with .generation appended)")
+	flags.Parse(args)
+
+	err := logging.Setup(*logFormat, *logLevel)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	config, err := sink.LoadConfig(*cfgFile)
+	if err != nil {
+		logging.Fatal("failed to load configuration", "file", *cfgFile, "error", err)
+	}
+
+	if *metricsAddr != "" {
+		metrics.Serve(*metricsAddr)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	outs, local := openOutputs(config, *seedFile)
+
+	srv, err := sink.New(config, outs)
+	if err != nil {
+		logging.Fatal("failed to start sink", "error", err)
+	}
+	srv.StateFile = *cfgFile
+
+	// Heartbeats take the server's lock, so that a stuck packet
+	// is noticed by the watchdog. A relay's heartbeats come from
+	// its scheduler.
+	interval := watchdogInterval()
+	heartbeat := func() {
+		srv.Counter()
+		notify(systemd.Watchdog)
+	}
+
+	var relay *source.Scheduler
+	var relayDone <-chan struct{}
+	if config.Relay != nil {
+		relay, relayDone = startRelay(ctx, config.Relay, interval, heartbeat)
+	} else if interval > 0 {
+		go beat(ctx, interval, heartbeat)
+	}
+
+	if *adminSocket != "" {
+		l := listenAdmin(*adminSocket, *cfgFile, srv, outs, relay, local)
+		defer l.Close()
+	}
+
+	stopped := shutdownOnDone(ctx, srv)
+	go reloadOnHangup(ctx, *cfgFile, srv, relay)
+
+	if *bundleFile != "" {
+		in, err := ioutil.ReadFile(*bundleFile)
+		if err != nil {
+			logging.Fatal("failed to read bundle", "file", *bundleFile, "error", err)
+		}
+
+		n, err := srv.Import(in, *rate)
+		if err == sink.ErrServerClosed {
+			slog.Warn("bundle import interrupted", "file", *bundleFile, "applied", n)
+		} else if err != nil {
+			logging.Fatal("failed to import bundle", "file", *bundleFile, "error", err)
+		} else {
+			slog.Info("imported bundle", "file", *bundleFile, "applied", n)
+		}
+	} else {
+		err = serve(srv)
+		if err != sink.ErrServerClosed {
+			logging.Fatal("sink stopped", "error", err)
+		}
+	}
+
+	// Shutting down the server persists its counter; the relay
+	// stores its targets as it stops.
+	stop()
+	<-stopped
+	if relayDone != nil {
+		<-relayDone
+	}
+
+	outs.Close()
+	if local {
+		prng.Shutdown()
+	}
+}
+
+// Enroll registers a new sink with a source using a one-time token
+// issued by the source's administrator. It generates the sink's
+// decryption key pair and writes it, along with a configuration
+// holding the source signer's public key; existing files aren't
+// overwritten.
+func Enroll(name string, args []string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	sourceAddr := flags.String("source", "", "address of the source's enrollment listener")
+	tokenString := flags.String("token", "", "enrollment token issued by the source")
+	advertise := flags.String("advertise", "", "address the source should send packets to")
+	listenAddr := flags.String("a", ":9437", "listener address")
+	cfgFile := flags.String("f", "config.json", "configuration file to write")
+	keyBase := flags.String("o", "decrypt", "base name of the key files to write")
+	drift := flags.Int64("d", 120, "clock drift value")
+	encrypt := flags.Bool("e", false, "seal the private key with a passphrase")
+	flags.StringVar(&util.PassphraseSpec, "passphrase", "", "read the passphrase from file:PATH or env:VAR instead of the terminal")
+	logFormat := flags.String("log-format", "text", "log format (text or json)")
+	logLevel := flags.String("log-level", "info", "minimum log level (debug, info, warn, or error)")
+	flags.Parse(args)
+
+	err := logging.Setup(*logFormat, *logLevel)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if *sourceAddr == "" || *tokenString == "" || *advertise == "" {
+		fmt.Fprintln(os.Stderr, "-source, -token, and -advertise are required")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	token, err := enroll.ParseToken(*tokenString)
+	if err != nil {
+		logging.Fatal("invalid token", "error", err)
+	}
+
+	keyFile, err := filepath.Abs(*keyBase + ".key")
+	if err != nil {
+		logging.Fatal("invalid key file", "error", err)
+	}
+
+	for _, path := range []string{*cfgFile, keyFile, *keyBase + ".pub"} {
+		if _, err := os.Stat(path); err == nil {
+			logging.Fatal("refusing to overwrite an existing file", "file", path)
+		}
+	}
+
+	var passphrase seal.Passphrase
+	if *encrypt {
+		passphrase, err = seal.ReadPassphrase(util.PassphraseSpec, true)
+		if err != nil {
+			logging.Fatal("failed to read passphrase", "error", err)
+		}
+	}
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		logging.Fatal("failed to generate key", "error", err)
+	}
+
+	// The keys are written, and the configuration file claimed,
+	// before enrolling, so that the source isn't told about a
+	// target whose keys can't be kept. Should anything fail, the
+	// files are removed again.
+	var written []string
+	fail := func(msg string, args ...any) {
+		for _, path := range written {
+			os.Remove(path)
+		}
+		logging.Fatal(msg, args...)
+	}
+
+	err = util.WritePrivateKey(keyFile, "CURVE25519 PRIVATE KEY", priv[:], false, passphrase)
+	if err != nil {
+		fail("failed to write private key", "file", keyFile, "error", err)
+	}
+	written = append(written, keyFile)
+
+	err = util.WritePublicKey(*keyBase+".pub", "CURVE25519 PUBLIC KEY", pub[:], false)
+	if err != nil {
+		fail("failed to write public key", "file", *keyBase+".pub", "error", err)
+	}
+	written = append(written, *keyBase+".pub")
+
+	cfg, err := os.OpenFile(*cfgFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		fail("can't write configuration", "file", *cfgFile, "error", err)
+	}
+	cfg.Close()
+	written = append(written, *cfgFile)
+
+	signer, err := enroll.Enroll(*sourceAddr, token, *advertise, pub[:])
+	if err != nil {
+		fail("enrollment failed", "source", *sourceAddr, "error", err)
+	}
+
+	config := &sink.Config{
+		Address:     *listenAddr,
+		Signer:      signer,
+		Drift:       *drift,
+		PrivateFile: keyFile,
+	}
+	err = config.Validate()
+	if err != nil {
+		fail("source sent an invalid signer key", "error", err)
+	}
+
+	err = config.Store(*cfgFile)
+	if err != nil {
+		fail("failed to write configuration", "file", *cfgFile, "error", err)
+	}
+	slog.Info("enrolled with source", "source", *sourceAddr, "target", *advertise,
+		"file", *cfgFile)
+}
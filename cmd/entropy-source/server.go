@@ -1,40 +1,11 @@
 package main
 
 import (
-	"crypto/rsa"
-	"crypto/x509"
-	"flag"
-	"io/ioutil"
-	"log"
+	"os"
 
-	"github.com/kisom/entropyshare/cmd/entropy-source/source"
-	"github.com/kisom/entropyshare/prng"
+	"github.com/kisom/entropyshare/cmd/entropy-source/sourced"
 )
 
-var signer *rsa.PrivateKey
-
-var config struct {
-	targets string
-	signer  string
-}
-
 func main() {
-	flag.StringVar(&config.signer, "k", "signer.key", "signature key")
-	seedFile := flag.String("s", "source.seed", "PRNG seed file")
-	flag.StringVar(&config.targets, "t", "targets.json", "test targets")
-	flag.Parse()
-
-	in, err := ioutil.ReadFile(config.signer)
-	if err != nil {
-		log.Fatalf("%v", err)
-	}
-	signer, err := x509.ParsePKCS1PrivateKey(in)
-	if err != nil {
-		log.Fatalf("%v", err)
-	}
-
-	prng.Start(*seedFile)
-
-	defer prng.StoreSeed()
-	source.Start(signer, config.targets)
+	sourced.Main(os.Args[0], os.Args[1:])
 }
@@ -1,57 +1,311 @@
 package source
 
 import (
+	"context"
 	"crypto/rsa"
-	"log"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/kisom/entropyshare/prng"
+	"github.com/kisom/entropyshare/admin"
+	"github.com/kisom/entropyshare/clock"
 	"github.com/kisom/entropyshare/target"
 )
 
+var (
+	// ErrNoTarget is returned when a command names a target that
+	// isn't in the targets file.
+	ErrNoTarget = errors.New("source: no such target")
+
+	// ErrTargetExists is returned by Add for an address that is
+	// already a target.
+	ErrTargetExists = errors.New("source: already a target")
+)
+
+// delay is the time between packets sent to a target.
+var delay = 6 * time.Hour
+
+// A Scheduler delivers entropy packets to the targets in a targets
+// file. The file is re-read on each scan, so that it may be edited
+// while the source is running.
+type Scheduler struct {
+	// If Heartbeat is set, it is called every HeartbeatInterval
+	// from the scheduler's loop, and between targets during a
+	// scan, so that a watchdog can tell if the scheduler is stuck
+	// without mistaking a scan of many unreachable targets for it.
+	Heartbeat         func()
+	HeartbeatInterval time.Duration
+
+	// Clock is used to stamp packets and to schedule scans; if
+	// it is nil, the system clock is used.
+	Clock clock.Clock
+
+	signer     *rsa.PrivateKey
+	targetFile string
+
+	// lock serialises access to the targets file.
+	lock sync.Mutex
+	wake chan struct{}
+
+	// lastBeat is when Heartbeat was last called, in Unix
+	// nanoseconds.
+	lastBeat int64
+}
+
+// NewScheduler returns a scheduler that signs packets with signer.
+func NewScheduler(signer *rsa.PrivateKey, targetFile string) *Scheduler {
+	return &Scheduler{
+		signer:     signer,
+		targetFile: targetFile,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
 // Start begins the source scanner. This function will continually
 // load the target list, and deliver entropy packets as appropriate.
 func Start(signer *rsa.PrivateKey, targetFile string) {
-	defer prng.StoreSeed()
+	NewScheduler(signer, targetFile).Run(context.Background())
+}
 
-	var delay = 6 * time.Hour
-	var targetUpdate bool
+// Run scans the targets every minute, or when Reload is called,
+// until ctx is done. A scan that is under way when ctx is done
+// finishes the send in progress and stores the targets before Run
+// returns.
+func (s *Scheduler) Run(ctx context.Context) {
+	clk := clock.Or(s.Clock)
+	var heartbeat <-chan time.Time
+	if s.Heartbeat != nil && s.HeartbeatInterval > 0 {
+		heartbeat = clk.After(s.HeartbeatInterval)
+	}
 
+	next := clk.After(0)
 	for {
-		log.Println("scanning targets")
-		now := time.Now().Unix()
-
-		targets := target.Load(targetFile)
-		for i, t := range targets {
-			updated := targetCheck(t, signer, now)
-			if updated {
-				targets[i].Next = now + int64(delay.Seconds())
-				targetUpdate = true
-			}
+		select {
+		case <-next:
+		case <-s.wake:
+		case <-heartbeat:
+			s.beat(clk, 0)
+			heartbeat = clk.After(s.HeartbeatInterval)
+			continue
+		case <-ctx.Done():
+			slog.Info("scheduler stopped", "file", s.targetFile)
+			return
 		}
 
-		if targetUpdate {
-			err := target.Store(targetFile, targets)
-			if err != nil {
-				log.Printf("%v", err)
-			}
-			targetUpdate = false
+		s.Scan(ctx)
+		next = clk.After(1 * time.Minute)
+	}
+}
+
+// Scan sends a packet to each target that is due, as Run does every
+// minute, and stores the targets. If the targets file can't be read,
+// perhaps because it is being edited, the error is logged and
+// returned, and the file is left as it is until the next scan.
+func (s *Scheduler) Scan(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	slog.Debug("scanning targets", "file", s.targetFile)
+	clk := clock.Or(s.Clock)
+	now := clk.Now().Unix()
+
+	targets, err := target.Read(s.targetFile)
+	if err != nil {
+		slog.Error("failed to read targets; skipping this scan",
+			"file", s.targetFile, "error", err)
+		return err
+	}
+
+	var targetUpdate bool
+	for i, t := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// Each send is bounded, but a scan of many unreachable
+		// targets isn't.
+		s.beat(clk, s.HeartbeatInterval)
+		updated := targetCheck(clk, t, s.signer, now)
+		if updated {
+			targets[i].Next = now + int64(delay.Seconds())
+			targetUpdate = true
+		}
+	}
+
+	if targetUpdate {
+		err = target.Store(s.targetFile, targets)
+		if err != nil {
+			slog.Error("failed to store targets",
+				"file", s.targetFile, "error", err)
 		}
-		<-time.After(1 * time.Minute)
 	}
+	return err
+}
+
+// beat calls Heartbeat, if it is set, unless it was called less than
+// since ago.
+func (s *Scheduler) beat(clk clock.Clock, since time.Duration) {
+	if s.Heartbeat == nil || s.HeartbeatInterval <= 0 {
+		return
+	}
+
+	now := clk.Now().UnixNano()
+	last := atomic.LoadInt64(&s.lastBeat)
+	if now-last < int64(since) || !atomic.CompareAndSwapInt64(&s.lastBeat, last, now) {
+		return
+	}
+	s.Heartbeat()
+}
+
+// Reload rescans the targets file now, rather than at the next
+// scheduled scan. It returns at once; Scan rescans synchronously.
+func (s *Scheduler) Reload() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Targets returns the targets in the targets file.
+func (s *Scheduler) Targets() ([]*target.Target, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return target.Read(s.targetFile)
 }
 
-func targetCheck(t *target.Target, signer *rsa.PrivateKey, now int64) bool {
-	if t.Next < now {
-		err := t.Send(signer)
+// SendNow sends a packet to the target at address immediately, even
+// if it isn't due or is paused.
+func (s *Scheduler) SendNow(address string) error {
+	clk := clock.Or(s.Clock)
+	return s.update(address, func(t *target.Target) error {
+		err := send(clk, t, s.signer)
 		if err != nil {
-			log.Printf("failed to send to %s: %v",
-				t.Address, err)
-			return false
-		} else {
-			log.Printf("send packet to %s", t.Address)
-			return true
+			return err
 		}
+		t.Next = clk.Now().Unix() + int64(delay.Seconds())
+		return nil
+	})
+}
+
+// Pause stops packets from being sent to the target at address
+// until it is resumed.
+func (s *Scheduler) Pause(address string) error {
+	return s.update(address, func(t *target.Target) error {
+		t.Paused = true
+		return nil
+	})
+}
+
+// Resume resumes sending packets to a paused target.
+func (s *Scheduler) Resume(address string) error {
+	return s.update(address, func(t *target.Target) error {
+		t.Paused = false
+		return nil
+	})
+}
+
+// Add adds a new target to the targets file, which is created if it
+// doesn't exist, and rescans the targets so that the target is sent
+// its first packet.
+func (s *Scheduler) Add(t *target.Target) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	targets, err := target.Read(s.targetFile)
+	if os.IsNotExist(err) {
+		targets = []*target.Target{}
+	} else if err != nil {
+		return err
+	}
+
+	if target.Find(targets, t.Address) != nil {
+		return ErrTargetExists
+	}
+
+	err = target.Store(s.targetFile, append(targets, t))
+	if err != nil {
+		return err
+	}
+	s.Reload()
+	return nil
+}
+
+// update applies f to the target at address, storing the targets
+// file if it succeeds.
+func (s *Scheduler) update(address string, f func(*target.Target) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	targets, err := target.Read(s.targetFile)
+	if err != nil {
+		return err
+	}
+
+	t := target.Find(targets, address)
+	if t == nil {
+		return ErrNoTarget
+	}
+
+	err = f(t)
+	if err != nil {
+		return err
+	}
+	return target.Store(s.targetFile, targets)
+}
+
+// RegisterAdmin adds the scheduler's commands to a control socket.
+func (s *Scheduler) RegisterAdmin(a *admin.Server) {
+	a.Handle("targets", "list the targets and their state", func([]string) (interface{}, error) {
+		return s.Targets()
+	})
+	a.Handle("send", "send a packet to a target now: send address", s.addressCommand(s.SendNow))
+	a.Handle("pause", "stop sending packets to a target: pause address", s.addressCommand(s.Pause))
+	a.Handle("resume", "resume sending packets to a target: resume address", s.addressCommand(s.Resume))
+	a.Handle("reload", "re-read the targets file now", func([]string) (interface{}, error) {
+		s.Reload()
+		return nil, nil
+	})
+}
+
+func (s *Scheduler) addressCommand(f func(string) error) admin.HandlerFunc {
+	return func(args []string) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, admin.ErrUsage
+		}
+		return nil, f(args[0])
+	}
+}
+
+func targetCheck(clk clock.Clock, t *target.Target, signer *rsa.PrivateKey, now int64) bool {
+	if t.Paused || t.Next >= now {
+		return false
+	}
+	return send(clk, t, signer) == nil
+}
+
+// send delivers a packet to the target, logging the outcome.
+func send(clk clock.Clock, t *target.Target, signer *rsa.PrivateKey) error {
+	logger := slog.With("target", t.Address)
+	err := t.Send(clk, signer)
+	if err != nil {
+		logger.Warn("failed to send packet", "counter", t.Counter,
+			"error", err, "error_class", errorClass(err))
+		return err
+	}
+	logger.Info("sent packet", "counter", t.Counter)
+	return nil
+}
+
+// errorClass distinguishes failures to reach a target from failures
+// to build a packet.
+func errorClass(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "network"
 	}
-	return false
+	return "packet"
 }
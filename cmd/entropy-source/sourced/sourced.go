@@ -0,0 +1,266 @@
+// Package sourced runs an entropy source: it delivers signed, encrypted
+// packets of PRNG output to its targets until it is told to stop.
+package sourced
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kisom/entropyshare/admin"
+	"github.com/kisom/entropyshare/clock"
+	"github.com/kisom/entropyshare/cmd/entropy-source/source"
+	"github.com/kisom/entropyshare/enroll"
+	"github.com/kisom/entropyshare/logging"
+	"github.com/kisom/entropyshare/metrics"
+	"github.com/kisom/entropyshare/prng"
+	"github.com/kisom/entropyshare/seal"
+	"github.com/kisom/entropyshare/systemd"
+	"github.com/kisom/entropyshare/target"
+	"github.com/kisom/entropyshare/util"
+)
+
+var signer *rsa.PrivateKey
+
+var config struct {
+	targets string
+	signer  string
+}
+
+// Main runs the daemon with the given command line arguments; name
+// is used in usage messages.
+func Main(name string, args []string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&config.signer, "k", "signer.key", "signature key")
+	seedFile := flags.String("s", "source.seed", "PRNG seed file")
+	flags.StringVar(&config.targets, "t", "targets.json", "test targets")
+	exportFile := flags.String("export", "", "write an offline packet bundle to this file and exit")
+	exportTarget := flags.String("a", "", "address of the target to export a bundle for")
+	exportCount := flags.Int("n", 16, "number of packets to export")
+	exportValidity := flags.Duration("v", 30*24*time.Hour, "validity period of an exported bundle")
+	metricsAddr := flags.String("metrics", "", "address to serve Prometheus metrics on")
+	logFormat := flags.String("log-format", "text", "log format (text or json)")
+	logLevel := flags.String("log-level", "info", "minimum log level (debug, info, warn, or error)")
+	adminSocket := flags.String("admin", "", "path of the admin control socket")
+	enrollAddr := flags.String("enroll", "", "address to accept sink enrollments on; tokens are issued on the admin socket")
+	flags.StringVar(&util.PassphraseSpec, "passphrase", "", "read the passphrase for sealed keys from file:PATH or env:VAR instead of the terminal")
+	seedKey := flags.String("seed-key", "", "seal the seed file with this key (file:, passphrase:, or tpm2: and a path)")
+	seedGeneration := flags.String("seed-generation", "", "file recording the sealed seed's generation (default is the seed file with .generation appended)")
+	flags.Parse(args)
+
+	err := logging.Setup(*logFormat, *logLevel)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	in, err := util.ReadPrivateKey(config.signer, "PRIVATE KEY", "RSA PRIVATE KEY")
+	if err != nil {
+		logging.Fatal("failed to read signature key", "file", config.signer, "error", err)
+	}
+	signer, err := x509.ParsePKCS1PrivateKey(in)
+	if err != nil {
+		logging.Fatal("failed to parse signature key", "file", config.signer, "error", err)
+	}
+
+	if *metricsAddr != "" {
+		metrics.Serve(*metricsAddr)
+	}
+
+	if *seedKey != "" {
+		sealSeed(*seedKey, *seedGeneration, *seedFile)
+	}
+	prng.Start(*seedFile)
+
+	defer prng.Shutdown()
+	if *exportFile != "" {
+		export(signer, *exportFile, *exportTarget, *exportCount, *exportValidity)
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *enrollAddr != "" && *adminSocket == "" {
+		logging.Fatal("enrollment tokens are issued on the admin socket, which isn't enabled")
+	}
+
+	scheduler := source.NewScheduler(signer, config.targets)
+	if *adminSocket != "" {
+		a := admin.NewServer()
+		scheduler.RegisterAdmin(a)
+		prng.RegisterAdmin(a)
+		if *enrollAddr != "" {
+			l := listenEnroll(a, *enrollAddr, signer, scheduler)
+			defer l.Close()
+		}
+		l := listenAdmin(a, *adminSocket)
+		defer l.Close()
+	}
+
+	setWatchdog(scheduler)
+	go reloadOnHangup(ctx, scheduler)
+	notify(systemd.Ready)
+	scheduler.Run(ctx)
+	slog.Info("shutting down")
+	notify(systemd.Stopping)
+}
+
+// sealSeed has the PRNG seal its seed file with the key described
+// by spec.
+func sealSeed(spec, generationFile, seedFile string) {
+	kp, err := seal.ParseKeyProvider(spec)
+	if err != nil {
+		logging.Fatal("invalid seed key", "key", spec, "error", err)
+	}
+
+	if generationFile == "" {
+		generationFile = seedFile + ".generation"
+	}
+	prng.SealSeed(kp, generationFile)
+}
+
+// notify tells systemd about a change in the source's state, if it
+// is running under systemd.
+func notify(state string) {
+	_, err := systemd.Notify(state)
+	if err != nil {
+		slog.Warn("failed to notify systemd", "state", state, "error", err)
+	}
+}
+
+// setWatchdog has the scheduler send heartbeats to systemd, if its
+// watchdog is enabled.
+func setWatchdog(scheduler *source.Scheduler) {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		slog.Warn("ignoring systemd watchdog", "error", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	scheduler.HeartbeatInterval = interval / 2
+	scheduler.Heartbeat = func() {
+		notify(systemd.Watchdog)
+	}
+}
+
+// listenAdmin opens the admin control socket and serves it in the
+// background.
+func listenAdmin(a *admin.Server, path string) net.Listener {
+	l, err := admin.Listen(path)
+	if err != nil {
+		logging.Fatal("failed to open admin socket", "path", path, "error", err)
+	}
+
+	slog.Info("serving admin socket", "path", path)
+	go a.Serve(l)
+	return l
+}
+
+// listenEnroll accepts sink enrollments on addr in the background,
+// adding enrolled sinks to the scheduler's targets. Tokens are issued
+// with the admin socket's enroll-token command.
+func listenEnroll(a *admin.Server, addr string, signer *rsa.PrivateKey, scheduler *source.Scheduler) net.Listener {
+	pub, err := x509.MarshalPKIXPublicKey(&signer.PublicKey)
+	if err != nil {
+		logging.Fatal("failed to encode signer's public key", "error", err)
+	}
+
+	srv := enroll.NewServer(pub, func(address string, public []byte) error {
+		return scheduler.Add(&target.Target{Address: address, Public: public})
+	})
+
+	a.Handle("enroll-token", "issue a one-time sink enrollment token: enroll-token [lifetime]", func(args []string) (interface{}, error) {
+		ttl := enroll.DefaultTTL
+		if len(args) > 1 {
+			return nil, admin.ErrUsage
+		} else if len(args) == 1 {
+			var err error
+			ttl, err = time.ParseDuration(args[0])
+			if err != nil || ttl <= 0 {
+				return nil, admin.ErrUsage
+			}
+		}
+
+		t, expires, err := srv.Issue(ttl)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("issued enrollment token", "expires", expires)
+		return struct {
+			Token   string
+			Expires time.Time
+		}{t.String(), expires}, nil
+	})
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		logging.Fatal("failed to listen for enrollments", "address", addr, "error", err)
+	}
+
+	slog.Info("accepting enrollments", "address", addr)
+	go srv.Serve(l)
+	return l
+}
+
+// reloadOnHangup re-reads the targets file whenever the source
+// receives a SIGHUP. The scan is made before systemd is told the
+// reload is done, so that it is only told once the targets have been
+// re-read.
+func reloadOnHangup(ctx context.Context, scheduler *source.Scheduler) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			slog.Info("reloading targets")
+			notify(systemd.Reloading)
+			if err := scheduler.Scan(ctx); err != nil {
+				slog.Error("failed to reload targets", "error", err)
+			}
+			notify(systemd.Ready)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// export writes a bundle of packets for the target at address to
+// bundleFile, and records the target's advanced counter.
+func export(signer *rsa.PrivateKey, bundleFile, address string, count int, validity time.Duration) {
+	targets := target.Load(config.targets)
+	t := target.Find(targets, address)
+	if t == nil {
+		logging.Fatal("no such target", "target", address)
+	}
+
+	out, err := t.Bundle(clock.System, signer, count, int64(validity.Seconds()))
+	if err != nil {
+		logging.Fatal("failed to build bundle", "target", address, "error", err)
+	}
+
+	err = ioutil.WriteFile(bundleFile, out, 0600)
+	if err != nil {
+		logging.Fatal("failed to write bundle", "file", bundleFile, "error", err)
+	}
+
+	err = target.Store(config.targets, targets)
+	if err != nil {
+		logging.Fatal("failed to store targets", "file", config.targets, "error", err)
+	}
+	slog.Info("wrote bundle", "target", address, "counter", t.Counter,
+		"packets", count, "file", bundleFile)
+}
@@ -8,13 +8,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+
+	"github.com/kisom/entropyshare/common"
 )
 
 var target struct {
-	Address string
-	Public  []byte
-	Counter int64
-	Next    int64 `json:",omitempty"`
+	Address   string
+	Public    []byte
+	Counter   int64
+	Next      int64 `json:",omitempty"`
+	ChunkSize int   `json:",omitempty"`
 }
 
 func checkError(err error) {
@@ -27,6 +30,7 @@ func main() {
 	flag.StringVar(&target.Address, "a", "", "address of sink")
 	flag.Int64Var(&target.Counter, "c", 0, "initial packet counter")
 	flag.Int64Var(&target.Next, "t", 0, "initial update timestamp")
+	flag.IntVar(&target.ChunkSize, "n", 0, "chunk size (0 uses the default)")
 	keyFile := flag.String("k", "decrypt.pub", "sink's decryption public key")
 	flag.Parse()
 
@@ -35,11 +39,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	if target.ChunkSize != 0 && (target.ChunkSize < common.MinChunkSize ||
+		target.ChunkSize > common.MaxChunkSize) {
+		fmt.Fprintf(os.Stderr, "[!] chunk size must be between %d and %d.\n",
+			common.MinChunkSize, common.MaxChunkSize)
+		os.Exit(1)
+	}
+
 	in, err := ioutil.ReadFile(*keyFile)
 	checkError(err)
 
 	if len(in) != 32 {
 		fmt.Fprintf(os.Stderr, "[!] invalid Curve25519 public key.\n")
+		os.Exit(1)
 	}
 
 	target.Public = in
@@ -0,0 +1,349 @@
+// Package suite contains a battery of statistical tests for the
+// output of an entropy source. The tests are drawn from NIST SP
+// 800-22, FIPS 140-1, SP 800-90B, and the ent utility. Passing them
+// doesn't show that data is unpredictable, only that it isn't
+// obviously broken.
+package suite
+
+import (
+	"bytes"
+	"compress/flate"
+	"math"
+)
+
+// Alpha is the significance level for tests that produce a p-value.
+const Alpha = 0.01
+
+// MinCompression is the smallest compressed-to-original size ratio
+// that passes the compression test.
+const MinCompression = 0.99
+
+// Result is the outcome of a single test. Tests that don't produce
+// a p-value have a nil PValue, and pass or fail on their statistic.
+type Result struct {
+	Name      string
+	Statistic float64
+	PValue    *float64 `json:",omitempty"`
+	Pass      bool
+}
+
+func pResult(name string, statistic, p float64) Result {
+	return Result{
+		Name:      name,
+		Statistic: statistic,
+		PValue:    &p,
+		Pass:      p >= Alpha,
+	}
+}
+
+// Run runs every test in the suite over data. Min-entropy estimates
+// below minEntropy bits per byte fail, unless data is too small for
+// uniform data to reach minEntropy; the threshold is then lowered to
+// MinEntropyBound.
+func Run(data []byte, minEntropy float64) []Result {
+	results := []Result{
+		Monobit(data),
+		Runs(data),
+		Poker(data),
+		ChiSquare(data),
+		SerialCorrelation(data),
+		Compression(data),
+	}
+
+	h := MinEntropy(data)
+	results = append(results, Result{
+		Name:      "min-entropy (most common value)",
+		Statistic: h,
+		Pass:      h >= math.Min(minEntropy, MinEntropyBound(len(data))),
+	})
+	return results
+}
+
+// Passed returns true if every result passed.
+func Passed(results []Result) bool {
+	for _, r := range results {
+		if !r.Pass {
+			return false
+		}
+	}
+	return true
+}
+
+func bit(data []byte, i int) int {
+	return int(data[i/8]>>(7-uint(i%8))) & 1
+}
+
+// Monobit is the SP 800-22 frequency test: the proportion of ones
+// should be close to one half.
+func Monobit(data []byte) Result {
+	n := len(data) * 8
+	var sum int
+	for i := 0; i < n; i++ {
+		sum += 2*bit(data, i) - 1
+	}
+
+	sObs := math.Abs(float64(sum)) / math.Sqrt(float64(n))
+	return pResult("monobit", sObs, math.Erfc(sObs/math.Sqrt2))
+}
+
+// Runs is the SP 800-22 runs test: the number of uninterrupted
+// sequences of identical bits should be as expected for random
+// data.
+func Runs(data []byte) Result {
+	n := len(data) * 8
+	if n == 0 {
+		return pResult("runs", 0, 0)
+	}
+
+	var ones int
+	for i := 0; i < n; i++ {
+		ones += bit(data, i)
+	}
+
+	pi := float64(ones) / float64(n)
+	if math.Abs(pi-0.5) >= 2/math.Sqrt(float64(n)) {
+		// The frequency prerequisite failed, so the runs
+		// test isn't meaningful.
+		return pResult("runs", 0, 0)
+	}
+
+	runs := 1
+	for i := 1; i < n; i++ {
+		if bit(data, i) != bit(data, i-1) {
+			runs++
+		}
+	}
+
+	v := float64(runs)
+	num := math.Abs(v - 2*float64(n)*pi*(1-pi))
+	den := 2 * math.Sqrt(2*float64(n)) * pi * (1 - pi)
+	return pResult("runs", v, math.Erfc(num/den))
+}
+
+// chiSquare returns the chi-square statistic for the observed counts
+// against a uniform distribution over len(counts) categories.
+func chiSquare(counts []int, total int) float64 {
+	expected := float64(total) / float64(len(counts))
+	var chi float64
+	for _, c := range counts {
+		d := float64(c) - expected
+		chi += d * d / expected
+	}
+	return chi
+}
+
+// Poker is the FIPS 140-1 poker test, a chi-square test on the
+// distribution of 4-bit nibbles.
+func Poker(data []byte) Result {
+	counts := make([]int, 16)
+	for _, b := range data {
+		counts[b>>4]++
+		counts[b&0xf]++
+	}
+
+	chi := chiSquare(counts, len(data)*2)
+	return pResult("poker", chi, Igamc(15.0/2, chi/2))
+}
+
+// ChiSquare is a chi-square test on the distribution of byte values.
+func ChiSquare(data []byte) Result {
+	counts := make([]int, 256)
+	for _, b := range data {
+		counts[b]++
+	}
+
+	chi := chiSquare(counts, len(data))
+	return pResult("chi-square", chi, Igamc(255.0/2, chi/2))
+}
+
+// SerialCorrelation computes the correlation between each byte and
+// the next, as ent does. For random data the coefficient is close to
+// zero, and approximately normal with variance 1/n.
+func SerialCorrelation(data []byte) Result {
+	n := float64(len(data))
+	if len(data) < 2 {
+		return pResult("serial correlation", 0, 0)
+	}
+
+	var t1, t2, t3 float64
+	for i := range data {
+		u := float64(data[i])
+		v := float64(data[(i+1)%len(data)])
+		t1 += u * v
+		t2 += u
+		t3 += u * u
+	}
+
+	var r float64
+	den := n*t3 - t2*t2
+	if den == 0 {
+		r = 1
+	} else {
+		r = (n*t1 - t2*t2) / den
+	}
+
+	z := math.Abs(r) * math.Sqrt(n)
+	return pResult("serial correlation", r, math.Erfc(z/math.Sqrt2))
+}
+
+// Compression compresses data with DEFLATE; random data shouldn't
+// compress at all. The statistic is the compressed-to-original size
+// ratio.
+func Compression(data []byte) Result {
+	buf := &bytes.Buffer{}
+	w, _ := flate.NewWriter(buf, flate.BestCompression)
+	w.Write(data)
+	w.Close()
+
+	var ratio float64
+	if len(data) > 0 {
+		ratio = float64(buf.Len()) / float64(len(data))
+	}
+
+	return Result{
+		Name:      "compression ratio",
+		Statistic: ratio,
+		Pass:      ratio >= MinCompression,
+	}
+}
+
+// MinEntropy is the SP 800-90B most common value estimate of
+// min-entropy, in bits per byte. It takes the upper bound of the 99%
+// confidence interval on the probability of the most common byte
+// value.
+func MinEntropy(data []byte) float64 {
+	n := len(data)
+	if n < 2 {
+		return 0
+	}
+
+	counts := make([]int, 256)
+	var mode int
+	for _, b := range data {
+		counts[b]++
+		if counts[b] > mode {
+			mode = counts[b]
+		}
+	}
+
+	return mcvEntropy(mode, n)
+}
+
+// mcvEntropy is the most common value estimate for a sample of n
+// bytes whose most common value occurs mode times.
+func mcvEntropy(mode, n int) float64 {
+	p := float64(mode) / float64(n)
+	pu := math.Min(1, p+2.576*math.Sqrt(p*(1-p)/float64(n-1)))
+	return -math.Log2(pu)
+}
+
+// MinEntropyBound is the lowest most common value estimate that
+// uniformly random data of n bytes gives, other than with probability
+// Alpha. The estimate is pessimistic, and more so the smaller the
+// sample: for 1 KiB, the bound is about 5.4 bits per byte.
+func MinEntropyBound(n int) float64 {
+	if n < 2 {
+		return 0
+	}
+
+	// The count of each byte value is binomial. Find the largest
+	// count that the most common of the 256 values exceeds with
+	// probability at most Alpha, bounding that probability by 256
+	// times that of a single value's count exceeding it.
+	const p = 1.0 / 256
+	lgn, _ := math.Lgamma(float64(n + 1))
+	pmf := func(k int) float64 {
+		lgk, _ := math.Lgamma(float64(k + 1))
+		lgnk, _ := math.Lgamma(float64(n - k + 1))
+		return math.Exp(lgn - lgk - lgnk + float64(k)*math.Log(p) +
+			float64(n-k)*math.Log1p(-p))
+	}
+
+	mean := float64(n) * p
+	mode := int(mean+20*math.Sqrt(mean)) + 20
+	if mode > n {
+		mode = n
+	}
+
+	var tail float64
+	for mode > 0 {
+		t := tail + pmf(mode)
+		if 256*t > Alpha {
+			break
+		}
+		tail = t
+		mode--
+	}
+	return mcvEntropy(mode, n)
+}
+
+// Igamc is the regularised upper incomplete gamma function Q(a, x),
+// which gives the p-value of a chi-square statistic chi with k
+// degrees of freedom as Q(k/2, chi/2).
+func Igamc(a, x float64) float64 {
+	if x < 0 || a <= 0 {
+		return 1
+	}
+
+	if x < a+1 {
+		return 1 - gammaSeries(a, x)
+	}
+	return gammaFraction(a, x)
+}
+
+const (
+	gammaIterations = 1000
+	gammaEpsilon    = 1e-15
+	gammaTiny       = 1e-300
+)
+
+// gammaSeries evaluates the lower regularised incomplete gamma
+// function P(a, x) by its series representation.
+func gammaSeries(a, x float64) float64 {
+	if x == 0 {
+		return 0
+	}
+
+	lga, _ := math.Lgamma(a)
+	ap := a
+	sum := 1 / a
+	del := sum
+	for i := 0; i < gammaIterations; i++ {
+		ap++
+		del *= x / ap
+		sum += del
+		if math.Abs(del) < math.Abs(sum)*gammaEpsilon {
+			break
+		}
+	}
+	return sum * math.Exp(-x+a*math.Log(x)-lga)
+}
+
+// gammaFraction evaluates Q(a, x) by its continued fraction
+// representation, using the modified Lentz method.
+func gammaFraction(a, x float64) float64 {
+	lga, _ := math.Lgamma(a)
+	b := x + 1 - a
+	c := 1 / gammaTiny
+	d := 1 / b
+	h := d
+	for i := 1; i <= gammaIterations; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < gammaTiny {
+			d = gammaTiny
+		}
+		c = b + an/c
+		if math.Abs(c) < gammaTiny {
+			c = gammaTiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < gammaEpsilon {
+			break
+		}
+	}
+	return math.Exp(-x+a*math.Log(x)-lga) * h
+}
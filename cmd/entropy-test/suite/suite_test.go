@@ -0,0 +1,84 @@
+package suite
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// testStream returns n bytes of deterministic, random-looking data:
+// SHA-256 in counter mode.
+func testStream(n int) []byte {
+	var data []byte
+	var block [8]byte
+	for i := uint64(0); len(data) < n; i++ {
+		binary.BigEndian.PutUint64(block[:], i)
+		sum := sha256.Sum256(block[:])
+		data = append(data, sum[:]...)
+	}
+	return data[:n]
+}
+
+func TestIgamc(t *testing.T) {
+	for _, x := range []float64{0.1, 1, 2.5, 10, 40} {
+		// Q(1, x) = e^-x
+		if d := math.Abs(Igamc(1, x) - math.Exp(-x)); d > 1e-10 {
+			t.Fatalf("Q(1, %f) is off by %g", x, d)
+		}
+
+		// Q(1/2, x) = erfc(sqrt(x))
+		if d := math.Abs(Igamc(0.5, x) - math.Erfc(math.Sqrt(x))); d > 1e-10 {
+			t.Fatalf("Q(1/2, %f) is off by %g", x, d)
+		}
+	}
+}
+
+func TestRandomPasses(t *testing.T) {
+	results := Run(testStream(1<<20), 7.5)
+	for _, r := range results {
+		if !r.Pass {
+			t.Fatalf("%s failed on random data: %+v", r.Name, r)
+		}
+	}
+}
+
+func TestSmallSamples(t *testing.T) {
+	for _, n := range []int{1 << 10, 1 << 12, 1 << 14} {
+		data := testStream(n)
+		if r := Run(data, 7.5); !Passed(r) {
+			t.Fatalf("%d bytes of random data failed: %+v", n, r)
+		}
+
+		if bound := MinEntropyBound(n); bound >= 7.5 {
+			t.Fatalf("the bound for %d bytes should be below 7.5, have %f", n, bound)
+		}
+	}
+
+	// With enough data, the given threshold applies.
+	if bound := MinEntropyBound(1 << 20); bound < 7.5 {
+		t.Fatalf("the bound for 1 MiB should be above 7.5, have %f", bound)
+	}
+}
+
+func TestBrokenFails(t *testing.T) {
+	zeros := make([]byte, 1<<16)
+	for _, r := range Run(zeros, 7.5) {
+		if r.Pass {
+			t.Fatalf("%s passed on all-zero data", r.Name)
+		}
+	}
+
+	// Alternating bits are perfectly balanced, but have far too
+	// many runs.
+	alternating := make([]byte, 1<<16)
+	for i := range alternating {
+		alternating[i] = 0x55
+	}
+	if r := Monobit(alternating); !r.Pass {
+		t.Fatal("balanced data should pass the monobit test")
+	}
+	if r := Runs(alternating); r.Pass {
+		t.Fatal("alternating bits should fail the runs test")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kisom/entropyshare/cmd/entropy-test/suite"
+	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/prng"
+	"github.com/kisom/entropyshare/seal"
+	"github.com/kisom/entropyshare/sink"
+)
+
+type report struct {
+	Source  string
+	Bytes   int
+	Pass    bool
+	Results []suite.Result
+}
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// readBundle decrypts the packets in a bundle with the sink's keys,
+// returning their chunks. Timestamps and counters aren't checked.
+func readBundle(bundleFile, cfgFile string) ([]byte, error) {
+	cfg, err := sink.LoadConfig(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(cfg.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("invalid public key")
+	}
+
+	in, err := ioutil.ReadFile(bundleFile)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := common.ParseBundle(in, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	for i, packet := range bundle.Packets {
+		p, err := common.ParseHybridPacket(packet, cfg.Private, cfg.KEMPrivate, signer)
+		if err != nil {
+			return nil, fmt.Errorf("packet %d: %v", i, err)
+		}
+		data = append(data, p.Chunk...)
+	}
+	return data, nil
+}
+
+// copyFile copies the file at from, if there is one, to to.
+func copyFile(from, to string) error {
+	in, err := ioutil.ReadFile(from)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(to, in, 0600)
+}
+
+// readPRNG starts the PRNG from a copy of seedFile and reads size
+// bytes from it. The PRNG rewrites its seed file, and the generation
+// file of a sealed one, as it runs; working on copies leaves the
+// seed in use by the source as it was, so that the test doesn't
+// replace it with one the source never produced.
+func readPRNG(seedFile string, kp seal.KeyProvider, generationFile string, size int, useTPM bool) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "entropy-test")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	seedCopy := filepath.Join(dir, "seed")
+	if err = copyFile(seedFile, seedCopy); err != nil {
+		return nil, err
+	}
+
+	if kp != nil {
+		generationCopy := filepath.Join(dir, "seed.generation")
+		if err = copyFile(generationFile, generationCopy); err != nil {
+			return nil, err
+		}
+		prng.SealSeed(kp, generationCopy)
+	}
+
+	if useTPM {
+		prng.Start(seedCopy)
+	} else {
+		prng.StartWithoutTPM(seedCopy)
+	}
+	defer prng.Shutdown()
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(prng.PRNG, data)
+	return data, err
+}
+
+func printReport(r *report) {
+	fmt.Printf("%s: %d bytes\n\n", r.Source, r.Bytes)
+	for _, res := range r.Results {
+		status := "PASS"
+		if !res.Pass {
+			status = "FAIL"
+		}
+
+		p := "-"
+		if res.PValue != nil {
+			p = fmt.Sprintf("%.6f", *res.PValue)
+		}
+		fmt.Printf("%-32s %s  statistic=%-14.6f p=%s\n", res.Name, status,
+			res.Statistic, p)
+	}
+
+	if r.Pass {
+		fmt.Println("\nall tests passed")
+	} else {
+		fmt.Println("\none or more tests failed")
+	}
+}
+
+func main() {
+	inFile := flag.String("f", "", "test the contents of a file")
+	bundleFile := flag.String("bundle", "", "test the chunks in a packet bundle")
+	cfgFile := flag.String("c", "config.json", "sink configuration with the keys to open a bundle")
+	seedFile := flag.String("prng", "", "test the output of the PRNG, using this seed file")
+	useTPM := flag.Bool("tpm", false, "seed the PRNG from the TPM")
+	seedKey := flag.String("seed-key", "", "key the PRNG's seed file is sealed with")
+	seedGeneration := flag.String("seed-generation", "", "file recording the sealed seed's generation")
+	size := flag.Int("n", 1<<20, "number of bytes to read from the PRNG")
+	minEntropy := flag.Float64("m", 7.5, "minimum acceptable min-entropy estimate, in bits per byte, lowered for samples too small to reach it")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	var r report
+	var err error
+	var data []byte
+	switch {
+	case *inFile != "":
+		r.Source = *inFile
+		data, err = ioutil.ReadFile(*inFile)
+	case *bundleFile != "":
+		r.Source = *bundleFile
+		data, err = readBundle(*bundleFile, *cfgFile)
+	case *seedFile != "":
+		r.Source = "PRNG"
+		var kp seal.KeyProvider
+		if *seedKey != "" {
+			kp, err = seal.ParseKeyProvider(*seedKey)
+			checkError(err)
+			if *seedGeneration == "" {
+				*seedGeneration = *seedFile + ".generation"
+			}
+		}
+		data, err = readPRNG(*seedFile, kp, *seedGeneration, *size, *useTPM)
+	default:
+		err = errors.New("one of -f, -bundle, or -prng is required")
+	}
+	checkError(err)
+
+	r.Bytes = len(data)
+	r.Results = suite.Run(data, *minEntropy)
+	r.Pass = suite.Passed(r.Results)
+
+	if *asJSON {
+		out, err := json.MarshalIndent(r, "", "\t")
+		checkError(err)
+		fmt.Printf("%s\n", out)
+	} else {
+		printReport(&r)
+	}
+
+	if !r.Pass {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kisom/entropyshare/admin"
+)
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[!] %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s -s socket command [args...]\n",
+		os.Args[0])
+	fmt.Fprintf(os.Stderr, "Run the help command for a list of commands.\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	socket := flag.String("s", "", "path of the daemon's admin control socket")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *socket == "" || flag.NArg() == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	result, err := admin.Call(*socket, flag.Arg(0), flag.Args()[1:]...)
+	checkError(err)
+
+	if len(result) == 0 || string(result) == "null" {
+		fmt.Println("OK")
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	checkError(json.Indent(buf, result, "", "    "))
+	fmt.Println(buf.String())
+}
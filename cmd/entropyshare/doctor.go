@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/kisom/entropyshare/doctor"
+	"github.com/kisom/entropyshare/sink"
+	"github.com/kisom/entropyshare/target"
+	"github.com/kisom/entropyshare/util"
+)
+
+// readSigner reads the signature key named by a flag, if one was
+// given.
+func readSigner(path string) (*rsa.PrivateKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return util.ReadSigner(path)
+}
+
+// writeFindings reports the findings, returning errReported if any
+// of them is an error.
+func writeFindings(fs doctor.Findings) error {
+	if jsonOutput {
+		if fs == nil {
+			fs = doctor.Findings{}
+		}
+		if err := report(fs, ""); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range fs {
+			subject := ""
+			if f.Subject != "" {
+				subject = f.Subject + ": "
+			}
+			fmt.Printf("[%s] %s%s: %s\n", f.Severity, subject, f.Check, f.Message)
+		}
+	}
+
+	if fs.Failed() {
+		return errReported
+	}
+	return nil
+}
+
+func doctorSink(name string, args []string) error {
+	flags := newFlagSet(name)
+	cfgFile := flags.String("f", "config.json", "sink configuration file")
+	signerFile := flags.String("k", "", "source's signature key, to check the configured signer against")
+	flags.StringVar(&util.PassphraseSpec, "passphrase", "", "read the passphrase for sealed keys from file:PATH or env:VAR instead of the terminal")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	cfg, err := sink.LoadConfig(*cfgFile)
+	if err != nil {
+		return err
+	}
+
+	signer, err := readSigner(*signerFile)
+	if err != nil {
+		return err
+	}
+	return writeFindings(doctor.Sink(cfg, &doctor.Options{Signer: signer}))
+}
+
+func doctorTargets(name string, args []string) error {
+	flags := newFlagSet(name)
+	targetsFile := flags.String("t", "targets.json", "targets file")
+	keyFile := flags.String("k", "", "a sink's private key, to find and self-test its target")
+	kemFile := flags.String("kem", "", "the sink's ML-KEM key, to self-test hybrid packets to its target")
+	signerFile := flags.String("s", "", "source's signature key, to sign the self-test with")
+	flags.StringVar(&util.PassphraseSpec, "passphrase", "", "read the passphrase for sealed keys from file:PATH or env:VAR instead of the terminal")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	targets, err := target.Read(*targetsFile)
+	if err != nil {
+		return err
+	}
+
+	opts := &doctor.Options{}
+	if *keyFile != "" {
+		opts.Private, err = util.ReadPrivateKey(*keyFile, "CURVE25519 PRIVATE KEY")
+		if err != nil {
+			return err
+		}
+	}
+
+	if *kemFile != "" {
+		opts.KEMPrivate, err = util.ReadPrivateKey(*kemFile, "ML-KEM-768 PRIVATE KEY")
+		if err != nil {
+			return err
+		}
+	}
+
+	opts.Signer, err = readSigner(*signerFile)
+	if err != nil {
+		return err
+	}
+	return writeFindings(doctor.Targets(targets, opts))
+}
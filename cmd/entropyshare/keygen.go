@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+
+	"code.google.com/p/go.crypto/nacl/box"
+	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/common/crypt"
+	"github.com/kisom/entropyshare/seal"
+	"github.com/kisom/entropyshare/util"
+)
+
+// keyPair describes the key files written by a keygen command.
+type keyPair struct {
+	Type        string
+	Private     string
+	Public      string
+	Fingerprint string
+	Sealed      bool
+}
+
+// keygenFlags holds the flags shared by the keygen commands.
+type keygenFlags struct {
+	base    *string
+	armour  *bool
+	encrypt *bool
+}
+
+func newKeygenFlags(flags *flag.FlagSet, base string) *keygenFlags {
+	flags.StringVar(&util.PassphraseSpec, "passphrase", "", "read the passphrase from file:PATH or env:VAR instead of the terminal")
+	return &keygenFlags{
+		base:    flags.String("o", base, "output file base name"),
+		armour:  flags.Bool("a", false, "armour the keys"),
+		encrypt: flags.Bool("e", false, "seal the private key with a passphrase"),
+	}
+}
+
+// write writes the key pair to the base name with .key and .pub
+// appended, sealing the private key if -e was given.
+func (kf *keygenFlags) write(keyType, privType string, priv []byte, pubType string, pub []byte) error {
+	if *kf.base == "" {
+		return errors.New("no output base filename specified")
+	}
+
+	var passphrase seal.Passphrase
+	if *kf.encrypt {
+		var err error
+		passphrase, err = seal.ReadPassphrase(util.PassphraseSpec, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	kp := &keyPair{
+		Type:        keyType,
+		Private:     *kf.base + ".key",
+		Public:      *kf.base + ".pub",
+		Fingerprint: util.Fingerprint(pub),
+		Sealed:      passphrase != nil,
+	}
+
+	err := util.WritePrivateKey(kp.Private, privType, priv, *kf.armour, passphrase)
+	if err != nil {
+		return err
+	}
+
+	err = util.WritePublicKey(kp.Public, pubType, pub, *kf.armour)
+	if err != nil {
+		return err
+	}
+	return report(kp, "wrote %s private key to %s and public key to %s (%s)",
+		keyType, kp.Private, kp.Public, kp.Fingerprint)
+}
+
+func keygenRSA(name string, args []string) error {
+	flags := newFlagSet(name)
+	kf := newKeygenFlags(flags, "signer")
+	keySize := flags.Int("s", 2048, "RSA key size")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	if *keySize < 2048 {
+		return errors.New("RSA keys must be at least 2048 bits")
+	} else if *keySize > common.MaxSignerBits {
+		return fmt.Errorf("RSA keys must be at most %d bits", common.MaxSignerBits)
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, *keySize)
+	if err != nil {
+		return err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	return kf.write("rsa", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv),
+		"RSA PUBLIC KEY", pub)
+}
+
+// keygenEd25519 generates an Ed25519 key pair, in PKCS #8 and PKIX
+// form. Packets are still signed with RSA, so an Ed25519 key can't
+// yet be used as a source's signature key.
+func keygenEd25519(name string, args []string) error {
+	flags := newFlagSet(name)
+	kf := newKeygenFlags(flags, "ed25519")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	return kf.write("ed25519", "PRIVATE KEY", privDER, "PUBLIC KEY", pubDER)
+}
+
+func keygenCurve25519(name string, args []string) error {
+	flags := newFlagSet(name)
+	kf := newKeygenFlags(flags, "decrypt")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	return kf.write("curve25519", "CURVE25519 PRIVATE KEY", priv[:],
+		"CURVE25519 PUBLIC KEY", pub[:])
+}
+
+// keygenMLKEM generates an ML-KEM-768 key pair, which a sink uses
+// alongside its Curve25519 key for hybrid sealing. The private key is
+// kept as its 64-byte seed.
+func keygenMLKEM(name string, args []string) error {
+	flags := newFlagSet(name)
+	kf := newKeygenFlags(flags, "kem")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	pub, priv, err := crypt.GenerateKEMKey()
+	if err != nil {
+		return err
+	}
+	return kf.write("ml-kem-768", "ML-KEM-768 PRIVATE KEY", priv,
+		"ML-KEM-768 PUBLIC KEY", pub)
+}
@@ -0,0 +1,148 @@
+// Command entropyshare brings the entropyshare tools together under
+// one command. Every subcommand takes a --json flag to write its
+// output as JSON, and exits with a non-zero status if its input fails
+// validation.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A command is one of entropyshare's subcommands, such as "target
+// add".
+type command struct {
+	name    string
+	summary string
+	run     func(name string, args []string) error
+}
+
+var commands = []command{
+	{"keygen rsa", "generate an RSA signature key pair", keygenRSA},
+	{"keygen ed25519", "generate an Ed25519 key pair", keygenEd25519},
+	{"keygen curve25519", "generate a Curve25519 decryption key pair", keygenCurve25519},
+	{"keygen mlkem", "generate an ML-KEM-768 key pair for hybrid sealing", keygenMLKEM},
+	{"sink init", "write a sink configuration", sinkInit},
+	{"sink enroll", "register a new sink with a source", sinkEnroll},
+	{"sink run", "run a sink", sinkRun},
+	{"sink migrate", "convert a JSON sink configuration to TOML", sinkMigrate},
+	{"source run", "run a source", sourceRun},
+	{"target add", "add a sink to a source's targets", targetAdd},
+	{"target remove", "remove a sink from a source's targets", targetRemove},
+	{"target list", "list a source's targets", targetList},
+	{"target migrate", "convert a JSON targets file to TOML", targetMigrate},
+	{"doctor sink", "check that a sink configuration is usable", doctorSink},
+	{"doctor targets", "check that a source's targets are usable", doctorTargets},
+	{"packet inspect", "decrypt and describe a captured wire packet", packetInspect},
+}
+
+// errUsage is returned when a command is given bad arguments; the
+// usage message has already been printed.
+var errUsage = errors.New("invalid usage")
+
+// errReported is returned by a command whose output already explains
+// its failure; it only sets the exit status.
+var errReported = errors.New("failure already reported")
+
+// jsonOutput is set by the --json flag that every command takes.
+var jsonOutput bool
+
+// newFlagSet returns the flag set for a command, with the --json flag
+// shared by all of them.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("entropyshare "+name, flag.ContinueOnError)
+	flags.BoolVar(&jsonOutput, "json", false, "write output as JSON")
+	return flags
+}
+
+// parseFlags parses a command's arguments, which must all be flags.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		return errUsage
+	}
+
+	if flags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", flags.Arg(0))
+		flags.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// report writes a command's result: v as indented JSON if --json was
+// given, and otherwise the text.
+func report(v interface{}, format string, args ...interface{}) error {
+	if !jsonOutput {
+		fmt.Printf(format+"\n", args...)
+		return nil
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	err = json.Indent(buf, out, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", buf.Bytes())
+	return nil
+}
+
+// fail reports an error, as JSON if --json was given, and exits. A
+// usage error has already been reported by the flag set.
+func fail(err error) {
+	if err == errUsage {
+		os.Exit(2)
+	} else if err == errReported {
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		out, _ := json.Marshal(struct{ Error string }{err.Error()})
+		fmt.Printf("%s\n", out)
+	} else {
+		fmt.Fprintf(os.Stderr, "[!] %v\n", err)
+	}
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: entropyshare command subcommand [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "\t%-20s%s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun a command with -h for its flags.\n")
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := os.Args[1] + " " + os.Args[2]
+	for _, c := range commands {
+		if c.name == name {
+			err := c.run(name, os.Args[3:])
+			if err != nil {
+				fail(err)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", strings.Join(os.Args[1:3], " "))
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/kisom/entropyshare/common/crypt"
+	"github.com/kisom/entropyshare/inspect"
+	"github.com/kisom/entropyshare/util"
+)
+
+func packetInspect(name string, args []string) error {
+	flags := newFlagSet(name)
+	packetFile := flags.String("p", "", "captured wire packet")
+	keyFile := flags.String("k", "", "sink's decryption key")
+	kemFile := flags.String("kem", "", "sink's ML-KEM key, to open packets sealed with the hybrid key agreement")
+	signerFile := flags.String("s", "", "signer's public key")
+	flags.StringVar(&util.PassphraseSpec, "passphrase", "", "read the passphrase for a sealed key from file:PATH or env:VAR instead of the terminal")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	if *packetFile == "" {
+		return errors.New("no packet file provided")
+	}
+
+	in, err := ioutil.ReadFile(*packetFile)
+	if err != nil {
+		return err
+	}
+
+	var priv []byte
+	if *keyFile != "" {
+		priv, err = util.ReadPrivateKey(*keyFile, "CURVE25519 PRIVATE KEY")
+		if err != nil {
+			return err
+		}
+	}
+
+	var kemPriv []byte
+	if *kemFile != "" {
+		kemPriv, err = util.ReadPrivateKey(*kemFile, "ML-KEM-768 PRIVATE KEY")
+		if err != nil {
+			return err
+		} else if len(kemPriv) != crypt.KEMPrivateKeySize {
+			return crypt.ErrInvalidKEMKey
+		}
+	}
+
+	var signer *rsa.PublicKey
+	if *signerFile != "" {
+		signer, err = util.ReadSignerPublic(*signerFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	r := inspect.Packet(in, priv, kemPriv, signer, time.Now())
+	if jsonOutput {
+		err = report(r, "")
+	} else {
+		r.WriteText(os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.Failed != "" {
+		return errReported
+	}
+	return nil
+}
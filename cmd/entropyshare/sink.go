@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kisom/entropyshare/cmd/entropy-sink/sinkd"
+	"github.com/kisom/entropyshare/seal"
+	"github.com/kisom/entropyshare/sink"
+	"github.com/kisom/entropyshare/util"
+)
+
+// sinkInit writes a new sink configuration; it refuses to overwrite
+// an existing one, which holds the sink's counter.
+func sinkInit(name string, args []string) error {
+	var config sink.Config
+	flags := newFlagSet(name)
+	cfgFile := flags.String("f", "config.json", "configuration file to write; a .toml file keeps the counter in a separate state file")
+	flags.StringVar(&config.Address, "a", ":9437", "listener address")
+	keyFile := flags.String("k", "decrypt.key", "key file for decryption")
+	kemFile := flags.String("kem", "", "ML-KEM key file, to accept packets sealed with the hybrid key agreement")
+	signerFile := flags.String("s", "signer.pub", "signer's public key")
+	flags.Int64Var(&config.Drift, "d", 120, "clock drift value")
+	flags.IntVar(&config.MinChunk, "min", 0, "minimum accepted chunk size")
+	flags.IntVar(&config.MaxChunk, "max", 0, "maximum accepted chunk size")
+	reference := flags.Bool("r", false, "refer to the key file rather than embedding the key")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(*cfgFile); err == nil {
+		return errors.New(*cfgFile + " already exists")
+	}
+
+	in, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	// A sealed key can't be embedded without its passphrase, and
+	// a TOML configuration never embeds keys, so either always
+	// refers to the key file.
+	if *reference || seal.IsSealedKey(in) || filepath.Ext(*cfgFile) == ".toml" {
+		config.PrivateFile, err = filepath.Abs(*keyFile)
+	} else {
+		config.Private, err = util.ReadPrivateKey(*keyFile, "CURVE25519 PRIVATE KEY")
+	}
+	if err != nil {
+		return err
+	}
+
+	if *kemFile != "" {
+		if err = readKEMKey(&config, *kemFile, *reference || filepath.Ext(*cfgFile) == ".toml"); err != nil {
+			return err
+		}
+	}
+
+	config.Signer, err = util.ReadPublicKey(*signerFile, "PUBLIC KEY", "RSA PUBLIC KEY")
+	if err != nil {
+		return err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = config.Store(*cfgFile)
+	if err != nil {
+		return err
+	}
+
+	// The private key is never reported.
+	result := struct {
+		File           string
+		Address        string
+		PrivateFile    string `json:",omitempty"`
+		KEMPrivateFile string `json:",omitempty"`
+	}{*cfgFile, config.Address, config.PrivateFile, config.KEMPrivateFile}
+	return report(result, "wrote sink configuration to %s", *cfgFile)
+}
+
+// readKEMKey sets the sink's ML-KEM key from keyFile, referring to the
+// file rather than embedding the key under the same conditions as the
+// decryption key.
+func readKEMKey(config *sink.Config, keyFile string, reference bool) error {
+	in, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	if reference || seal.IsSealedKey(in) {
+		config.KEMPrivateFile, err = filepath.Abs(keyFile)
+		return err
+	}
+
+	config.KEMPrivate, err = util.ReadPrivateKey(keyFile, "ML-KEM-768 PRIVATE KEY")
+	return err
+}
+
+// sinkMigrate converts a JSON sink configuration to TOML.
+func sinkMigrate(name string, args []string) error {
+	flags := newFlagSet(name)
+	from := flags.String("f", "config.json", "JSON configuration to convert")
+	to := flags.String("o", "sink.toml", "TOML configuration to write")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	if err := sink.Migrate(*from, *to); err != nil {
+		return err
+	}
+
+	result := struct{ From, To string }{*from, *to}
+	return report(result, "converted %s to %s", *from, *to)
+}
+
+// sinkEnroll registers a new sink with a source, taking the same
+// flags as entropy-sink enroll.
+func sinkEnroll(name string, args []string) error {
+	sinkd.Enroll("entropyshare "+name, runArgs(args))
+	return nil
+}
+
+// sinkRun runs a sink, taking the same flags as entropy-sink.
+func sinkRun(name string, args []string) error {
+	sinkd.Main("entropyshare "+name, runArgs(args))
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/kisom/entropyshare/cmd/entropy-source/sourced"
+)
+
+// sourceRun runs a source, taking the same flags as entropy-source.
+func sourceRun(name string, args []string) error {
+	sourced.Main("entropyshare "+name, runArgs(args))
+	return nil
+}
+
+// runArgs translates the --json flag for the daemons, which log as
+// JSON with it, into their -log-format flag.
+func runArgs(args []string) []string {
+	out := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch arg {
+		case "-json", "--json", "-json=true", "--json=true":
+			out = append(out, "-log-format=json")
+		case "-json=false", "--json=false":
+		default:
+			out = append(out, arg)
+		}
+	}
+	return out
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/common/crypt"
+	"github.com/kisom/entropyshare/target"
+	"github.com/kisom/entropyshare/util"
+)
+
+// readTargets reads a targets file; if create is set, a missing file
+// is taken to hold no targets.
+func readTargets(path string, create bool) ([]*target.Target, error) {
+	targets, err := target.Read(path)
+	if os.IsNotExist(err) && create {
+		return []*target.Target{}, nil
+	}
+	return targets, err
+}
+
+func targetAdd(name string, args []string) error {
+	t := &target.Target{}
+	flags := newFlagSet(name)
+	targetsFile := flags.String("t", "targets.json", "targets file")
+	flags.StringVar(&t.Address, "a", "", "address of the sink")
+	flags.Int64Var(&t.Counter, "c", 0, "initial packet counter")
+	flags.Int64Var(&t.Next, "next", 0, "initial update timestamp")
+	flags.IntVar(&t.ChunkSize, "n", 0, "chunk size (0 uses the default)")
+	flags.BoolVar(&t.Cookie, "cookie", false, "the sink requires a cookie")
+	flags.BoolVar(&t.Session, "session", false, "deliver packets in forward-secret sessions")
+	keyFile := flags.String("k", "decrypt.pub", "sink's decryption public key")
+	kemFile := flags.String("kem", "", "sink's ML-KEM public key, to seal packets with the hybrid key agreement")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	if t.Address == "" {
+		return errors.New("no address provided")
+	}
+
+	if t.ChunkSize != 0 && (t.ChunkSize < common.MinChunkSize ||
+		t.ChunkSize > common.MaxChunkSize) {
+		return fmt.Errorf("chunk size must be between %d and %d",
+			common.MinChunkSize, common.MaxChunkSize)
+	}
+
+	var err error
+	t.Public, err = util.ReadPublicKey(*keyFile, "CURVE25519 PUBLIC KEY")
+	if err != nil {
+		return err
+	} else if len(t.Public) != 32 {
+		return errors.New("invalid Curve25519 public key")
+	}
+
+	if *kemFile != "" {
+		if t.Session {
+			return errors.New("-session and -kem can't be used together")
+		}
+
+		t.KEMPublic, err = util.ReadPublicKey(*kemFile, "ML-KEM-768 PUBLIC KEY")
+		if err != nil {
+			return err
+		} else if len(t.KEMPublic) != crypt.KEMPublicKeySize {
+			return errors.New("invalid ML-KEM public key")
+		}
+	}
+
+	targets, err := readTargets(*targetsFile, true)
+	if err != nil {
+		return err
+	}
+
+	if target.Find(targets, t.Address) != nil {
+		return fmt.Errorf("%s is already a target", t.Address)
+	}
+
+	err = target.Store(*targetsFile, append(targets, t))
+	if err != nil {
+		return err
+	}
+	return report(t, "added %s to %s", t.Address, *targetsFile)
+}
+
+func targetRemove(name string, args []string) error {
+	flags := newFlagSet(name)
+	targetsFile := flags.String("t", "targets.json", "targets file")
+	address := flags.String("a", "", "address of the sink")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	targets, err := readTargets(*targetsFile, false)
+	if err != nil {
+		return err
+	}
+
+	t := target.Find(targets, *address)
+	if t == nil {
+		return fmt.Errorf("%s isn't a target", *address)
+	}
+
+	kept := targets[:0]
+	for _, other := range targets {
+		if other != t {
+			kept = append(kept, other)
+		}
+	}
+
+	err = target.Store(*targetsFile, kept)
+	if err != nil {
+		return err
+	}
+	return report(t, "removed %s from %s", t.Address, *targetsFile)
+}
+
+func targetList(name string, args []string) error {
+	flags := newFlagSet(name)
+	targetsFile := flags.String("t", "targets.json", "targets file")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	targets, err := readTargets(*targetsFile, false)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return report(targets, "")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tCOUNTER\tNEXT\tCHUNK\tPAUSED")
+	for _, t := range targets {
+		chunk := t.ChunkSize
+		if chunk == 0 {
+			chunk = common.ChunkSize
+		}
+
+		next := "-"
+		if t.Next != 0 {
+			next = time.Unix(t.Next, 0).Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%v\n", t.Address, t.Counter,
+			next, chunk, t.Paused)
+	}
+	return w.Flush()
+}
+
+// targetMigrate converts a JSON targets file to TOML.
+func targetMigrate(name string, args []string) error {
+	flags := newFlagSet(name)
+	from := flags.String("t", "targets.json", "JSON targets file to convert")
+	to := flags.String("o", "targets.toml", "TOML targets file to write")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	if err := target.Migrate(*from, *to); err != nil {
+		return err
+	}
+
+	result := struct{ From, To string }{*from, *to}
+	return report(result, "converted %s to %s", *from, *to)
+}
@@ -4,11 +4,11 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
-	"encoding/pem"
 	"flag"
-	"io/ioutil"
 	"log"
 
+	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/seal"
 	"github.com/kisom/entropyshare/util"
 )
 
@@ -17,6 +17,8 @@ func main() {
 	keyFile := flag.String("key", "", "key file to dump public key from")
 	outFile := flag.String("o", "signer", "output file base name")
 	keySize := flag.Int("s", 2048, "RSA key size")
+	encrypt := flag.Bool("e", false, "seal the private key with a passphrase")
+	flag.StringVar(&util.PassphraseSpec, "passphrase", "", "read the passphrase from file:PATH or env:VAR instead of the terminal")
 	flag.Parse()
 
 	if *keyFile != "" {
@@ -29,26 +31,32 @@ func main() {
 		log.Fatal("no output base filename specified")
 	}
 
+	if *keySize > common.MaxSignerBits {
+		log.Fatalf("RSA keys must be at most %d bits", common.MaxSignerBits)
+	}
+
 	priv, err := rsa.GenerateKey(rand.Reader, *keySize)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
 
-	dumpPrivate(priv, *outFile, *armour)
-	dumpPublic(priv, *outFile, *armour)
-}
-
-func dumpPrivate(priv *rsa.PrivateKey, baseName string, armour bool) {
-	out := x509.MarshalPKCS1PrivateKey(priv)
-	if armour {
-		p := &pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: out,
+	var passphrase seal.Passphrase
+	if *encrypt {
+		passphrase, err = seal.ReadPassphrase(util.PassphraseSpec, true)
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
-		out = pem.EncodeToMemory(p)
 	}
 
-	err := ioutil.WriteFile(baseName+".key", out, 0600)
+	dumpPrivate(priv, *outFile, *armour, passphrase)
+	dumpPublic(priv, *outFile, *armour)
+}
+
+// dumpPrivate writes the private key; if a passphrase is given, it
+// is sealed with the passphrase, and is always armoured.
+func dumpPrivate(priv *rsa.PrivateKey, baseName string, armour bool, passphrase seal.Passphrase) {
+	err := util.WritePrivateKey(baseName+".key", "RSA PRIVATE KEY",
+		x509.MarshalPKCS1PrivateKey(priv), armour, passphrase)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -61,15 +69,7 @@ func dumpPublic(priv *rsa.PrivateKey, baseName string, armour bool) {
 		log.Fatalf("%v", err)
 	}
 
-	if armour {
-		p := &pem.Block{
-			Type:  "RSA PUBLIC KEY",
-			Bytes: out,
-		}
-		out = pem.EncodeToMemory(p)
-	}
-
-	err = ioutil.WriteFile(baseName+".pub", out, 0644)
+	err = util.WritePublicKey(baseName+".pub", "RSA PUBLIC KEY", out, armour)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+
+	"github.com/kisom/entropyshare/common/crypt"
+)
+
+// A Bundle carries pre-generated wire packets to a sink that can't be
+// reached over the network. The bundle is signed as a whole, and its
+// packets are only accepted between NotBefore and NotAfter.
+type Bundle struct {
+	NotBefore int64
+	NotAfter  int64
+	Packets   [][]byte
+}
+
+var (
+	ErrUnsignedBundle = errors.New("bundle was not signed")
+	ErrBundleWindow   = errors.New("invalid bundle validity window")
+)
+
+// SerialiseBundle packs and signs a bundle for transport.
+func SerialiseBundle(b *Bundle, signer *rsa.PrivateKey) ([]byte, error) {
+	if signer == nil {
+		return nil, ErrUnsignedBundle
+	}
+
+	if b.NotAfter <= b.NotBefore {
+		return nil, ErrBundleWindow
+	}
+
+	out, err := asn1.Marshal(*b)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypt.Sign(out, signer)
+}
+
+// ParseBundle verifies and unpacks a bundle. The individual packets
+// are left encrypted, and should be applied with
+// ParseAndWriteOfflinePacket.
+func ParseBundle(in []byte, signer *rsa.PublicKey) (*Bundle, error) {
+	msg, signed, err := crypt.Verify(in, signer)
+	if err != nil {
+		return nil, err
+	} else if !signed {
+		return nil, ErrUnsignedBundle
+	}
+
+	var b Bundle
+	_, err = asn1.Unmarshal(msg, &b)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.NotAfter <= b.NotBefore {
+		return nil, ErrBundleWindow
+	}
+	return &b, nil
+}
@@ -15,11 +15,6 @@ import (
 
 const symKeyLen = 32
 
-type signed struct {
-	Message   []byte
-	Signature []byte
-}
-
 // NonceSize contains the size, in bytes, of a NaCl nonce.
 const nonceSize = 24
 
@@ -55,19 +50,7 @@ func Encrypt(message []byte, peer []byte, signer *rsa.PrivateKey) ([]byte, error
 	var pub [32]byte
 	copy(pub[:], peer)
 
-	var signed signed
-	var err error
-
-	signed.Message = message
-	if signer != nil {
-		digest := sha256.Sum256(message)
-		signed.Signature, err = rsa.SignPSS(rand.Reader, signer, crypto.SHA256, digest[:], nil)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	sm, err := asn1.Marshal(signed)
+	sm, err := Sign(message, signer)
 	if err != nil {
 		return nil, err
 	}
@@ -84,47 +67,140 @@ func Encrypt(message []byte, peer []byte, signer *rsa.PrivateKey) ([]byte, error
 	return out, nil
 }
 
+var (
+	ErrBoxSize      = errors.New("crypt: invalid box size")
+	ErrDecrypt      = errors.New("crypt: decryption failure")
+	ErrNoPrivateKey = errors.New("crypt: no private key provided")
+	ErrNoSigner     = errors.New("crypt: no signer public key provided")
+)
+
 const msgStart = 32 + nonceSize
-const overhead = 32 + nonceSize + box.Overhead
 
-func Decrypt(ciphertext []byte, priv []byte, signer *rsa.PublicKey) ([]byte, bool, error) {
-	var signedMessage bool
+// Overhead is the number of bytes a box adds to the signed message:
+// the ephemeral public key, the nonce, and the authenticator.
+const Overhead = 32 + nonceSize + box.Overhead
 
-	if priv == nil {
-		return nil, false, errors.New("crypt: no private key provided")
-	}
+// A Box is the outer layer of an encrypted message: the sender's
+// ephemeral public key, the nonce, and the sealed, signed message.
+type Box struct {
+	Ephemeral [32]byte
+	Nonce     [nonceSize]byte
+	Sealed    []byte
+}
 
-	if len(ciphertext) < (32 + nonceSize + box.Overhead) {
-		return nil, false, errors.New("crypt: invalid box size")
+// ParseBox splits an encrypted message into its box.
+func ParseBox(ciphertext []byte) (*Box, error) {
+	if len(ciphertext) < Overhead {
+		return nil, ErrBoxSize
 	}
 
-	var pub [32]byte
-	copy(pub[:], ciphertext[:32])
+	b := &Box{Sealed: ciphertext[msgStart:]}
+	copy(b.Ephemeral[:], ciphertext[:32])
+	copy(b.Nonce[:], ciphertext[32:])
+	return b, nil
+}
 
-	var nonce [nonceSize]byte
-	copy(nonce[:], ciphertext[32:])
+// Open decrypts and authenticates the box with the recipient's
+// private key, returning the signed message inside.
+func (b *Box) Open(priv []byte) ([]byte, error) {
+	if priv == nil {
+		return nil, ErrNoPrivateKey
+	}
 
 	var decrypt [32]byte
 	copy(decrypt[:], priv)
 
-	out, ok := box.Open(nil, ciphertext[msgStart:], &nonce, &pub, &decrypt)
+	out, ok := box.Open(nil, b.Sealed, &b.Nonce, &b.Ephemeral, &decrypt)
 	if !ok {
-		return nil, false, errors.New("crypt: decryption failure")
+		return nil, ErrDecrypt
+	}
+	return out, nil
+}
+
+func Decrypt(ciphertext []byte, priv []byte, signer *rsa.PublicKey) ([]byte, bool, error) {
+	if priv == nil {
+		return nil, false, ErrNoPrivateKey
+	}
+
+	b, err := ParseBox(ciphertext)
+	if err != nil {
+		return nil, false, err
 	}
 
-	var signed signed
-	_, err := asn1.Unmarshal(out, &signed)
+	out, err := b.Open(priv)
 	if err != nil {
 		return nil, false, err
 	}
 
-	if len(signed.Signature) != 0 {
-		digest := sha256.Sum256(signed.Message)
-		err = rsa.VerifyPSS(signer, crypto.SHA256, digest[:], signed.Signature, nil)
+	return Verify(out, signer)
+}
+
+// Sign packs the message alongside an RSA-PSS signature from
+// signer. If signer is nil, the message is packed without a
+// signature.
+func Sign(message []byte, signer *rsa.PrivateKey) ([]byte, error) {
+	var signed SignedMessage
+	var err error
+
+	signed.Message = message
+	if signer != nil {
+		digest := sha256.Sum256(message)
+		signed.Signature, err = rsa.SignPSS(rand.Reader, signer, crypto.SHA256, digest[:], nil)
 		if err != nil {
-			return nil, false, err
+			return nil, err
 		}
-		signedMessage = true
 	}
-	return signed.Message, signedMessage, nil
+
+	return asn1.Marshal(signed)
+}
+
+// A SignedMessage is a message packed by Sign.
+type SignedMessage struct {
+	Message   []byte
+	Signature []byte
+}
+
+// ParseSigned unpacks a message packed by Sign without checking its
+// signature.
+func ParseSigned(in []byte) (*SignedMessage, error) {
+	var signed SignedMessage
+	_, err := asn1.Unmarshal(in, &signed)
+	if err != nil {
+		return nil, err
+	}
+	return &signed, nil
+}
+
+// Signed reports whether the message carries a signature.
+func (sm *SignedMessage) Signed() bool {
+	return len(sm.Signature) != 0
+}
+
+// VerifySignature checks the message's signature against signer.
+func (sm *SignedMessage) VerifySignature(signer *rsa.PublicKey) error {
+	if signer == nil {
+		return ErrNoSigner
+	}
+
+	digest := sha256.Sum256(sm.Message)
+	return rsa.VerifyPSS(signer, crypto.SHA256, digest[:], sm.Signature, nil)
+}
+
+// Verify unpacks a message packed by Sign, checking its signature if
+// one is present. It returns the message and whether it was signed.
+func Verify(in []byte, signer *rsa.PublicKey) ([]byte, bool, error) {
+	signed, err := ParseSigned(in)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !signed.Signed() {
+		return signed.Message, false, nil
+	}
+
+	err = signed.VerifySignature(signer)
+	if err != nil {
+		return nil, false, err
+	}
+	return signed.Message, true, nil
 }
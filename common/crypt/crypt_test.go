@@ -2,15 +2,21 @@ package crypt
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"io/ioutil"
 	"testing"
+
+	"code.google.com/p/go.crypto/nacl/box"
 )
 
 var crypt, signer *rsa.PrivateKey
 
+// boxPub and boxPriv are the recipient's Curve25519 keys.
+var boxPub, boxPriv *[32]byte
+
 const (
 	cryptFile  = "testdata/crypt.key"
 	signerFile = "testdata/signer.key"
@@ -58,6 +64,9 @@ func TestLoadKeys(t *testing.T) {
 	if !bytes.Equal(digest[:], signerSHA256) {
 		t.Fatal("crypt: invalid digest for signature key")
 	}
+
+	boxPub, boxPriv, err = box.GenerateKey(rand.Reader)
+	checkError(t, err)
 }
 
 var testCiphertext []byte
@@ -65,12 +74,12 @@ var testMessage = []byte("Do not go gently into that good night\nRage, rage agai
 
 func TestEncryptNoSign(t *testing.T) {
 	var err error
-	testCiphertext, err = Encrypt(testMessage, &crypt.PublicKey, nil)
+	testCiphertext, err = Encrypt(testMessage, boxPub[:], nil)
 	checkError(t, err)
 }
 
 func TestDecryptNoSign(t *testing.T) {
-	msg, signed, err := Decrypt(testCiphertext, crypt, nil)
+	msg, signed, err := Decrypt(testCiphertext, boxPriv[:], nil)
 	checkError(t, err)
 
 	if signed {
@@ -84,12 +93,12 @@ func TestDecryptNoSign(t *testing.T) {
 
 func TestEncryptSign(t *testing.T) {
 	var err error
-	testCiphertext, err = Encrypt(testMessage, &crypt.PublicKey, signer)
+	testCiphertext, err = Encrypt(testMessage, boxPub[:], signer)
 	checkError(t, err)
 }
 
 func TestDecryptSign(t *testing.T) {
-	msg, signed, err := Decrypt(testCiphertext, crypt, &signer.PublicKey)
+	msg, signed, err := Decrypt(testCiphertext, boxPriv[:], &signer.PublicKey)
 	checkError(t, err)
 
 	if !signed {
@@ -100,3 +109,61 @@ func TestDecryptSign(t *testing.T) {
 		t.Fatal("crypt: decrypted message doesn't match the original message")
 	}
 }
+
+// fuzzKeys loads the signer and generates a recipient key for the
+// fuzz targets, which may run without TestLoadKeys.
+func fuzzKeys(f *testing.F) (*rsa.PrivateKey, *[32]byte, *[32]byte) {
+	in, err := ioutil.ReadFile(signerFile)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(in)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return key, pub, priv
+}
+
+func FuzzDecrypt(f *testing.F) {
+	key, pub, priv := fuzzKeys(f)
+	for _, s := range []*rsa.PrivateKey{nil, key} {
+		out, err := Encrypt(testMessage, pub[:], s)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(out)
+		f.Add(out[:Overhead])
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		msg, signed, err := Decrypt(in, priv[:], &key.PublicKey)
+		if err != nil && (msg != nil || signed) {
+			t.Fatal("a failed decryption returned a message")
+		}
+	})
+}
+
+func FuzzVerify(f *testing.F) {
+	key, _, _ := fuzzKeys(f)
+	for _, s := range []*rsa.PrivateKey{nil, key} {
+		out, err := Sign(testMessage, s)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(out)
+	}
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		msg, signed, err := Verify(in, &key.PublicKey)
+		if err != nil && (msg != nil || signed) {
+			t.Fatal("a failed verification returned a message")
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package crypt
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+
+	"code.google.com/p/go.crypto/nacl/box"
+)
+
+// KEMPublicKeySize and KEMPrivateKeySize are the sizes of an
+// ML-KEM-768 encapsulation key and of the seed that its decapsulation
+// key is kept as.
+const (
+	KEMPublicKeySize  = mlkem.EncapsulationKeySize768
+	KEMPrivateKeySize = mlkem.SeedSize
+)
+
+// KEMCiphertextSize is the size of the ML-KEM ciphertext that
+// precedes the box in a hybrid box.
+const KEMCiphertextSize = mlkem.CiphertextSize768
+
+// HybridOverhead is the number of bytes a hybrid box adds to the
+// signed message: the ML-KEM ciphertext, followed by the same
+// overhead as a box.
+const HybridOverhead = KEMCiphertextSize + Overhead
+
+// hybridLabel separates the hybrid box key from any other use of the
+// shared secrets.
+const hybridLabel = "entropyshare hybrid X25519 ML-KEM-768 v1"
+
+var (
+	ErrNoKEMKey      = errors.New("crypt: no ML-KEM key provided")
+	ErrInvalidKEMKey = errors.New("crypt: invalid ML-KEM key")
+)
+
+// GenerateKEMKey generates an ML-KEM-768 key pair for hybrid boxes.
+func GenerateKEMKey() (pub, priv []byte, err error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, nil, err
+	}
+	return dk.EncapsulationKey().Bytes(), dk.Bytes(), nil
+}
+
+// EncryptHybrid behaves like Encrypt, but the box's key is derived
+// from both an X25519 exchange with peer and an ML-KEM-768
+// encapsulation to kemPeer, so that the message stays secret unless
+// both are broken. The ML-KEM ciphertext precedes the box.
+func EncryptHybrid(message []byte, peer, kemPeer []byte, signer *rsa.PrivateKey) ([]byte, error) {
+	if peer == nil {
+		return nil, errors.New("crypt: no public key provided")
+	} else if kemPeer == nil {
+		return nil, ErrNoKEMKey
+	}
+
+	ek, err := mlkem.NewEncapsulationKey768(kemPeer)
+	if err != nil {
+		return nil, ErrInvalidKEMKey
+	}
+
+	var pub [32]byte
+	copy(pub[:], peer)
+
+	sm, err := Sign(message, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	epub, epriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	kemShared, kemCiphertext := ek.Encapsulate()
+	var shared [32]byte
+	box.Precompute(&shared, &pub, epriv)
+	key := hybridKey(&shared, kemShared, kemCiphertext, epub, &pub)
+
+	out := append(kemCiphertext, epub[:]...)
+	nonce := newNonce()
+	out = append(out, nonce[:]...)
+	out = box.SealAfterPrecomputation(out, sm, nonce, key)
+	return out, nil
+}
+
+// DecryptHybrid opens a message sealed by EncryptHybrid with the
+// recipient's private key and ML-KEM key, and verifies it as Decrypt
+// does.
+func DecryptHybrid(ciphertext []byte, priv, kemPriv []byte, signer *rsa.PublicKey) ([]byte, bool, error) {
+	_, out, err := OpenHybrid(ciphertext, priv, kemPriv)
+	if err != nil {
+		return nil, false, err
+	}
+	return Verify(out, signer)
+}
+
+// OpenHybrid decrypts and authenticates a hybrid box, returning the
+// box that follows the ML-KEM ciphertext along with the signed
+// message inside, which isn't verified.
+func OpenHybrid(ciphertext []byte, priv, kemPriv []byte) (*Box, []byte, error) {
+	if priv == nil {
+		return nil, nil, ErrNoPrivateKey
+	} else if kemPriv == nil {
+		return nil, nil, ErrNoKEMKey
+	}
+
+	dk, err := mlkem.NewDecapsulationKey768(kemPriv)
+	if err != nil {
+		return nil, nil, ErrInvalidKEMKey
+	}
+
+	if len(ciphertext) < HybridOverhead {
+		return nil, nil, ErrBoxSize
+	}
+
+	kemCiphertext := ciphertext[:KEMCiphertextSize]
+	b, err := ParseBox(ciphertext[KEMCiphertextSize:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Decapsulation never fails on a well-sized ciphertext; a
+	// tampered one yields a key that fails to open the box.
+	kemShared, err := dk.Decapsulate(kemCiphertext)
+	if err != nil {
+		return nil, nil, ErrDecrypt
+	}
+
+	var decrypt, pub, shared [32]byte
+	copy(decrypt[:], priv)
+	x, err := ecdh.X25519().NewPrivateKey(decrypt[:])
+	if err != nil {
+		return nil, nil, ErrNoPrivateKey
+	}
+	copy(pub[:], x.PublicKey().Bytes())
+
+	box.Precompute(&shared, &b.Ephemeral, &decrypt)
+	key := hybridKey(&shared, kemShared, kemCiphertext, &b.Ephemeral, &pub)
+	out, ok := box.OpenAfterPrecomputation(nil, b.Sealed, &b.Nonce, key)
+	if !ok {
+		return nil, nil, ErrDecrypt
+	}
+	return b, out, nil
+}
+
+// hybridKey combines the X25519 and ML-KEM shared secrets into the
+// box key, binding in the ML-KEM ciphertext and both X25519 public
+// keys as X-Wing does.
+func hybridKey(shared *[32]byte, kemShared, kemCiphertext []byte, ephemeral, peer *[32]byte) *[32]byte {
+	h := sha256.New()
+	h.Write([]byte(hybridLabel))
+	h.Write(kemShared)
+	h.Write(shared[:])
+	h.Write(kemCiphertext)
+	h.Write(ephemeral[:])
+	h.Write(peer[:])
+
+	var key [32]byte
+	copy(key[:], h.Sum(nil))
+	return &key
+}
@@ -0,0 +1,55 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"code.google.com/p/go.crypto/nacl/box"
+)
+
+func TestHybrid(t *testing.T) {
+	kemPub, kemPriv, err := GenerateKEMKey()
+	checkError(t, err)
+	if len(kemPub) != KEMPublicKeySize || len(kemPriv) != KEMPrivateKeySize {
+		t.Fatalf("invalid ML-KEM key sizes %d and %d", len(kemPub), len(kemPriv))
+	}
+
+	ciphertext, err := EncryptHybrid(testMessage, boxPub[:], kemPub, signer)
+	checkError(t, err)
+
+	msg, signed, err := DecryptHybrid(ciphertext, boxPriv[:], kemPriv, &signer.PublicKey)
+	checkError(t, err)
+	if !signed || !bytes.Equal(msg, testMessage) {
+		t.Fatal("crypt: decrypted message doesn't match the original message")
+	}
+
+	// Both keys are needed to open a hybrid box.
+	_, otherKEM, err := GenerateKEMKey()
+	checkError(t, err)
+	_, otherPriv, err := box.GenerateKey(rand.Reader)
+	checkError(t, err)
+
+	if _, _, err = DecryptHybrid(ciphertext, boxPriv[:], otherKEM, &signer.PublicKey); err != ErrDecrypt {
+		t.Fatalf("expected %v with the wrong ML-KEM key, have %v", ErrDecrypt, err)
+	}
+	if _, _, err = DecryptHybrid(ciphertext, otherPriv[:], kemPriv, &signer.PublicKey); err != ErrDecrypt {
+		t.Fatalf("expected %v with the wrong Curve25519 key, have %v", ErrDecrypt, err)
+	}
+	if _, _, err = Decrypt(ciphertext, boxPriv[:], &signer.PublicKey); err != ErrDecrypt {
+		t.Fatalf("a hybrid box shouldn't open as a plain one, have %v", err)
+	}
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[0] ^= 1
+	if _, _, err = DecryptHybrid(tampered, boxPriv[:], kemPriv, &signer.PublicKey); err != ErrDecrypt {
+		t.Fatalf("expected %v with a tampered ML-KEM ciphertext, have %v", ErrDecrypt, err)
+	}
+
+	if _, _, err = DecryptHybrid(ciphertext[:HybridOverhead-1], boxPriv[:], kemPriv, nil); err != ErrBoxSize {
+		t.Fatalf("expected %v, have %v", ErrBoxSize, err)
+	}
+	if _, err = EncryptHybrid(testMessage, boxPub[:], kemPub[1:], signer); err != ErrInvalidKEMKey {
+		t.Fatalf("expected %v, have %v", ErrInvalidKEMKey, err)
+	}
+}
@@ -5,119 +5,341 @@ import (
 	"encoding/asn1"
 	"errors"
 	"io"
-	"time"
 
+	"github.com/kisom/entropyshare/clock"
 	"github.com/kisom/entropyshare/common/crypt"
 )
 
+// ChunkSize is the default size of a packet's chunk of entropy.
 const ChunkSize = 1024
 
+// MinChunkSize and MaxChunkSize bound the chunk sizes that may be
+// negotiated for a target.
+const (
+	MinChunkSize = 32
+	MaxChunkSize = 8192
+)
+
+// MaxSignerBits is the size of the largest RSA signature key whose
+// packets will fit in MaxPacketSize.
+const MaxSignerBits = 8192
+
+// maxEncoding bounds the ASN.1 framing around a packet's fields and
+// its signature.
+const maxEncoding = 64
+
+// MaxPacketSize is the size of the largest valid wire packet: a
+// MaxChunkSize chunk, signed with a MaxSignerBits key and sealed in a
+// hybrid box. It bounds the length a sink will read from the wire.
+const MaxPacketSize = MaxChunkSize + MaxSignerBits/8 + maxEncoding + crypt.HybridOverhead
+
+// CookieSize is the size of the cookie that a sink may send when a
+// source connects, which the source must echo before its packet.
+const CookieSize = 16
+
 // Packet combine a timestamp and a random chunk of data.
 type Packet struct {
 	Timestamp int64
 	Counter   int64
-	Chunk     [ChunkSize]byte
+	Chunk     []byte
 }
 
+// packet is the wire form of a Packet. Size is optional so that
+// packets from sources predating variable chunk sizes, which are
+// always ChunkSize bytes, may still be parsed.
 type packet struct {
 	Timestamp int64
 	Counter   int64
+	Size      int `asn1:"optional"`
 	Chunk     []byte
 }
 
-func NewPacket(counter int64, r io.Reader) (int64, *Packet, error) {
-	var p Packet
-	_, err := io.ReadFull(r, p.Chunk[:])
+// NewPacket generates a new packet with a ChunkSize chunk.
+func NewPacket(clk clock.Clock, counter int64, r io.Reader) (int64, *Packet, error) {
+	return NewSizedPacket(clk, counter, ChunkSize, r)
+}
+
+// NewSizedPacket generates a new packet with a chunk of size bytes
+// read from r, stamped with the time from clk. A size of 0 selects
+// the default ChunkSize.
+func NewSizedPacket(clk clock.Clock, counter int64, size int, r io.Reader) (int64, *Packet, error) {
+	if size == 0 {
+		size = ChunkSize
+	}
+
+	if size < MinChunkSize || size > MaxChunkSize {
+		return counter, nil, ErrBadChunk
+	}
+
+	p := Packet{Chunk: make([]byte, size)}
+	_, err := io.ReadFull(r, p.Chunk)
 	if err != nil {
 		return counter, nil, err
 	}
 
 	counter++
-	p.Timestamp = time.Now().Unix()
+	p.Timestamp = clk.Now().Unix()
 	p.Counter = counter
 	return counter, &p, nil
 }
 
 // SerialiseWire packs and encrypts a packet for transmission on the wire.
 func SerialiseWire(p *Packet, peer []byte, signer *rsa.PrivateKey) ([]byte, error) {
-	packet := packet{
-		Timestamp: p.Timestamp,
-		Counter:   p.Counter,
-		Chunk:     p.Chunk[:],
+	out, err := encodePacket(p)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err = crypt.Encrypt(out, peer, signer)
+	if err != nil {
+		return nil, err
+	} else if len(out) > MaxPacketSize {
+		return nil, ErrPacketSize
+	}
+	return out, nil
+}
+
+// SerialiseHybridWire behaves like SerialiseWire, but seals the packet
+// with a key agreed with both the sink's Curve25519 key, peer, and its
+// ML-KEM key, kemPeer; see crypt.EncryptHybrid.
+func SerialiseHybridWire(p *Packet, peer, kemPeer []byte, signer *rsa.PrivateKey) ([]byte, error) {
+	out, err := encodePacket(p)
+	if err != nil {
+		return nil, err
 	}
-	out, err := asn1.Marshal(packet)
+
+	out, err = crypt.EncryptHybrid(out, peer, kemPeer, signer)
 	if err != nil {
 		return nil, err
+	} else if len(out) > MaxPacketSize {
+		return nil, ErrPacketSize
+	}
+	return out, nil
+}
+
+// encodePacket packs a packet's fields, before they are signed and
+// encrypted.
+func encodePacket(p *Packet) ([]byte, error) {
+	if len(p.Chunk) < MinChunkSize || len(p.Chunk) > MaxChunkSize {
+		return nil, ErrBadChunk
 	}
 
-	return crypt.Encrypt(out, peer, signer)
+	packet := packet{
+		Timestamp: p.Timestamp,
+		Counter:   p.Counter,
+		Chunk:     p.Chunk,
+	}
+
+	// A default-sized chunk leaves Size out, so that the packet
+	// is still readable by sinks predating variable chunk sizes.
+	if len(p.Chunk) != ChunkSize {
+		packet.Size = len(p.Chunk)
+	}
+	return asn1.Marshal(packet)
 }
 
 var (
 	ErrUnsignedPacket = errors.New("packet was not signed")
 	ErrBadChunk       = errors.New("bad packet chunk length")
+	ErrPacketSize     = errors.New("packet exceeds the maximum size")
 )
 
-// ParsePacket decrypts and unpacks a packet from the wire.
+// ParsePacket decrypts and unpacks a packet from the wire. Packets
+// larger than MaxPacketSize are rejected with ErrPacketSize.
 func ParsePacket(in []byte, priv []byte, signer *rsa.PublicKey) (*Packet, error) {
-	msg, signed, err := crypt.Decrypt(in, priv, signer)
+	return ParseHybridPacket(in, priv, nil, signer)
+}
+
+// ErrHybridRequired is returned by ParseHybridOnlyPacket for a packet
+// sealed without the hybrid key agreement.
+var ErrHybridRequired = errors.New("packet isn't sealed with the hybrid key agreement")
+
+// ParseHybridPacket behaves like ParsePacket, but if kemPriv, the
+// sink's ML-KEM key, is given, packets sealed by SerialiseHybridWire
+// are accepted as well as those sealed by SerialiseWire.
+func ParseHybridPacket(in []byte, priv, kemPriv []byte, signer *rsa.PublicKey) (*Packet, error) {
+	return parseHybridPacket(in, priv, kemPriv, signer, true)
+}
+
+// ParseHybridOnlyPacket behaves like ParseHybridPacket, but refuses
+// packets sealed by SerialiseWire with ErrHybridRequired, so that
+// once every source uses the hybrid key agreement, packets protected
+// by X25519 alone are no longer accepted.
+func ParseHybridOnlyPacket(in []byte, priv, kemPriv []byte, signer *rsa.PublicKey) (*Packet, error) {
+	if kemPriv == nil {
+		return nil, crypt.ErrNoKEMKey
+	}
+	return parseHybridPacket(in, priv, kemPriv, signer, false)
+}
+
+func parseHybridPacket(in []byte, priv, kemPriv []byte, signer *rsa.PublicKey, classic bool) (*Packet, error) {
+	if len(in) > MaxPacketSize {
+		return nil, ErrPacketSize
+	}
+
+	// Nothing marks a hybrid box, but a box only opens with the
+	// key it was sealed with, so each kind is tried in turn.
+	var msg []byte
+	var signed bool
+	err := crypt.ErrDecrypt
+	if kemPriv != nil && len(in) >= crypt.HybridOverhead {
+		msg, signed, err = crypt.DecryptHybrid(in, priv, kemPriv, signer)
+	}
+	if err == crypt.ErrDecrypt && classic {
+		msg, signed, err = crypt.Decrypt(in, priv, signer)
+	} else if err == crypt.ErrDecrypt {
+		// Opening the box, which is cheap, says why the packet
+		// was refused; its signature isn't worth verifying.
+		if b, berr := crypt.ParseBox(in); berr == nil {
+			if _, berr = b.Open(priv); berr == nil {
+				err = ErrHybridRequired
+			}
+		}
+	}
 	if err != nil {
 		return nil, err
 	} else if !signed {
 		return nil, ErrUnsignedPacket
 	}
 
-	var packet packet
-	_, err = asn1.Unmarshal(msg, &packet)
+	p, _, err := DecodePacket(msg)
 	if err != nil {
 		return nil, err
 	}
+	return p, nil
+}
+
+// DecodePacket unpacks the decrypted contents of a packet, returning
+// it along with the chunk size it declares. If the chunk is invalid,
+// the packet is returned along with ErrBadChunk so that it can be
+// examined.
+func DecodePacket(msg []byte) (*Packet, int, error) {
+	var packet packet
+	_, err := asn1.Unmarshal(msg, &packet)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	if len(packet.Chunk) != ChunkSize {
-		return nil, ErrBadChunk
+	if packet.Size == 0 {
+		packet.Size = ChunkSize
 	}
+
 	p := &Packet{
 		Timestamp: packet.Timestamp,
 		Counter:   packet.Counter,
+		Chunk:     packet.Chunk,
 	}
-	copy(p.Chunk[:], packet.Chunk)
-	return p, nil
+
+	if len(packet.Chunk) != packet.Size {
+		return p, packet.Size, ErrBadChunk
+	} else if packet.Size < MinChunkSize || packet.Size > MaxChunkSize {
+		return p, packet.Size, ErrBadChunk
+	}
+	return p, packet.Size, nil
 }
 
 var (
 	ErrTimestamp = errors.New("invalid packet timestamp")
 	ErrCounter   = errors.New("counter has regressed")
+	ErrChunkSize = errors.New("chunk size outside of accepted range")
 )
 
 // ParseAndWritePacket decrypts and unpacks a packet from the wire,
-// verifies the timestamp is within an acceptable drift range and
-// that the counter hasn't decremented, and then writes the entropy
-// to the PRNG. It returns the new counter. On error, the current
-// counter value is returned instead of a new value.
-func ParseAndWritePacket(in []byte, priv []byte, signer *rsa.PublicKey, drift, counter int64, w io.Writer) (int64, error) {
+// verifies the timestamp is within an acceptable drift range of the
+// time from clk, that the counter hasn't decremented, and that the
+// chunk size is between minChunk and maxChunk, and then writes the
+// entropy to the PRNG. A minChunk or maxChunk of 0 selects
+// MinChunkSize or MaxChunkSize, respectively. It returns the new
+// counter. On error, the current counter value is returned instead
+// of a new value.
+func ParseAndWritePacket(clk clock.Clock, in []byte, priv []byte, signer *rsa.PublicKey, drift, counter int64, minChunk, maxChunk int, w io.Writer) (int64, error) {
 	p, err := ParsePacket(in, priv, signer)
 	if err != nil {
 		return counter, err
 	}
 
-	if w == nil {
-		return counter, errors.New("invalid writer")
+	return WritePacket(clk, p, drift, counter, minChunk, maxChunk, w)
+}
+
+// WritePacket performs the checks described in ParseAndWritePacket
+// on a packet that has already been parsed, and writes its entropy
+// to the PRNG.
+func WritePacket(clk clock.Clock, p *Packet, drift, counter int64, minChunk, maxChunk int, w io.Writer) (int64, error) {
+	checkTimestamp := func(ts int64) error {
+		now := clk.Now().Unix()
+
+		if (now + drift) < ts {
+			return ErrTimestamp
+		}
+
+		if (now - drift) > ts {
+			return ErrTimestamp
+		}
+		return nil
 	}
 
-	now := time.Now().Unix()
+	return writePacket(p, checkTimestamp, counter, minChunk, maxChunk, w)
+}
 
-	if (now + drift) < p.Timestamp {
-		return counter, ErrTimestamp
+// ParseAndWriteOfflinePacket behaves like ParseAndWritePacket, but
+// is intended for packets delivered in a bundle long after they were
+// generated. Instead of a drift range, both the time from clk and the
+// packet's timestamp must fall within the window from notBefore to
+// notAfter.
+func ParseAndWriteOfflinePacket(clk clock.Clock, in []byte, priv []byte, signer *rsa.PublicKey, notBefore, notAfter, counter int64, minChunk, maxChunk int, w io.Writer) (int64, error) {
+	p, err := ParsePacket(in, priv, signer)
+	if err != nil {
+		return counter, err
+	}
+
+	return WriteOfflinePacket(clk, p, notBefore, notAfter, counter, minChunk, maxChunk, w)
+}
+
+// WriteOfflinePacket performs the checks described in
+// ParseAndWriteOfflinePacket on a packet that has already been
+// parsed, and writes its entropy to the PRNG.
+func WriteOfflinePacket(clk clock.Clock, p *Packet, notBefore, notAfter, counter int64, minChunk, maxChunk int, w io.Writer) (int64, error) {
+	checkTimestamp := func(ts int64) error {
+		now := clk.Now().Unix()
+
+		if now < notBefore || now > notAfter {
+			return ErrTimestamp
+		}
+
+		if ts < notBefore || ts > notAfter {
+			return ErrTimestamp
+		}
+		return nil
+	}
+
+	return writePacket(p, checkTimestamp, counter, minChunk, maxChunk, w)
+}
+
+func writePacket(p *Packet, checkTimestamp func(int64) error, counter int64, minChunk, maxChunk int, w io.Writer) (int64, error) {
+	if minChunk == 0 {
+		minChunk = MinChunkSize
+	}
+
+	if maxChunk == 0 {
+		maxChunk = MaxChunkSize
+	}
+
+	if len(p.Chunk) < minChunk || len(p.Chunk) > maxChunk {
+		return counter, ErrChunkSize
 	}
 
-	if (now - drift) > p.Timestamp {
-		return counter, ErrTimestamp
+	if w == nil {
+		return counter, errors.New("invalid writer")
+	}
+
+	if err := checkTimestamp(p.Timestamp); err != nil {
+		return counter, err
 	}
 
 	if p.Counter <= counter {
 		return counter, ErrCounter
 	}
 
-	_, err = w.Write(p.Chunk[:])
+	_, err := w.Write(p.Chunk)
 	return p.Counter, err
 }
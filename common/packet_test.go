@@ -12,10 +12,12 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"testing"
 	"time"
 
 	"code.google.com/p/go.crypto/nacl/box"
+	"github.com/kisom/entropyshare/clock"
 	"github.com/kisom/entropyshare/common/crypt"
 )
 
@@ -60,7 +62,7 @@ var testPacket []byte
 
 func TestSerialiseWire(t *testing.T) {
 	var err error
-	p := &Packet{}
+	p := &Packet{Chunk: make([]byte, ChunkSize)}
 	testPacket, err = SerialiseWire(p, testPub, signer)
 	checkError(t, err)
 }
@@ -75,7 +77,7 @@ var senderCounter, receiverCounter int64
 
 func TestNewPacket(t *testing.T) {
 	var err error
-	senderCounter, testRawPacket, err = NewPacket(30, rand.Reader)
+	senderCounter, testRawPacket, err = NewPacket(clock.System, 30, rand.Reader)
 	checkError(t, err)
 
 	if senderCounter != 31 {
@@ -101,73 +103,164 @@ func TestParseAndWritePacket(t *testing.T) {
 	var err error
 
 	drift := time.Now().Unix() - testRawPacket.Timestamp + 1
-	receiverCounter, err = ParseAndWritePacket(testPacket, testPriv, &signer.PublicKey, drift, 0, buf)
+	receiverCounter, err = ParseAndWritePacket(clock.System, testPacket, testPriv, &signer.PublicKey, drift, 0, 0, 0, buf)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 
 	// Make sure that counter regression is caught.
-	receiverCounter, err = ParseAndWritePacket(testPacket, testPriv, &signer.PublicKey, drift, receiverCounter, buf)
+	receiverCounter, err = ParseAndWritePacket(clock.System, testPacket, testPriv, &signer.PublicKey, drift, receiverCounter, 0, 0, buf)
 	if err != ErrCounter {
 		t.Fatal("counter regression should be rejected")
 	}
 }
 
 func TestTimestamping(t *testing.T) {
-	var err error
 	var buf = &bytes.Buffer{}
+	const drift = 60
+	clk := clock.NewFake(time.Unix(1400000000, 0))
 
-	// Delay to push the clock drift check.
-	<-time.After(2 * time.Second)
-	// Ensure clock drift is caught.
-	var drift int64 = 1
-	_, err = ParseAndWritePacket(testPacket, testPriv, &signer.PublicKey, drift, receiverCounter-1, buf)
-	if err != ErrTimestamp {
-		t.Fatal("packet should be outside acceptable clock drift")
-	}
-
-	_, p, err := NewPacket(0, rand.Reader)
+	_, p, err := NewPacket(clk, 0, rand.Reader)
 	checkError(t, err)
 
-	p.Timestamp = time.Now().Unix() + drift + 1
 	out, err := SerialiseWire(p, testPub, signer)
 	checkError(t, err)
 
-	_, err = ParseAndWritePacket(out, testPriv, &signer.PublicKey, drift, 0, buf)
-	if err != ErrTimestamp {
-		t.Fatalf("packet should be outside acceptable clock drift", err)
+	// The packet is accepted while the sink's clock is within
+	// drift seconds of its timestamp, in either direction.
+	stamp := clk.Now()
+	var tests = []struct {
+		offset time.Duration
+		ok     bool
+	}{
+		{-(drift + 1) * time.Second, false},
+		{-drift * time.Second, true},
+		{0, true},
+		{drift * time.Second, true},
+		{(drift + 1) * time.Second, false},
 	}
 
-	p.Timestamp = time.Now().Unix() - drift - 1
-	out, err = SerialiseWire(p, testPub, signer)
-	checkError(t, err)
-
-	_, err = ParseAndWritePacket(out, testPriv, &signer.PublicKey, drift, 0, buf)
-	if err != ErrTimestamp {
-		t.Fatalf("packet should be outside acceptable clock drift", err)
+	for _, test := range tests {
+		clk.Set(stamp.Add(test.offset))
+		_, err = ParseAndWritePacket(clk, out, testPriv, &signer.PublicKey, drift, 0, 0, 0, buf)
+		if test.ok && err != nil {
+			t.Fatalf("packet %v from the sink's clock should be accepted: %v", test.offset, err)
+		} else if !test.ok && err != ErrTimestamp {
+			t.Fatalf("packet %v from the sink's clock should be outside acceptable clock drift", test.offset)
+		}
 	}
-
 }
 
 func TestCounterProgression(t *testing.T) {
 	var err error
 	var buf = &bytes.Buffer{}
 
-	senderCounter, testRawPacket, err = NewPacket(senderCounter, rand.Reader)
+	senderCounter, testRawPacket, err = NewPacket(clock.System, senderCounter, rand.Reader)
 	checkError(t, err)
 
 	testPacket, err = SerialiseWire(testRawPacket, testPub, signer)
 	checkError(t, err)
 
 	drift := time.Now().Unix() - testRawPacket.Timestamp + 1
-	receiverCounter, err = ParseAndWritePacket(testPacket, testPriv, &signer.PublicKey, drift, receiverCounter, buf)
+	receiverCounter, err = ParseAndWritePacket(clock.System, testPacket, testPriv, &signer.PublicKey, drift, receiverCounter, 0, 0, buf)
+	checkError(t, err)
+}
+
+func TestSizedPacket(t *testing.T) {
+	var buf = &bytes.Buffer{}
+
+	_, p, err := NewSizedPacket(clock.System, 0, 256, rand.Reader)
+	checkError(t, err)
+
+	if len(p.Chunk) != 256 {
+		t.Fatalf("Chunk: expected 256 bytes, have %d", len(p.Chunk))
+	}
+
+	out, err := SerialiseWire(p, testPub, signer)
 	checkError(t, err)
+
+	rp, err := ParsePacket(out, testPriv, &signer.PublicKey)
+	checkError(t, err)
+
+	if !bytes.Equal(rp.Chunk, p.Chunk) {
+		t.Fatal("parsed chunk doesn't match the original chunk")
+	}
+
+	_, err = ParseAndWritePacket(clock.System, out, testPriv, &signer.PublicKey, 10, 0, 512, 0, buf)
+	if err != ErrChunkSize {
+		t.Fatal("chunk smaller than the sink minimum should be rejected")
+	}
+
+	_, err = ParseAndWritePacket(clock.System, out, testPriv, &signer.PublicKey, 10, 0, 0, 128, buf)
+	if err != ErrChunkSize {
+		t.Fatal("chunk larger than the sink maximum should be rejected")
+	}
+
+	_, err = ParseAndWritePacket(clock.System, out, testPriv, &signer.PublicKey, 10, 0, 256, 256, buf)
+	checkError(t, err)
+
+	if buf.Len() != 256 {
+		t.Fatalf("expected 256 bytes written, have %d", buf.Len())
+	}
+
+	_, _, err = NewSizedPacket(clock.System, 0, MaxChunkSize+1, rand.Reader)
+	if err != ErrBadChunk {
+		t.Fatal("oversized chunks should be rejected")
+	}
+}
+
+func TestLegacyPacket(t *testing.T) {
+	legacy := struct {
+		Timestamp int64
+		Counter   int64
+		Chunk     []byte
+	}{time.Now().Unix(), 1, make([]byte, ChunkSize)}
+
+	msg, err := asn1.Marshal(legacy)
+	checkError(t, err)
+
+	out, err := crypt.Encrypt(msg, testPub, signer)
+	checkError(t, err)
+
+	p, err := ParsePacket(out, testPriv, &signer.PublicKey)
+	checkError(t, err)
+
+	if len(p.Chunk) != ChunkSize {
+		t.Fatalf("Chunk: expected %d bytes, have %d", ChunkSize, len(p.Chunk))
+	}
+}
+
+func TestLegacySink(t *testing.T) {
+	var legacy struct {
+		Timestamp int64
+		Counter   int64
+		Chunk     []byte
+	}
+
+	p := &Packet{Timestamp: time.Now().Unix(), Counter: 1, Chunk: make([]byte, ChunkSize)}
+	msg, err := encodePacket(p)
+	checkError(t, err)
+
+	// A sink predating variable chunk sizes must be able to read
+	// a default-sized packet.
+	rest, err := asn1.Unmarshal(msg, &legacy)
+	checkError(t, err)
+	if len(rest) != 0 || legacy.Counter != p.Counter || len(legacy.Chunk) != ChunkSize {
+		t.Fatalf("legacy decoding mismatch: %+v", legacy)
+	}
+
+	p.Chunk = make([]byte, 2*ChunkSize)
+	msg, err = encodePacket(p)
+	checkError(t, err)
+	if _, size, err := DecodePacket(msg); err != nil || size != 2*ChunkSize {
+		t.Fatalf("expected a declared size of %d, have %d (%v)", 2*ChunkSize, size, err)
+	}
 }
 
 func TestCounterPreserved(t *testing.T) {
 	r := &bytes.Buffer{}
 
-	counter, packet, err := NewPacket(senderCounter, r)
+	counter, packet, err := NewPacket(clock.System, senderCounter, r)
 	if err == nil {
 		fmt.Println(hex.Dump(packet.Chunk[:]))
 		t.Fatal("expected call to NewPacket to fail")
@@ -193,17 +286,189 @@ func TestCryptFails(t *testing.T) {
 		t.Fatal("parsing should fail without a private key")
 	}
 
-	_, err = ParseAndWritePacket(testPacket, nil, nil, 0, 0, nil)
+	_, err = ParseAndWritePacket(clock.System, testPacket, nil, nil, 0, 0, 0, 0, nil)
 	if err == nil {
 		t.Fatal("parsing should fail without a private key")
 	}
 }
 
+func TestBundle(t *testing.T) {
+	var buf = &bytes.Buffer{}
+	now := time.Now().Unix()
+
+	b := &Bundle{NotBefore: now - 60, NotAfter: now + 60}
+	var counter int64
+	for i := 0; i < 2; i++ {
+		var p *Packet
+		var err error
+		counter, p, err = NewPacket(clock.System, counter, rand.Reader)
+		checkError(t, err)
+
+		out, err := SerialiseWire(p, testPub, signer)
+		checkError(t, err)
+		b.Packets = append(b.Packets, out)
+	}
+
+	out, err := SerialiseBundle(b, signer)
+	checkError(t, err)
+
+	rb, err := ParseBundle(out, &signer.PublicKey)
+	checkError(t, err)
+
+	if len(rb.Packets) != 2 {
+		t.Fatalf("expected 2 packets in bundle, have %d", len(rb.Packets))
+	}
+
+	counter = 0
+	for _, packet := range rb.Packets {
+		counter, err = ParseAndWriteOfflinePacket(clock.System, packet, testPriv, &signer.PublicKey,
+			rb.NotBefore, rb.NotAfter, counter, 0, 0, buf)
+		checkError(t, err)
+	}
+
+	if counter != 2 {
+		t.Fatalf("Counter: expected 2, have %d", counter)
+	}
+
+	_, err = ParseAndWriteOfflinePacket(clock.System, rb.Packets[0], testPriv, &signer.PublicKey,
+		now-120, now-60, 0, 0, 0, buf)
+	if err != ErrTimestamp {
+		t.Fatal("packet outside of the validity window should be rejected")
+	}
+
+	_, err = SerialiseBundle(b, nil)
+	if err != ErrUnsignedBundle {
+		t.Fatal("bundles must be signed")
+	}
+
+	out[len(out)-1] ^= 1
+	_, err = ParseBundle(out, &signer.PublicKey)
+	if err == nil {
+		t.Fatal("tampered bundle should be rejected")
+	}
+}
+
+func TestOfflineWindow(t *testing.T) {
+	var buf = &bytes.Buffer{}
+	clk := clock.NewFake(time.Unix(1400000000, 0))
+	notBefore, notAfter := clk.Now().Unix(), clk.Now().Unix()+3600
+
+	_, p, err := NewPacket(clk, 0, rand.Reader)
+	checkError(t, err)
+
+	// Both ends of the window are inclusive.
+	var tests = []struct {
+		now int64
+		ok  bool
+	}{
+		{notBefore - 1, false},
+		{notBefore, true},
+		{notAfter, true},
+		{notAfter + 1, false},
+	}
+
+	for _, test := range tests {
+		clk.Set(time.Unix(test.now, 0))
+		_, err = WriteOfflinePacket(clk, p, notBefore, notAfter, 0, 0, 0, buf)
+		if test.ok && err != nil {
+			t.Fatalf("packet applied at %d should be accepted: %v", test.now, err)
+		} else if !test.ok && err != ErrTimestamp {
+			t.Fatalf("packet applied at %d should be outside the validity window", test.now)
+		}
+	}
+
+	// The packet's own timestamp must also fall in the window.
+	clk.Set(time.Unix(notAfter, 0))
+	_, err = WriteOfflinePacket(clk, p, notBefore+1, notAfter, 0, 0, 0, buf)
+	if err != ErrTimestamp {
+		t.Fatal("packet stamped before the validity window should be rejected")
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	p := &Packet{
+		Timestamp: math.MaxInt64,
+		Counter:   math.MaxInt64,
+		Chunk:     make([]byte, MaxChunkSize),
+	}
+
+	out, err := SerialiseWire(p, testPub, signer)
+	checkError(t, err)
+
+	// The same packet signed by the largest key must still fit.
+	largest := len(out) + (MaxSignerBits-signer.N.BitLen())/8
+	if largest > MaxPacketSize {
+		t.Fatalf("a maximal packet is %d bytes, but MaxPacketSize is %d", largest, MaxPacketSize)
+	}
+
+	kemPub, _, err := crypt.GenerateKEMKey()
+	checkError(t, err)
+	out, err = SerialiseHybridWire(p, testPub, kemPub, signer)
+	checkError(t, err)
+	largest = len(out) + (MaxSignerBits-signer.N.BitLen())/8
+	if largest > MaxPacketSize {
+		t.Fatalf("a maximal hybrid packet is %d bytes, but MaxPacketSize is %d", largest, MaxPacketSize)
+	}
+
+	_, err = ParsePacket(make([]byte, MaxPacketSize+1), testPriv, &signer.PublicKey)
+	if err != ErrPacketSize {
+		t.Fatal("oversized packets should be rejected before decryption")
+	}
+}
+
+func TestHybridPacket(t *testing.T) {
+	kemPub, kemPriv, err := crypt.GenerateKEMKey()
+	checkError(t, err)
+
+	_, p, err := NewPacket(clock.System, 0, rand.Reader)
+	checkError(t, err)
+	hybrid, err := SerialiseHybridWire(p, testPub, kemPub, signer)
+	checkError(t, err)
+	plain, err := SerialiseWire(p, testPub, signer)
+	checkError(t, err)
+
+	// A sink with an ML-KEM key accepts both kinds of packet.
+	for _, in := range [][]byte{hybrid, plain} {
+		parsed, err := ParseHybridPacket(in, testPriv, kemPriv, &signer.PublicKey)
+		checkError(t, err)
+		if !bytes.Equal(parsed.Chunk, p.Chunk) || parsed.Counter != p.Counter {
+			t.Fatal("parsed packet doesn't match")
+		}
+	}
+
+	if _, err = ParsePacket(hybrid, testPriv, &signer.PublicKey); err != crypt.ErrDecrypt {
+		t.Fatalf("a sink without an ML-KEM key can't open a hybrid packet, have %v", err)
+	}
+
+	// A sink requiring the hybrid key agreement only accepts
+	// hybrid packets.
+	parsed, err := ParseHybridOnlyPacket(hybrid, testPriv, kemPriv, &signer.PublicKey)
+	checkError(t, err)
+	if !bytes.Equal(parsed.Chunk, p.Chunk) {
+		t.Fatal("parsed packet doesn't match")
+	}
+	if _, err = ParseHybridOnlyPacket(plain, testPriv, kemPriv, &signer.PublicKey); err != ErrHybridRequired {
+		t.Fatalf("expected %v, have %v", ErrHybridRequired, err)
+	}
+
+	// Refusing a classic packet doesn't verify its signature, so
+	// a forged one costs the sink no more than a genuine one.
+	forged, err := crypt.Encrypt([]byte("forged"), testPub, nil)
+	checkError(t, err)
+	if _, err = ParseHybridOnlyPacket(forged, testPriv, kemPriv, &signer.PublicKey); err != ErrHybridRequired {
+		t.Fatalf("expected %v, have %v", ErrHybridRequired, err)
+	}
+	if _, err = ParseHybridOnlyPacket(hybrid, testPriv, nil, &signer.PublicKey); err != crypt.ErrNoKEMKey {
+		t.Fatalf("expected %v, have %v", crypt.ErrNoKEMKey, err)
+	}
+}
+
 func TestPacketSizes(t *testing.T) {
 	asnPacket := packet{
 		testRawPacket.Timestamp,
 		testRawPacket.Counter,
-		testRawPacket.Chunk[:],
+		len(testRawPacket.Chunk),
+		testRawPacket.Chunk,
 	}
 	packet, err := asn1.Marshal(asnPacket)
 	checkError(t, err)
@@ -230,3 +495,99 @@ func TestPacketSizes(t *testing.T) {
 	fmt.Println(" Signed and encrypted JSON length:", len(jout))
 	fmt.Println("  Signed and encrypted gob length:", len(gout))
 }
+
+// fuzzKeys loads the signer and generates a sink key for the fuzz
+// targets, which may run without TestLoadKeys.
+func fuzzKeys(f *testing.F) (*rsa.PrivateKey, []byte, []byte) {
+	in, err := ioutil.ReadFile(signerFile)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(in)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return key, pub[:], priv[:]
+}
+
+// fuzzPackets returns wire packets of the smallest, default, and
+// largest chunk sizes.
+func fuzzPackets(f *testing.F, key *rsa.PrivateKey, pub []byte) [][]byte {
+	var packets [][]byte
+	for _, size := range []int{MinChunkSize, ChunkSize, MaxChunkSize} {
+		_, p, err := NewSizedPacket(clock.System, 0, size, rand.Reader)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		out, err := SerialiseWire(p, pub, key)
+		if err != nil {
+			f.Fatal(err)
+		}
+		packets = append(packets, out)
+	}
+	return packets
+}
+
+func FuzzParsePacket(f *testing.F) {
+	key, pub, priv := fuzzKeys(f)
+	for _, packet := range fuzzPackets(f, key, pub) {
+		f.Add(packet)
+	}
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		p, err := ParsePacket(in, priv, &key.PublicKey)
+		if err != nil {
+			return
+		}
+
+		if len(p.Chunk) < MinChunkSize || len(p.Chunk) > MaxChunkSize {
+			t.Fatalf("accepted a packet with a %d byte chunk", len(p.Chunk))
+		}
+	})
+}
+
+func FuzzDecodePacket(f *testing.F) {
+	for _, size := range []int{0, MinChunkSize, MaxChunkSize} {
+		msg, err := asn1.Marshal(packet{
+			Timestamp: 1,
+			Counter:   1,
+			Size:      size,
+			Chunk:     make([]byte, MinChunkSize),
+		})
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(msg)
+	}
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		p, size, err := DecodePacket(msg)
+		if err == nil && len(p.Chunk) != size {
+			t.Fatalf("declared size %d doesn't match the %d byte chunk", size, len(p.Chunk))
+		}
+	})
+}
+
+func FuzzParseBundle(f *testing.F) {
+	key, pub, _ := fuzzKeys(f)
+	b := &Bundle{NotBefore: 1, NotAfter: 2, Packets: fuzzPackets(f, key, pub)}
+	out, err := SerialiseBundle(b, key)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(out)
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		b, err := ParseBundle(in, &key.PublicKey)
+		if err == nil && b.NotAfter <= b.NotBefore {
+			t.Fatal("accepted a bundle with an empty validity window")
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kisom/entropyshare/common/crypt"
+	"github.com/kisom/entropyshare/noise"
+)
+
+// SessionMarker is sent in place of a packet's length to begin a
+// session. No packet is this long, so a sink can tell a session from
+// a packet by the first two bytes a source sends.
+const SessionMarker = 0xffff
+
+// sessionPrologue binds the handshake to this protocol.
+var sessionPrologue = []byte("entropyshare session v1")
+
+var (
+	ErrBinding  = errors.New("session binding mismatch")
+	ErrRejected = errors.New("packet rejected by the sink")
+)
+
+// A session delivers a packet over a Noise IK handshake rather than
+// sealing it to the sink's key:
+//
+//	source -> sink: SessionMarker, handshake message 1
+//	sink -> source: handshake message 2
+//	source -> sink: Sign(binding || packet), encrypted
+//	sink -> source: the rejection reason, or nothing, encrypted
+//
+// Each message is prefixed with its length, and is at most
+// MaxPacketSize bytes. The sink's static key is its Curve25519 key;
+// the source's is generated for the session, as the source is
+// authenticated by its signature key instead. The signed binding is
+// the handshake hash, so a signed packet can't be replayed in another
+// session. Once both sides have discarded the session's ephemeral
+// keys, the packet can't be recovered from either side's long-term
+// keys.
+
+// SendSession delivers a packet to the sink whose public key is peer
+// in a session over rw, signing it with signer. If the sink rejects
+// the packet, an error wrapping ErrRejected is returned.
+func SendSession(rw io.ReadWriter, p *Packet, peer []byte, signer *rsa.PrivateKey) error {
+	encoded, err := encodePacket(p)
+	if err != nil {
+		return err
+	}
+
+	rs, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return err
+	}
+
+	s, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	hs := noise.NewInitiator(s, rs, sessionPrologue)
+	msg, err := hs.WriteMessage(nil)
+	if err != nil {
+		return err
+	}
+
+	var marker [2]byte
+	binary.BigEndian.PutUint16(marker[:], SessionMarker)
+	if err = writeMessage(rw, msg, marker[:]); err != nil {
+		return err
+	}
+
+	if msg, err = readMessage(rw); err != nil {
+		return err
+	}
+	if _, err = hs.ReadMessage(msg); err != nil {
+		return err
+	}
+
+	send, recv, err := hs.Split()
+	if err != nil {
+		return err
+	}
+
+	msg, err = crypt.Sign(append(hs.ChannelBinding(), encoded...), signer)
+	if err != nil {
+		return err
+	}
+	if msg, err = send.Encrypt(nil, nil, msg); err != nil {
+		return err
+	}
+	if err = writeMessage(rw, msg, nil); err != nil {
+		return err
+	}
+
+	if msg, err = readMessage(rw); err != nil {
+		return err
+	}
+	reason, err := recv.Decrypt(nil, msg)
+	if err != nil {
+		return err
+	} else if len(reason) != 0 {
+		return fmt.Errorf("%w: %s", ErrRejected, reason)
+	}
+	return nil
+}
+
+// A Session is the sink's side of a session whose source has been
+// authenticated.
+type Session struct {
+	rw   io.ReadWriter
+	send *noise.CipherState
+}
+
+// AcceptSession answers a session over rw, once the SessionMarker has
+// been read, with the sink's private key priv. The packet is checked
+// against signer, but not against the sink's counter or clock. The
+// session is returned, even with an error, once the source has been
+// authenticated; the sink should Reply on it with the outcome.
+func AcceptSession(rw io.ReadWriter, priv []byte, signer *rsa.PublicKey) (*Packet, *Session, error) {
+	if len(priv) != 32 {
+		return nil, nil, crypt.ErrNoPrivateKey
+	}
+
+	s, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hs := noise.NewResponder(s, sessionPrologue)
+	msg, err := readMessage(rw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = hs.ReadMessage(msg); err != nil {
+		return nil, nil, err
+	}
+
+	if msg, err = hs.WriteMessage(nil); err != nil {
+		return nil, nil, err
+	}
+	if err = writeMessage(rw, msg, nil); err != nil {
+		return nil, nil, err
+	}
+
+	send, recv, err := hs.Split()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if msg, err = readMessage(rw); err != nil {
+		return nil, nil, err
+	}
+	if msg, err = recv.Decrypt(nil, msg); err != nil {
+		return nil, nil, err
+	}
+
+	msg, signed, err := crypt.Verify(msg, signer)
+	if err != nil {
+		return nil, nil, err
+	} else if !signed {
+		return nil, nil, ErrUnsignedPacket
+	}
+
+	session := &Session{rw: rw, send: send}
+	binding := hs.ChannelBinding()
+	if !bytes.HasPrefix(msg, binding) {
+		return nil, session, ErrBinding
+	}
+
+	p, _, err := DecodePacket(msg[len(binding):])
+	if err != nil {
+		return nil, session, err
+	}
+	return p, session, nil
+}
+
+// Reply tells the source whether its packet was accepted.
+func (s *Session) Reply(result error) error {
+	var reason []byte
+	if result != nil {
+		reason = []byte(result.Error())
+	}
+
+	msg, err := s.send.Encrypt(nil, nil, reason)
+	if err != nil {
+		return err
+	}
+	return writeMessage(s.rw, msg, nil)
+}
+
+// writeMessage writes a length-prefixed session message in a single
+// write, after prefix.
+func writeMessage(w io.Writer, msg, prefix []byte) error {
+	if len(msg) > MaxPacketSize {
+		return ErrPacketSize
+	}
+
+	out := append(prefix, 0, 0)
+	binary.BigEndian.PutUint16(out[len(out)-2:], uint16(len(msg)))
+	_, err := w.Write(append(out, msg...))
+	return err
+}
+
+// readMessage reads a length-prefixed session message.
+func readMessage(r io.Reader) ([]byte, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+
+	l := int(binary.BigEndian.Uint16(b[:]))
+	if l > MaxPacketSize {
+		return nil, ErrPacketSize
+	}
+
+	msg := make([]byte, l)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"code.google.com/p/go.crypto/nacl/box"
+	"github.com/kisom/entropyshare/clock"
+)
+
+// acceptSession answers a session on conn, replying with the result
+// of check on the packet.
+func acceptSession(conn net.Conn, priv []byte, signer *rsa.PublicKey, check func(*Packet) error) (*Packet, error) {
+	defer conn.Close()
+
+	var marker [2]byte
+	if _, err := io.ReadFull(conn, marker[:]); err != nil {
+		return nil, err
+	} else if binary.BigEndian.Uint16(marker[:]) != SessionMarker {
+		return nil, errors.New("no session marker")
+	}
+
+	p, session, err := AcceptSession(conn, priv, signer)
+	if err == nil {
+		err = check(p)
+	}
+	if session != nil {
+		session.Reply(err)
+	}
+	return p, err
+}
+
+func TestSession(t *testing.T) {
+	in, err := ioutil.ReadFile(signerFile)
+	checkError(t, err)
+	key, err := x509.ParsePKCS1PrivateKey(in)
+	checkError(t, err)
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	checkError(t, err)
+
+	_, p, err := NewPacket(clock.System, 0, rand.Reader)
+	checkError(t, err)
+
+	type accepted struct {
+		p   *Packet
+		err error
+	}
+	run := func(signer *rsa.PublicKey, check func(*Packet) error) (accepted, error) {
+		source, sink := net.Pipe()
+		done := make(chan accepted, 1)
+		go func() {
+			p, err := acceptSession(sink, priv[:], signer, check)
+			done <- accepted{p, err}
+		}()
+
+		err := SendSession(source, p, pub[:], key)
+		source.Close()
+		return <-done, err
+	}
+
+	accept := func(*Packet) error { return nil }
+	result, err := run(&key.PublicKey, accept)
+	checkError(t, err)
+	checkError(t, result.err)
+	if result.p.Counter != p.Counter || string(result.p.Chunk) != string(p.Chunk) {
+		t.Fatal("the packet wasn't delivered intact")
+	}
+
+	// The source is told why its packet was rejected.
+	result, err = run(&key.PublicKey, func(*Packet) error { return ErrCounter })
+	if !errors.Is(err, ErrRejected) || result.err != ErrCounter {
+		t.Fatalf("expected %v, have %v", ErrRejected, err)
+	}
+
+	// A source with another signer isn't authenticated, and isn't
+	// told anything.
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	checkError(t, err)
+	result, err = run(&other.PublicKey, accept)
+	if result.err != rsa.ErrVerification {
+		t.Fatalf("expected %v, have %v", rsa.ErrVerification, result.err)
+	} else if err != io.EOF {
+		t.Fatalf("expected %v, have %v", io.EOF, err)
+	}
+}
@@ -0,0 +1,434 @@
+// Package doctor checks that a sink's configuration or a source's
+// targets are usable before a daemon is started with them, rather
+// than having them fail at runtime.
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/kisom/entropyshare/clock"
+	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/sink"
+	"github.com/kisom/entropyshare/target"
+)
+
+// The severities of a finding.
+const (
+	OK      = "ok"
+	Warning = "warning"
+	Error   = "error"
+)
+
+// resolveTimeout bounds the lookup of an address's host.
+const resolveTimeout = 5 * time.Second
+
+// A Finding is the result of one check.
+type Finding struct {
+	Severity string
+	Check    string
+	Subject  string `json:",omitempty"`
+	Message  string
+}
+
+// Findings are the results of checking a configuration.
+type Findings []Finding
+
+// Failed reports whether any check found an error.
+func (fs Findings) Failed() bool {
+	for _, f := range fs {
+		if f.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *Findings) add(severity, check, subject, format string, args ...interface{}) {
+	*fs = append(*fs, Finding{
+		Severity: severity,
+		Check:    check,
+		Subject:  subject,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Options supply the keys that some checks need.
+type Options struct {
+	// Private is a sink's Curve25519 private key. When checking
+	// targets, the target holding its public key is found and
+	// given a loopback self-test.
+	Private []byte
+
+	// KEMPrivate is the sink's ML-KEM-768 private key. If the
+	// target found with Private has an ML-KEM key, it must match,
+	// and the self-test also seals a hybrid packet.
+	KEMPrivate []byte
+
+	// Signer is the source's signature key. If it is given, the
+	// self-test signs with it, and a sink's Signer is checked
+	// against it; otherwise a throwaway key is used.
+	Signer *rsa.PrivateKey
+
+	// Now is the time Next values are judged against; if it is
+	// zero, the current time is used.
+	Now time.Time
+
+	// Resolve, if set, is used to look up the hosts in
+	// addresses in place of the default resolver.
+	Resolve func(ctx context.Context, host string) ([]string, error)
+}
+
+func (opts *Options) now() time.Time {
+	if opts.Now.IsZero() {
+		return time.Now()
+	}
+	return opts.Now
+}
+
+// publicKey returns the Curve25519 public key for a private key.
+func publicKey(priv []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return key.PublicKey().Bytes(), nil
+}
+
+// kemPublicKey returns the ML-KEM-768 encapsulation key for a
+// decapsulation key.
+func kemPublicKey(kemPriv []byte) ([]byte, error) {
+	key, err := mlkem.NewDecapsulationKey768(kemPriv)
+	if err != nil {
+		return nil, err
+	}
+	return key.EncapsulationKey().Bytes(), nil
+}
+
+// checkAddress checks that an address has a port and, if it names a
+// host, that the host resolves. A sink's listening address may leave
+// the host out.
+func checkAddress(fs *Findings, opts *Options, subject, address string, listen bool) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		fs.add(Error, "address", subject, "%v", err)
+		return
+	}
+
+	if _, err = net.LookupPort("tcp", port); err != nil {
+		fs.add(Error, "address", subject, "invalid port %q", port)
+		return
+	}
+
+	if host == "" {
+		if !listen {
+			fs.add(Error, "address", subject, "no host given")
+		} else {
+			fs.add(OK, "address", subject, "listens on all interfaces")
+		}
+		return
+	}
+
+	resolve := opts.Resolve
+	if resolve == nil {
+		resolve = net.DefaultResolver.LookupHost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := resolve(ctx, host)
+	if err != nil {
+		fs.add(Error, "address", subject, "%s doesn't resolve: %v", host, err)
+		return
+	}
+	fs.add(OK, "address", subject, "%s resolves to %v", host, addrs)
+}
+
+// checkCounter checks that a counter can still advance.
+func checkCounter(fs *Findings, subject string, counter int64) {
+	switch {
+	case counter < 0:
+		fs.add(Error, "counter", subject, "counter %d is negative", counter)
+	case counter > math.MaxInt64-(1<<32):
+		fs.add(Warning, "counter", subject,
+			"counter %d is close to rolling over; rotate the keys and reset it", counter)
+	default:
+		fs.add(OK, "counter", subject, "counter is %d", counter)
+	}
+}
+
+// selfTest generates a packet, encrypts and signs it as a source
+// would, and parses it as a sink would. If kemPriv is given, a packet
+// sealed with the hybrid key agreement is tested as well.
+func selfTest(fs *Findings, subject string, priv, kemPriv []byte, signer *rsa.PrivateKey, verifier *rsa.PublicKey, chunkSize int) {
+	pub, err := publicKey(priv)
+	if err != nil {
+		fs.add(Error, "self-test", subject, "%v", err)
+		return
+	}
+
+	_, p, err := common.NewSizedPacket(clock.System, 0, chunkSize, rand.Reader)
+	if err != nil {
+		fs.add(Error, "self-test", subject, "failed to build a packet: %v", err)
+		return
+	}
+
+	out, err := common.SerialiseWire(p, pub, signer)
+	if err != nil {
+		fs.add(Error, "self-test", subject, "failed to encrypt a packet: %v", err)
+		return
+	}
+
+	parsed, err := common.ParsePacket(out, priv, verifier)
+	if err != nil {
+		fs.add(Error, "self-test", subject, "failed to decrypt a packet: %v", err)
+		return
+	}
+
+	if !bytes.Equal(parsed.Chunk, p.Chunk) || parsed.Counter != p.Counter {
+		fs.add(Error, "self-test", subject, "decrypted packet doesn't match")
+		return
+	}
+	fs.add(OK, "self-test", subject, "encrypted and decrypted a %d byte packet", len(out))
+
+	if kemPriv == nil {
+		return
+	}
+
+	kemPub, err := kemPublicKey(kemPriv)
+	if err != nil {
+		fs.add(Error, "self-test", subject, "%v", err)
+		return
+	}
+
+	out, err = common.SerialiseHybridWire(p, pub, kemPub, signer)
+	if err != nil {
+		fs.add(Error, "self-test", subject, "failed to seal a hybrid packet: %v", err)
+		return
+	}
+
+	parsed, err = common.ParseHybridOnlyPacket(out, priv, kemPriv, verifier)
+	if err != nil {
+		fs.add(Error, "self-test", subject, "failed to open a hybrid packet: %v", err)
+		return
+	}
+
+	if !bytes.Equal(parsed.Chunk, p.Chunk) || parsed.Counter != p.Counter {
+		fs.add(Error, "self-test", subject, "decrypted hybrid packet doesn't match")
+		return
+	}
+	fs.add(OK, "self-test", subject, "sealed and opened a %d byte hybrid packet", len(out))
+}
+
+// testSigner returns the signer to use for a self-test.
+func testSigner(opts *Options) (*rsa.PrivateKey, error) {
+	if opts.Signer != nil {
+		return opts.Signer, nil
+	}
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// Sink checks a sink's configuration, which should have been loaded
+// with sink.LoadConfig so that a PrivateFile has been read.
+func Sink(cfg *sink.Config, opts *Options) Findings {
+	var fs Findings
+	const subject = "sink"
+
+	privOK := len(cfg.Private) == 32
+	if privOK {
+		fs.add(OK, "private key", subject, "32 byte Curve25519 key")
+	} else {
+		fs.add(Error, "private key", subject, "Curve25519 private key is %d bytes, not 32", len(cfg.Private))
+	}
+
+	var verifier *rsa.PublicKey
+	pub, err := x509.ParsePKIXPublicKey(cfg.Signer)
+	if err != nil {
+		fs.add(Error, "signer", subject, "signer isn't a PKIX public key: %v", err)
+	} else if rsaPub, ok := pub.(*rsa.PublicKey); !ok {
+		fs.add(Error, "signer", subject, "signer is a %T, not an RSA key", pub)
+	} else {
+		verifier = rsaPub
+		if bits := rsaPub.N.BitLen(); bits < 2048 {
+			fs.add(Warning, "signer", subject, "signer is a %d-bit RSA key; use at least 2048 bits", bits)
+		} else {
+			fs.add(OK, "signer", subject, "%d-bit RSA key", bits)
+		}
+	}
+
+	if verifier != nil && opts.Signer != nil {
+		if opts.Signer.PublicKey.Equal(verifier) {
+			fs.add(OK, "signer", subject, "matches the given signature key")
+		} else {
+			fs.add(Error, "signer", subject, "doesn't match the given signature key")
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fs.add(Error, "config", subject, "%v", err)
+	}
+
+	kemOK := false
+	if cfg.KEMPrivate != nil {
+		if _, err := kemPublicKey(cfg.KEMPrivate); err != nil {
+			fs.add(Error, "kem key", subject, "invalid ML-KEM-768 private key: %v", err)
+		} else {
+			kemOK = true
+			fs.add(OK, "kem key", subject, "packets may be sealed with X25519 and ML-KEM-768")
+		}
+	}
+
+	checkCounter(&fs, subject, cfg.Counter)
+
+	switch {
+	case cfg.Drift < 0:
+		fs.add(Error, "drift", subject, "drift %d is negative", cfg.Drift)
+	case cfg.Drift == 0:
+		fs.add(Warning, "drift", subject, "a drift of 0 needs the source's and sink's clocks to agree exactly")
+	case cfg.Drift > 86400:
+		fs.add(Warning, "drift", subject, "a drift of %ds allows packets more than a day old", cfg.Drift)
+	default:
+		fs.add(OK, "drift", subject, "timestamps may be off by up to %ds", cfg.Drift)
+	}
+
+	checkAddress(&fs, opts, subject, cfg.Address, true)
+
+	if privOK && verifier != nil {
+		signer, err := testSigner(opts)
+		if err != nil {
+			fs.add(Error, "self-test", subject, "%v", err)
+			return fs
+		}
+
+		// A throwaway signer can't be verified with the
+		// configured key, so the test only checks decryption.
+		if signer != opts.Signer {
+			verifier = &signer.PublicKey
+		}
+		var kemPriv []byte
+		if kemOK {
+			kemPriv = cfg.KEMPrivate
+		}
+		selfTest(&fs, subject, cfg.Private, kemPriv, signer, verifier, cfg.MaxChunk)
+	}
+	return fs
+}
+
+// Targets checks a source's targets.
+func Targets(targets []*target.Target, opts *Options) Findings {
+	var fs Findings
+	now := opts.now().Unix()
+
+	var matchPub []byte
+	if opts.Private != nil {
+		var err error
+		matchPub, err = publicKey(opts.Private)
+		if err != nil {
+			fs.add(Error, "private key", "", "invalid Curve25519 private key: %v", err)
+		}
+	}
+
+	seen := map[string]bool{}
+	var matched *target.Target
+	for _, t := range targets {
+		subject := t.Address
+		if subject == "" {
+			fs.add(Error, "address", "", "a target has no address")
+			continue
+		}
+
+		if seen[t.Address] {
+			fs.add(Error, "duplicate", subject, "address appears more than once")
+		}
+		seen[t.Address] = true
+
+		if len(t.Public) != 32 {
+			fs.add(Error, "public key", subject, "Curve25519 public key is %d bytes, not 32", len(t.Public))
+		} else {
+			fs.add(OK, "public key", subject, "32 byte Curve25519 key")
+			if matchPub != nil && bytes.Equal(t.Public, matchPub) {
+				fs.add(OK, "public key", subject, "matches the given private key")
+				matched = t
+			}
+		}
+
+		if t.KEMPublic != nil {
+			if t.Session {
+				fs.add(Error, "session", subject, "sessions don't use the ML-KEM key; drop one or the other")
+			}
+
+			if _, err := mlkem.NewEncapsulationKey768(t.KEMPublic); err != nil {
+				fs.add(Error, "kem key", subject, "invalid ML-KEM-768 public key: %v", err)
+			} else {
+				fs.add(OK, "kem key", subject, "packets are sealed with X25519 and ML-KEM-768")
+			}
+		}
+
+		if t.ChunkSize != 0 && (t.ChunkSize < common.MinChunkSize || t.ChunkSize > common.MaxChunkSize) {
+			fs.add(Error, "chunk size", subject, "chunk size %d isn't between %d and %d",
+				t.ChunkSize, common.MinChunkSize, common.MaxChunkSize)
+		}
+
+		checkCounter(&fs, subject, t.Counter)
+
+		switch {
+		case t.Next < 0:
+			fs.add(Error, "next", subject, "next update time %d is negative", t.Next)
+		case t.Next > now+86400:
+			fs.add(Warning, "next", subject, "next update is more than a day away, at %s",
+				time.Unix(t.Next, 0).UTC().Format(time.RFC3339))
+		case t.Next > now:
+			fs.add(OK, "next", subject, "next update is due in %s",
+				time.Duration(t.Next-now)*time.Second)
+		default:
+			fs.add(OK, "next", subject, "next update is due")
+		}
+
+		if t.Paused {
+			fs.add(Warning, "paused", subject, "target is paused")
+		}
+
+		checkAddress(&fs, opts, subject, t.Address, false)
+	}
+
+	if matchPub != nil {
+		if matched == nil {
+			fs.add(Error, "public key", "", "no target has the public key for the given private key")
+			return fs
+		}
+
+		signer, err := testSigner(opts)
+		if err != nil {
+			fs.add(Error, "self-test", matched.Address, "%v", err)
+			return fs
+		}
+		var kemPriv []byte
+		switch {
+		case matched.KEMPublic == nil:
+		case opts.KEMPrivate == nil:
+			fs.add(Warning, "self-test", matched.Address,
+				"hybrid packets aren't tested without the sink's ML-KEM key")
+		default:
+			kemPub, err := kemPublicKey(opts.KEMPrivate)
+			if err != nil {
+				fs.add(Error, "kem key", "", "invalid ML-KEM-768 private key: %v", err)
+			} else if !bytes.Equal(kemPub, matched.KEMPublic) {
+				fs.add(Error, "kem key", matched.Address, "doesn't match the given ML-KEM key")
+			} else {
+				fs.add(OK, "kem key", matched.Address, "matches the given ML-KEM key")
+				kemPriv = opts.KEMPrivate
+			}
+		}
+		selfTest(&fs, matched.Address, opts.Private, kemPriv, signer, &signer.PublicKey, matched.ChunkSize)
+	}
+	return fs
+}
@@ -0,0 +1,172 @@
+package doctor
+
+import (
+	"context"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/box"
+	"github.com/kisom/entropyshare/sink"
+	"github.com/kisom/entropyshare/target"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// resolve resolves only example.net's hosts, so that the tests don't
+// depend on DNS.
+func resolve(ctx context.Context, host string) ([]string, error) {
+	if host == "sink.example.net" || host == "127.0.0.1" {
+		return []string{"192.0.2.1"}, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+// has reports whether the findings include one with the given
+// severity and check.
+func has(fs Findings, severity, check string) bool {
+	for _, f := range fs {
+		if f.Severity == severity && f.Check == check {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSink(t *testing.T) {
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	checkError(t, err)
+	spub, err := x509.MarshalPKIXPublicKey(&signer.PublicKey)
+	checkError(t, err)
+
+	_, priv, err := box.GenerateKey(rand.Reader)
+	checkError(t, err)
+
+	cfg := &sink.Config{
+		Address: ":9437",
+		Signer:  spub,
+		Private: priv[:],
+		Drift:   120,
+	}
+
+	opts := &Options{Signer: signer, Resolve: resolve}
+	fs := Sink(cfg, opts)
+	if fs.Failed() || !has(fs, OK, "self-test") {
+		t.Fatalf("valid configuration failed: %+v", fs)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	checkError(t, err)
+	fs = Sink(cfg, &Options{Signer: other, Resolve: resolve})
+	if !has(fs, Error, "signer") {
+		t.Fatal("mismatched signer wasn't found")
+	}
+
+	bad := *cfg
+	bad.Private = priv[:16]
+	bad.Drift = 0
+	bad.Address = "nowhere.invalid:9437"
+	fs = Sink(&bad, opts)
+	for _, check := range []string{"private key", "address"} {
+		if !has(fs, Error, check) {
+			t.Fatalf("%s error wasn't found: %+v", check, fs)
+		}
+	}
+	if !has(fs, Warning, "drift") || has(fs, OK, "self-test") {
+		t.Fatalf("bad configuration: %+v", fs)
+	}
+
+	dk, err := mlkem.GenerateKey768()
+	checkError(t, err)
+	hybrid := *cfg
+	hybrid.KEMPrivate = dk.Bytes()
+	hybrid.RequireHybrid = true
+	fs = Sink(&hybrid, opts)
+	if fs.Failed() || !hasMessage(fs, "sealed and opened") {
+		t.Fatalf("hybrid self-test wasn't run: %+v", fs)
+	}
+}
+
+// hasMessage reports whether the findings include an OK one whose
+// message starts with prefix.
+func hasMessage(fs Findings, prefix string) bool {
+	for _, f := range fs {
+		if f.Severity == OK && strings.HasPrefix(f.Message, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTargets(t *testing.T) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	checkError(t, err)
+	otherPub, _, err := box.GenerateKey(rand.Reader)
+	checkError(t, err)
+
+	now := time.Now()
+	targets := []*target.Target{
+		{Address: "sink.example.net:9437", Public: pub[:], ChunkSize: 256},
+		{Address: "127.0.0.1:9437", Public: otherPub[:], Next: now.Unix()},
+	}
+
+	opts := &Options{Private: priv[:], Now: now, Resolve: resolve}
+	fs := Targets(targets, opts)
+	if fs.Failed() || !has(fs, OK, "self-test") {
+		t.Fatalf("valid targets failed: %+v", fs)
+	}
+
+	targets[1].Next = now.Add(90 * time.Minute).Unix()
+	fs = Targets(targets, opts)
+	if !hasMessage(fs, "next update is due in 1h30m0s") {
+		t.Fatalf("time until the next update wasn't reported: %+v", fs)
+	}
+
+	dk, err := mlkem.GenerateKey768()
+	checkError(t, err)
+	targets[0].KEMPublic = dk.EncapsulationKey().Bytes()
+	fs = Targets(targets, opts)
+	if fs.Failed() || !has(fs, Warning, "self-test") {
+		t.Fatalf("untested hybrid packets weren't reported: %+v", fs)
+	}
+
+	other, err := mlkem.GenerateKey768()
+	checkError(t, err)
+	fs = Targets(targets, &Options{Private: priv[:], KEMPrivate: other.Bytes(), Now: now, Resolve: resolve})
+	if !has(fs, Error, "kem key") {
+		t.Fatalf("mismatched ML-KEM key wasn't found: %+v", fs)
+	}
+
+	opts.KEMPrivate = dk.Bytes()
+	fs = Targets(targets, opts)
+	if fs.Failed() || !hasMessage(fs, "sealed and opened") {
+		t.Fatalf("hybrid self-test wasn't run: %+v", fs)
+	}
+	opts.KEMPrivate = nil
+	targets[0].KEMPublic = nil
+
+	targets = append(targets,
+		&target.Target{Address: "127.0.0.1:9437", Public: pub[:16], Counter: -1},
+		&target.Target{Address: "nowhere.invalid", Public: otherPub[:], ChunkSize: 16,
+			Next: now.Add(72 * time.Hour).Unix(), KEMPublic: pub[:], Session: true})
+	targets[0].Public = otherPub[:]
+
+	fs = Targets(targets, opts)
+	for _, check := range []string{"duplicate", "public key", "kem key", "session", "counter", "chunk size", "address"} {
+		if !has(fs, Error, check) {
+			t.Fatalf("%s error wasn't found: %+v", check, fs)
+		}
+	}
+	if !has(fs, Warning, "next") || has(fs, OK, "self-test") {
+		t.Fatalf("bad targets: %+v", fs)
+	}
+}
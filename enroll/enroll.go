@@ -0,0 +1,325 @@
+// Package enroll registers new sinks with a source. The source's
+// administrator issues a short-lived, one-time token, which is given
+// to the sink's administrator. The sink proves that it holds the
+// token when it sends its address and public key, and the source
+// proves that it issued the token when it returns its signer's public
+// key. The token's secret never crosses the network, so the exchange
+// needs no other protection.
+package enroll
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTTL is how long a token is valid for if no other lifetime
+// is given.
+const DefaultTTL = 15 * time.Minute
+
+const (
+	idSize     = 8
+	secretSize = 16
+	nonceSize  = 16
+
+	// timeout bounds an enrollment exchange, and maxMessage the
+	// size of its messages.
+	timeout    = 30 * time.Second
+	maxMessage = 16384
+)
+
+var (
+	// ErrToken is returned for a malformed token.
+	ErrToken = errors.New("enroll: invalid token")
+
+	// ErrRejected is returned when the source refuses an
+	// enrollment; the source's reason is appended to it.
+	ErrRejected = errors.New("enroll: enrollment rejected")
+
+	// ErrProof is returned when the source's response isn't
+	// authenticated by the token, so the signer's key it carries
+	// can't be trusted.
+	ErrProof = errors.New("enroll: source's response failed authentication")
+
+	// errBadToken is reported to a sink whose token is unknown,
+	// expired, already used, or whose proof doesn't verify; the
+	// sink isn't told which.
+	errBadToken = errors.New("invalid, expired, or used token")
+)
+
+// A Token authorises a single enrollment. Its string form,
+// "ID.SECRET" in hex, is what is handed to the sink's administrator.
+type Token struct {
+	ID     []byte
+	Secret []byte
+}
+
+func (t *Token) String() string {
+	return hex.EncodeToString(t.ID) + "." + hex.EncodeToString(t.Secret)
+}
+
+// ParseToken parses the string form of a token.
+func ParseToken(s string) (*Token, error) {
+	id, secret, ok := strings.Cut(strings.TrimSpace(s), ".")
+	if !ok {
+		return nil, ErrToken
+	}
+
+	var t Token
+	var err error
+	t.ID, err = hex.DecodeString(id)
+	if err != nil || len(t.ID) != idSize {
+		return nil, ErrToken
+	}
+
+	t.Secret, err = hex.DecodeString(secret)
+	if err != nil || len(t.Secret) != secretSize {
+		return nil, ErrToken
+	}
+	return &t, nil
+}
+
+type request struct {
+	ID      []byte
+	Address string
+	Public  []byte
+	Nonce   []byte
+	Proof   []byte
+}
+
+type response struct {
+	Error  string `json:",omitempty"`
+	Signer []byte `json:",omitempty"`
+	Proof  []byte `json:",omitempty"`
+}
+
+// mac computes an HMAC-SHA256 under the token's secret over a label
+// and length-prefixed fields.
+func mac(secret []byte, label string, fields ...[]byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(label))
+	for _, f := range fields {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(f)))
+		h.Write(n[:])
+		h.Write(f)
+	}
+	return h.Sum(nil)
+}
+
+func (req *request) proof(secret []byte) []byte {
+	return mac(secret, "entropyshare enroll request",
+		req.ID, []byte(req.Address), req.Public, req.Nonce)
+}
+
+func responseProof(secret, requestProof, signer []byte) []byte {
+	return mac(secret, "entropyshare enroll response", requestProof, signer)
+}
+
+// A RegisterFunc adds an enrolled sink to the source's targets.
+type RegisterFunc func(address string, public []byte) error
+
+type issued struct {
+	secret  []byte
+	expires time.Time
+}
+
+// A Server issues tokens and enrolls the sinks that present them.
+type Server struct {
+	signer   []byte
+	register RegisterFunc
+
+	lock   sync.Mutex
+	tokens map[string]*issued
+}
+
+// NewServer returns a server that hands out signer, the source's
+// PKIX-encoded public key, and passes enrolled sinks to register.
+func NewServer(signer []byte, register RegisterFunc) *Server {
+	return &Server{
+		signer:   signer,
+		register: register,
+		tokens:   map[string]*issued{},
+	}
+}
+
+// Issue returns a new token that is valid for one enrollment within
+// ttl, and the time it expires.
+func (s *Server) Issue(ttl time.Duration) (*Token, time.Time, error) {
+	t := &Token{
+		ID:     make([]byte, idSize),
+		Secret: make([]byte, secretSize),
+	}
+
+	_, err := io.ReadFull(rand.Reader, t.ID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	_, err = io.ReadFull(rand.Reader, t.Secret)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for id, tok := range s.tokens {
+		if now.After(tok.expires) {
+			delete(s.tokens, id)
+		}
+	}
+
+	expires := now.Add(ttl)
+	s.tokens[hex.EncodeToString(t.ID)] = &issued{secret: t.Secret, expires: expires}
+	return t, expires, nil
+}
+
+// redeem checks the request's proof against the token it names,
+// removing the token if it is valid.
+func (s *Server) redeem(req *request) (*issued, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := hex.EncodeToString(req.ID)
+	tok, ok := s.tokens[id]
+	if !ok {
+		return nil, errBadToken
+	}
+
+	if time.Now().After(tok.expires) {
+		delete(s.tokens, id)
+		return nil, errBadToken
+	}
+
+	if !hmac.Equal(req.Proof, req.proof(tok.secret)) {
+		return nil, errBadToken
+	}
+
+	delete(s.tokens, id)
+	return tok, nil
+}
+
+// restore puts back a redeemed token whose enrollment failed, so
+// that it may be retried.
+func (s *Server) restore(id []byte, tok *issued) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens[hex.EncodeToString(id)] = tok
+}
+
+// Serve handles enrollments on l until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	logger := slog.With("remote", conn.RemoteAddr().String())
+
+	var req request
+	err := json.NewDecoder(io.LimitReader(conn, maxMessage)).Decode(&req)
+	if err != nil {
+		logger.Warn("invalid enrollment request", "error", err)
+		return
+	}
+
+	resp, err := s.enroll(&req)
+	if err != nil {
+		logger.Warn("rejected enrollment", "target", req.Address, "error", err)
+		resp = &response{Error: err.Error()}
+	} else {
+		logger.Info("enrolled sink", "target", req.Address)
+	}
+
+	err = json.NewEncoder(conn).Encode(resp)
+	if err != nil {
+		logger.Warn("failed to send enrollment response", "error", err)
+	}
+}
+
+func (s *Server) enroll(req *request) (*response, error) {
+	if req.Address == "" || len(req.Public) != 32 || len(req.Nonce) != nonceSize {
+		return nil, errors.New("malformed request")
+	}
+
+	tok, err := s.redeem(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.register(req.Address, req.Public)
+	if err != nil {
+		s.restore(req.ID, tok)
+		return nil, err
+	}
+
+	return &response{
+		Signer: s.signer,
+		Proof:  responseProof(tok.secret, req.Proof, s.signer),
+	}, nil
+}
+
+// Enroll registers a sink reachable at address, with the given
+// Curve25519 public key, with the source whose enrollment listener is
+// at source. It returns the source signer's PKIX-encoded public key.
+func Enroll(source string, t *Token, address string, public []byte) ([]byte, error) {
+	req := &request{
+		ID:      t.ID,
+		Address: address,
+		Public:  public,
+		Nonce:   make([]byte, nonceSize),
+	}
+
+	_, err := io.ReadFull(rand.Reader, req.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	req.Proof = req.proof(t.Secret)
+
+	conn, err := net.DialTimeout("tcp", source, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp response
+	err = json.NewDecoder(io.LimitReader(conn, maxMessage)).Decode(&resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrRejected, resp.Error)
+	}
+
+	if !hmac.Equal(resp.Proof, responseProof(t.Secret, req.Proof, resp.Signer)) {
+		return nil, ErrProof
+	}
+	return resp.Signer, nil
+}
@@ -0,0 +1,160 @@
+package enroll
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+var (
+	testSigner = []byte("the signer's PKIX public key")
+	testPublic = bytes.Repeat([]byte{0x42}, 32)
+)
+
+// startServer runs an enrollment server on a loopback listener,
+// recording the sinks it registers.
+func startServer(t *testing.T, register RegisterFunc) (*Server, string) {
+	srv := NewServer(testSigner, register)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	checkError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go srv.Serve(l)
+	return srv, l.Addr().String()
+}
+
+func TestEnroll(t *testing.T) {
+	var lock sync.Mutex
+	registered := map[string][]byte{}
+	srv, addr := startServer(t, func(address string, public []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if registered[address] != nil {
+			return errors.New("already a target")
+		}
+		registered[address] = public
+		return nil
+	})
+
+	tok, _, err := srv.Issue(DefaultTTL)
+	checkError(t, err)
+
+	parsed, err := ParseToken(tok.String())
+	checkError(t, err)
+
+	// A wrong secret is refused, but doesn't use up the token.
+	forged := &Token{ID: parsed.ID, Secret: make([]byte, secretSize)}
+	_, err = Enroll(addr, forged, "sink.example.net:9437", testPublic)
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("forged token: expected %v, have %v", ErrRejected, err)
+	}
+
+	signer, err := Enroll(addr, parsed, "sink.example.net:9437", testPublic)
+	checkError(t, err)
+
+	if !bytes.Equal(signer, testSigner) {
+		t.Fatal("wrong signer key returned")
+	}
+	lock.Lock()
+	if !bytes.Equal(registered["sink.example.net:9437"], testPublic) {
+		t.Fatal("sink wasn't registered")
+	}
+	lock.Unlock()
+
+	_, err = Enroll(addr, parsed, "other.example.net:9437", testPublic)
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("reused token: expected %v, have %v", ErrRejected, err)
+	}
+
+	// A failed registration leaves the token usable.
+	tok, _, err = srv.Issue(DefaultTTL)
+	checkError(t, err)
+	_, err = Enroll(addr, tok, "sink.example.net:9437", testPublic)
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("duplicate target: expected %v, have %v", ErrRejected, err)
+	}
+	_, err = Enroll(addr, tok, "third.example.net:9437", testPublic)
+	checkError(t, err)
+
+	tok, _, err = srv.Issue(-time.Second)
+	checkError(t, err)
+	_, err = Enroll(addr, tok, "fourth.example.net:9437", testPublic)
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("expired token: expected %v, have %v", ErrRejected, err)
+	}
+}
+
+func TestEnrollForgedResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	checkError(t, err)
+	defer l.Close()
+
+	// An impostor that doesn't know the token's secret can't
+	// substitute its own signer key.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var req request
+		json.NewDecoder(conn).Decode(&req)
+		json.NewEncoder(conn).Encode(&response{
+			Signer: []byte("an impostor's key"),
+			Proof:  req.Proof,
+		})
+	}()
+
+	srv := NewServer(testSigner, nil)
+	tok, _, err := srv.Issue(DefaultTTL)
+	checkError(t, err)
+
+	_, err = Enroll(l.Addr().String(), tok, "sink.example.net:9437", testPublic)
+	if err != ErrProof {
+		t.Fatalf("expected %v, have %v", ErrProof, err)
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	for _, s := range []string{"", "0011", "0011.2233", "zz.zz",
+		"0011223344556677.00112233445566778899aabbccddeeff00"} {
+		if _, err := ParseToken(s); err != ErrToken {
+			t.Fatalf("%q: expected %v, have %v", s, ErrToken, err)
+		}
+	}
+
+	tok, err := ParseToken("0011223344556677.00112233445566778899aabbccddeeff\n")
+	checkError(t, err)
+	if tok.String() != "0011223344556677.00112233445566778899aabbccddeeff" {
+		t.Fatalf("token doesn't round trip: %s", tok)
+	}
+}
+
+func FuzzParseToken(f *testing.F) {
+	f.Add(strings.Repeat("ab", idSize) + "." + strings.Repeat("cd", secretSize))
+	f.Add(".")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		tok, err := ParseToken(s)
+		if err != nil {
+			return
+		}
+
+		again, err := ParseToken(tok.String())
+		if err != nil || !bytes.Equal(again.ID, tok.ID) || !bytes.Equal(again.Secret, tok.Secret) {
+			t.Fatalf("token %q doesn't survive a round trip", s)
+		}
+	})
+}
@@ -0,0 +1,245 @@
+// Package health implements continuous health tests on entropy, as
+// described in NIST SP 800-90B section 4.4: the Repetition Count
+// Test and the Adaptive Proportion Test. These run over every byte
+// that passes through a Tester, across chunk boundaries, and are
+// joined by a chunk-level sanity check. They catch a generator that
+// has failed outright (such as a stuck TPM, or a read that returns
+// all zeros), not subtle statistical weaknesses.
+package health
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+// DefaultEntropy is the min-entropy, in bits per byte, assumed for
+// samples if none is given.
+const DefaultEntropy = 8.0
+
+// FalsePositive is the false positive probability (α) the test
+// cutoffs are chosen for, 2^-40.
+var FalsePositive = math.Pow(2, -40)
+
+// WindowSize is the Adaptive Proportion Test window size for
+// non-binary samples.
+const WindowSize = 512
+
+// The health test failures. A chunk that fails is never passed on.
+var (
+	ErrRepetition = errors.New("health: repetition count test failed")
+	ErrProportion = errors.New("health: adaptive proportion test failed")
+	ErrChunk      = errors.New("health: chunk failed sanity check")
+)
+
+// IsFailure returns true if err is a health test failure.
+func IsFailure(err error) bool {
+	return err == ErrRepetition || err == ErrProportion || err == ErrChunk
+}
+
+// Stats counts the samples and chunks seen by a Tester, and its
+// failures.
+type Stats struct {
+	Chunks     int64
+	Samples    int64
+	Repetition int64
+	Proportion int64
+	Chunk      int64
+}
+
+// Failures returns the total number of failed chunks.
+func (s Stats) Failures() int64 {
+	return s.Repetition + s.Proportion + s.Chunk
+}
+
+type state struct {
+	started bool
+
+	rctValue byte
+	rctCount int
+
+	aptValue byte
+	aptCount int
+	aptSeen  int
+
+	last [sha256.Size]byte
+}
+
+// A Tester runs the continuous health tests on a stream of chunks.
+type Tester struct {
+	lock      sync.Mutex
+	rctCutoff int
+	aptCutoff int
+	state     state
+	stats     Stats
+}
+
+// New returns a Tester for samples with the given min-entropy per
+// byte. An entropy of 0 selects DefaultEntropy.
+func New(entropy float64) *Tester {
+	if entropy <= 0 || entropy > 8 {
+		entropy = DefaultEntropy
+	}
+
+	return &Tester{
+		rctCutoff: RepetitionCutoff(entropy, FalsePositive),
+		aptCutoff: ProportionCutoff(entropy, FalsePositive, WindowSize),
+	}
+}
+
+// RepetitionCutoff returns the Repetition Count Test cutoff for
+// samples with the given min-entropy and false positive
+// probability, 1 + ⌈-log2(α)/H⌉.
+func RepetitionCutoff(entropy, alpha float64) int {
+	return 1 + int(math.Ceil(-math.Log2(alpha)/entropy))
+}
+
+// ProportionCutoff returns the Adaptive Proportion Test cutoff for
+// samples with the given min-entropy, false positive probability,
+// and window size: 1 + CRITBINOM(W, 2^-H, 1-α).
+func ProportionCutoff(entropy, alpha float64, window int) int {
+	p := math.Pow(2, -entropy)
+	var cdf float64
+	for k := 0; k <= window; k++ {
+		cdf += binomial(window, k, p)
+		if cdf >= 1-alpha {
+			return 1 + k
+		}
+	}
+	return window
+}
+
+// binomial returns the probability of exactly k successes in n
+// trials with probability p.
+func binomial(n, k int, p float64) float64 {
+	ln, _ := math.Lgamma(float64(n + 1))
+	lk, _ := math.Lgamma(float64(k + 1))
+	lnk, _ := math.Lgamma(float64(n - k + 1))
+	return math.Exp(ln - lk - lnk + float64(k)*math.Log(p) +
+		float64(n-k)*math.Log1p(-p))
+}
+
+// Check runs the health tests over chunk. If the chunk fails, the
+// tests' state is left as it was before the chunk, so that a
+// rejected chunk doesn't affect the tests on those that follow.
+func (t *Tester) Check(chunk []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	st := t.state
+	err := t.check(&st, chunk)
+	t.stats.Chunks++
+	switch err {
+	case nil:
+		t.state = st
+		t.stats.Samples += int64(len(chunk))
+	case ErrRepetition:
+		t.stats.Repetition++
+	case ErrProportion:
+		t.stats.Proportion++
+	case ErrChunk:
+		t.stats.Chunk++
+	}
+	return err
+}
+
+func (t *Tester) check(st *state, chunk []byte) error {
+	if len(chunk) == 0 {
+		return ErrChunk
+	}
+
+	digest := sha256.Sum256(chunk)
+	if st.started && digest == st.last {
+		return ErrChunk
+	}
+	st.last = digest
+
+	if distinct(chunk) < minDistinct(len(chunk)) {
+		return ErrChunk
+	}
+
+	for _, b := range chunk {
+		if !st.started {
+			st.started = true
+			st.rctValue, st.rctCount = b, 1
+			st.aptValue, st.aptCount, st.aptSeen = b, 1, 1
+			continue
+		}
+
+		// Repetition Count Test (SP 800-90B 4.4.1).
+		if b == st.rctValue {
+			st.rctCount++
+			if st.rctCount >= t.rctCutoff {
+				return ErrRepetition
+			}
+		} else {
+			st.rctValue, st.rctCount = b, 1
+		}
+
+		// Adaptive Proportion Test (SP 800-90B 4.4.2).
+		if st.aptSeen == WindowSize {
+			st.aptValue, st.aptCount, st.aptSeen = b, 1, 1
+			continue
+		}
+		if b == st.aptValue {
+			st.aptCount++
+			if st.aptCount >= t.aptCutoff {
+				return ErrProportion
+			}
+		}
+		st.aptSeen++
+	}
+	return nil
+}
+
+// distinct returns the number of distinct byte values in chunk.
+func distinct(chunk []byte) int {
+	var seen [256]bool
+	var n int
+	for _, b := range chunk {
+		if !seen[b] {
+			seen[b] = true
+			n++
+		}
+	}
+	return n
+}
+
+// minDistinct returns the fewest distinct byte values a chunk of
+// length n may have: half the number expected from uniformly random
+// bytes, 256(1 - (255/256)^n).
+func minDistinct(n int) int {
+	expected := 256 * (1 - math.Pow(255.0/256.0, float64(n)))
+	return int(expected / 2)
+}
+
+// Stats returns the Tester's counters.
+func (t *Tester) Stats() Stats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.stats
+}
+
+// A Writer checks each chunk written to it, only passing those that
+// pass the health tests on to the underlying writer.
+type Writer struct {
+	t *Tester
+	w io.Writer
+}
+
+// NewWriter returns a Writer that checks chunks with t before
+// writing them to w.
+func NewWriter(t *Tester, w io.Writer) *Writer {
+	return &Writer{t: t, w: w}
+}
+
+// Write checks p, and writes it to the underlying writer if it
+// passes.
+func (hw *Writer) Write(p []byte) (int, error) {
+	if err := hw.t.Check(p); err != nil {
+		return 0, err
+	}
+	return hw.w.Write(p)
+}
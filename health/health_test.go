@@ -0,0 +1,116 @@
+package health
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func randomChunk(t *testing.T, n int) []byte {
+	chunk := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, chunk)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return chunk
+}
+
+func TestCutoffs(t *testing.T) {
+	// Values from SP 800-90B sections 4.4.1 and 4.4.2, for
+	// α = 2^-20.
+	alpha := 1.0 / (1 << 20)
+	if c := RepetitionCutoff(8, alpha); c != 4 {
+		t.Fatalf("RCT cutoff: expected 4, have %d", c)
+	}
+
+	if c := RepetitionCutoff(1, alpha); c != 21 {
+		t.Fatalf("RCT cutoff: expected 21, have %d", c)
+	}
+
+	if c := ProportionCutoff(8, alpha, WindowSize); c != 13 {
+		t.Fatalf("APT cutoff: expected 13, have %d", c)
+	}
+
+	if c := ProportionCutoff(1, alpha, WindowSize); c != 311 {
+		t.Fatalf("APT cutoff: expected 311, have %d", c)
+	}
+}
+
+func TestRandomPasses(t *testing.T) {
+	tester := New(0)
+	for i := 0; i < 256; i++ {
+		err := tester.Check(randomChunk(t, 1024))
+		if err != nil {
+			t.Fatalf("random chunk %d failed: %v", i, err)
+		}
+	}
+
+	if stats := tester.Stats(); stats.Failures() != 0 || stats.Samples != 256*1024 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	tester := New(0)
+
+	if err := tester.Check(make([]byte, 1024)); err != ErrChunk {
+		t.Fatalf("all-zero chunk should fail the sanity check, have %v", err)
+	}
+
+	// A run of identical bytes inside an otherwise random chunk.
+	chunk := randomChunk(t, 1024)
+	for i := 100; i < 110; i++ {
+		chunk[i] = 0x42
+	}
+	if err := tester.Check(chunk); err != ErrRepetition {
+		t.Fatalf("repeated bytes should fail the RCT, have %v", err)
+	}
+
+	// One value over-represented in a window, without runs.
+	chunk = randomChunk(t, 512)
+	for i := 0; i < 512; i += 8 {
+		chunk[i] = 0x42
+	}
+	for i := 1; i < 512; i += 8 {
+		if chunk[i] == 0x42 {
+			chunk[i] = 0x43
+		}
+	}
+	if err := tester.Check(chunk); err != ErrProportion {
+		t.Fatalf("biased chunk should fail the APT, have %v", err)
+	}
+
+	good := randomChunk(t, 1024)
+	if err := tester.Check(good); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err := tester.Check(good); err != ErrChunk {
+		t.Fatalf("repeated chunk should fail the sanity check, have %v", err)
+	}
+
+	stats := tester.Stats()
+	if stats.Repetition != 1 || stats.Proportion != 1 || stats.Chunk != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(New(0), buf)
+
+	_, err := w.Write(make([]byte, 64))
+	if !IsFailure(err) {
+		t.Fatalf("expected a health test failure, have %v", err)
+	}
+
+	if buf.Len() != 0 {
+		t.Fatal("failed chunk should not have been written")
+	}
+
+	_, err = w.Write(randomChunk(t, 64))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,261 @@
+// Package inspect explains what a sink makes of a captured wire
+// packet. It peels the packet's layers in the order
+// common.ParseHybridPacket does, recording what each one holds and
+// naming the check that a rejected packet fails.
+package inspect
+
+import (
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/common/crypt"
+)
+
+// The checks made on a packet, in the order they are made.
+const (
+	CheckSize      = "common.ParsePacket: packet size"
+	CheckBoxSize   = "crypt.Decrypt: box size"
+	CheckKEMKey    = "crypt.DecryptHybrid: ML-KEM key"
+	CheckBox       = "crypt.Decrypt: box authentication"
+	CheckEncoding  = "crypt.Verify: signed message encoding"
+	CheckSignature = "crypt.Verify: signature"
+	CheckUnsigned  = "common.ParsePacket: packet is signed"
+	CheckPacket    = "common.ParsePacket: packet encoding"
+	CheckChunk     = "common.ParsePacket: chunk size"
+)
+
+// The states of a layer that is checked.
+const (
+	Valid     = "valid"
+	Invalid   = "invalid"
+	Absent    = "absent"
+	Unchecked = "unchecked"
+)
+
+// The ways a packet may be sealed.
+const (
+	SealingClassic = "classic"
+	SealingHybrid  = "hybrid"
+)
+
+// PacketInfo describes the decoded contents of a packet.
+type PacketInfo struct {
+	Timestamp int64
+
+	// Drift is how long before the inspection the packet was
+	// generated, in seconds; it is negative for a packet from
+	// the future.
+	Drift int64
+
+	Counter      int64
+	DeclaredSize int
+	Chunk        int
+}
+
+// A Report describes each layer of a packet. Layers that couldn't be
+// reached are left empty.
+type Report struct {
+	// Size is the size of the packet, without the 2-byte length
+	// header; Header is set if the capture included it.
+	Size   int
+	Header bool
+
+	// Sealing is SealingClassic or SealingHybrid once the box
+	// has been opened. Until then, the ephemeral key and nonce
+	// are read as a classic box's.
+	Sealing       string `json:",omitempty"`
+	KEMCiphertext string `json:",omitempty"`
+
+	Ephemeral string `json:",omitempty"`
+	Nonce     string `json:",omitempty"`
+	Box       string
+	Signature string      `json:",omitempty"`
+	Packet    *PacketInfo `json:",omitempty"`
+
+	// Failed names the first check the packet failed, and Error
+	// is the error it failed with.
+	Failed string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+func (r *Report) fail(check string, err error) *Report {
+	if r.Failed == "" {
+		r.Failed = check
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// Complete reports whether every check could be made, which needs
+// both the sink's private key and the signer's public key.
+func (r *Report) Complete() bool {
+	return r.Failed != "" || (r.Box != Unchecked && r.Signature != Unchecked)
+}
+
+// StripHeader removes the 2-byte length header that precedes a packet
+// on the wire, if the capture includes it, and reports whether it
+// did.
+func StripHeader(in []byte) ([]byte, bool) {
+	if len(in) > 2 && int(binary.BigEndian.Uint16(in)) == len(in)-2 {
+		return in[2:], true
+	}
+	return in, false
+}
+
+// Packet inspects a captured packet, which may include its length
+// header. Without priv, the sink's private key, only the outer layer
+// can be described; without signer, the signature isn't checked. If
+// kemPriv, the sink's ML-KEM key, is given, the packet is opened as a
+// hybrid box before a classic one, as a sink with that key does.
+func Packet(in []byte, priv, kemPriv []byte, signer *rsa.PublicKey, now time.Time) *Report {
+	r := &Report{Box: Unchecked}
+	in, r.Header = StripHeader(in)
+	r.Size = len(in)
+	if r.Size > common.MaxPacketSize {
+		return r.fail(CheckSize, common.ErrPacketSize)
+	}
+
+	b, err := crypt.ParseBox(in)
+	if err != nil {
+		return r.fail(CheckBoxSize, err)
+	}
+	r.describeBox(b)
+
+	if priv == nil {
+		return r
+	}
+
+	// Nothing marks a hybrid box, so, as in a sink, each kind is
+	// tried in turn.
+	var msg []byte
+	mayBeHybrid := r.Size >= crypt.HybridOverhead
+	if kemPriv != nil && mayBeHybrid {
+		hb, out, err := crypt.OpenHybrid(in, priv, kemPriv)
+		switch err {
+		case nil:
+			r.Sealing = SealingHybrid
+			r.KEMCiphertext = hex.EncodeToString(in[:crypt.KEMCiphertextSize])
+			r.describeBox(hb)
+			msg = out
+			r.Box = Valid
+		case crypt.ErrDecrypt:
+			// It may still be a classic box.
+		default:
+			return r.fail(CheckKEMKey, err)
+		}
+	}
+
+	if r.Box != Valid {
+		msg, err = b.Open(priv)
+		switch {
+		case err != nil && kemPriv != nil && mayBeHybrid:
+			r.Box = Invalid
+			return r.fail(CheckBox, fmt.Errorf("%v, as either a classic or a hybrid box", err))
+		case err != nil && mayBeHybrid:
+			r.Box = Invalid
+			return r.fail(CheckBox, fmt.Errorf("%v; a hybrid box needs the sink's ML-KEM key", err))
+		case err != nil:
+			r.Box = Invalid
+			return r.fail(CheckBox, err)
+		}
+		r.Sealing = SealingClassic
+		r.Box = Valid
+	}
+
+	sm, err := crypt.ParseSigned(msg)
+	if err != nil {
+		return r.fail(CheckEncoding, err)
+	}
+
+	switch {
+	case !sm.Signed():
+		r.Signature = Absent
+		r.fail(CheckUnsigned, common.ErrUnsignedPacket)
+	case signer == nil:
+		r.Signature = Unchecked
+	default:
+		err = sm.VerifySignature(signer)
+		if err != nil {
+			r.Signature = Invalid
+			r.fail(CheckSignature, err)
+		} else {
+			r.Signature = Valid
+		}
+	}
+
+	// A sink stops at a bad or missing signature, but the
+	// contents are still decoded to help explain the packet.
+	p, size, err := common.DecodePacket(sm.Message)
+	if p == nil {
+		return r.fail(CheckPacket, err)
+	}
+
+	r.Packet = &PacketInfo{
+		Timestamp:    p.Timestamp,
+		Drift:        now.Unix() - p.Timestamp,
+		Counter:      p.Counter,
+		DeclaredSize: size,
+		Chunk:        len(p.Chunk),
+	}
+	if err != nil {
+		r.fail(CheckChunk, err)
+	}
+	return r
+}
+
+func (r *Report) describeBox(b *crypt.Box) {
+	r.Ephemeral = hex.EncodeToString(b.Ephemeral[:])
+	r.Nonce = hex.EncodeToString(b.Nonce[:])
+}
+
+// WriteText writes the report as text, one layer to a line.
+func (r *Report) WriteText(w io.Writer) {
+	header := ""
+	if r.Header {
+		header = " (length header stripped)"
+	}
+	fmt.Fprintf(w, "packet:     %d bytes%s\n", r.Size, header)
+
+	switch r.Sealing {
+	case SealingHybrid:
+		fmt.Fprintf(w, "sealing:    hybrid X25519 and ML-KEM-768\n")
+		fmt.Fprintf(w, "kem:        %s... (%d bytes)\n", r.KEMCiphertext[:32], crypt.KEMCiphertextSize)
+	case SealingClassic:
+		fmt.Fprintf(w, "sealing:    X25519\n")
+	}
+
+	if r.Ephemeral != "" {
+		fmt.Fprintf(w, "ephemeral:  %s\n", r.Ephemeral)
+		fmt.Fprintf(w, "nonce:      %s\n", r.Nonce)
+		fmt.Fprintf(w, "box:        %s\n", r.Box)
+	}
+
+	if r.Signature != "" {
+		fmt.Fprintf(w, "signature:  %s\n", r.Signature)
+	}
+
+	if p := r.Packet; p != nil {
+		fmt.Fprintf(w, "timestamp:  %s (drift %ds)\n",
+			time.Unix(p.Timestamp, 0).UTC().Format(time.RFC3339), p.Drift)
+		fmt.Fprintf(w, "counter:    %d\n", p.Counter)
+		fmt.Fprintf(w, "chunk:      %d bytes (declared %d)\n", p.Chunk, p.DeclaredSize)
+	}
+
+	switch {
+	case r.Failed != "":
+		fmt.Fprintf(w, "result:     failed %s: %s\n", r.Failed, r.Error)
+	case r.Box == Unchecked:
+		fmt.Fprintf(w, "result:     incomplete; the sink's private key is needed to open the box\n")
+	case r.Signature == Unchecked:
+		fmt.Fprintf(w, "result:     incomplete; the signer's public key is needed to check the signature\n")
+	case r.Sealing == SealingHybrid:
+		fmt.Fprintf(w, "result:     passed the checks in crypt.DecryptHybrid and common.ParseHybridPacket\n")
+	default:
+		fmt.Fprintf(w, "result:     passed the checks in crypt.Decrypt and common.ParsePacket\n")
+	}
+}
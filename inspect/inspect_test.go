@@ -0,0 +1,185 @@
+package inspect
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/box"
+	"github.com/kisom/entropyshare/clock"
+	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/common/crypt"
+)
+
+func checkError(t testing.TB, err error) {
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+type testKeys struct {
+	signer *rsa.PrivateKey
+	pub    []byte
+	priv   []byte
+}
+
+func newTestKeys(t testing.TB) *testKeys {
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	checkError(t, err)
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	checkError(t, err)
+	return &testKeys{signer: signer, pub: pub[:], priv: priv[:]}
+}
+
+func TestPacket(t *testing.T) {
+	keys := newTestKeys(t)
+	other := newTestKeys(t)
+
+	_, p, err := common.NewPacket(clock.System, 41, rand.Reader)
+	checkError(t, err)
+	packet, err := common.SerialiseWire(p, keys.pub, keys.signer)
+	checkError(t, err)
+
+	now := time.Unix(p.Timestamp+5, 0)
+	r := Packet(packet, keys.priv, nil, &keys.signer.PublicKey, now)
+	if r.Failed != "" || !r.Complete() {
+		t.Fatalf("valid packet failed %s: %s", r.Failed, r.Error)
+	}
+	if r.Box != Valid || r.Signature != Valid || r.Header {
+		t.Fatalf("bad report for a valid packet: %+v", r)
+	}
+	if r.Packet.Counter != 42 || r.Packet.Drift != 5 || r.Packet.Chunk != common.ChunkSize {
+		t.Fatalf("bad packet contents: %+v", r.Packet)
+	}
+
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(packet)))
+	r = Packet(append(header[:], packet...), keys.priv, nil, &keys.signer.PublicKey, now)
+	if !r.Header || r.Size != len(packet) || r.Failed != "" {
+		t.Fatalf("length header wasn't stripped: %+v", r)
+	}
+
+	r = Packet(packet, nil, nil, nil, now)
+	if r.Complete() || r.Box != Unchecked || r.Ephemeral == "" {
+		t.Fatalf("packet without keys: %+v", r)
+	}
+
+	r = Packet(packet, keys.priv, nil, nil, now)
+	if r.Complete() || r.Signature != Unchecked || r.Packet == nil {
+		t.Fatalf("packet without signer: %+v", r)
+	}
+
+	unsigned, err := common.SerialiseWire(p, keys.pub, nil)
+	checkError(t, err)
+
+	misencoded, err := crypt.Encrypt([]byte("not a packet"), keys.pub, keys.signer)
+	checkError(t, err)
+
+	// The chunk is shorter than the size the packet declares.
+	short, err := asn1.Marshal(struct {
+		Timestamp int64
+		Counter   int64
+		Size      int
+		Chunk     []byte
+	}{p.Timestamp, 42, 64, make([]byte, 32)})
+	checkError(t, err)
+	short, err = crypt.Encrypt(short, keys.pub, keys.signer)
+	checkError(t, err)
+
+	failures := []struct {
+		packet []byte
+		priv   []byte
+		signer *rsa.PublicKey
+		check  string
+	}{
+		{packet[:40], keys.priv, &keys.signer.PublicKey, CheckBoxSize},
+		{packet, other.priv, &keys.signer.PublicKey, CheckBox},
+		{packet, keys.priv, &other.signer.PublicKey, CheckSignature},
+		{unsigned, keys.priv, &keys.signer.PublicKey, CheckUnsigned},
+		{misencoded, keys.priv, &keys.signer.PublicKey, CheckPacket},
+		{short, keys.priv, &keys.signer.PublicKey, CheckChunk},
+	}
+	for _, f := range failures {
+		r = Packet(f.packet, f.priv, nil, f.signer, now)
+		if r.Failed != f.check {
+			t.Fatalf("expected %s to fail, have %q (%s)", f.check, r.Failed, r.Error)
+		}
+
+		// The report must agree with the sink.
+		if _, err := common.ParsePacket(f.packet, f.priv, f.signer); err == nil {
+			t.Fatalf("%s: packet is accepted by ParsePacket", f.check)
+		}
+	}
+}
+
+func TestHybridPacket(t *testing.T) {
+	keys := newTestKeys(t)
+	kemPub, kemPriv, err := crypt.GenerateKEMKey()
+	checkError(t, err)
+	_, otherKEM, err := crypt.GenerateKEMKey()
+	checkError(t, err)
+
+	_, p, err := common.NewPacket(clock.System, 0, rand.Reader)
+	checkError(t, err)
+	packet, err := common.SerialiseHybridWire(p, keys.pub, kemPub, keys.signer)
+	checkError(t, err)
+	plain, err := common.SerialiseWire(p, keys.pub, keys.signer)
+	checkError(t, err)
+
+	now := time.Unix(p.Timestamp, 0)
+	r := Packet(packet, keys.priv, kemPriv, &keys.signer.PublicKey, now)
+	if r.Failed != "" || r.Sealing != SealingHybrid || r.Signature != Valid {
+		t.Fatalf("valid hybrid packet: %+v", r)
+	}
+	if r.KEMCiphertext != hex.EncodeToString(packet[:crypt.KEMCiphertextSize]) ||
+		r.Ephemeral != hex.EncodeToString(packet[crypt.KEMCiphertextSize:crypt.KEMCiphertextSize+32]) {
+		t.Fatalf("the hybrid box's layers weren't split: %+v", r)
+	}
+
+	// A sink with an ML-KEM key still opens classic packets.
+	r = Packet(plain, keys.priv, kemPriv, &keys.signer.PublicKey, now)
+	if r.Failed != "" || r.Sealing != SealingClassic {
+		t.Fatalf("valid classic packet: %+v", r)
+	}
+
+	for _, k := range [][]byte{nil, otherKEM} {
+		r = Packet(packet, keys.priv, k, &keys.signer.PublicKey, now)
+		if r.Failed != CheckBox || r.Sealing != "" {
+			t.Fatalf("a hybrid packet shouldn't open without its ML-KEM key: %+v", r)
+		}
+	}
+
+	r = Packet(packet, keys.priv, kemPriv[1:], &keys.signer.PublicKey, now)
+	if r.Failed != CheckKEMKey {
+		t.Fatalf("expected %s to fail, have %q", CheckKEMKey, r.Failed)
+	}
+}
+
+func TestPacketOversized(t *testing.T) {
+	keys := newTestKeys(t)
+	r := Packet(make([]byte, common.MaxPacketSize+1), keys.priv, nil, nil, time.Now())
+	if r.Failed != CheckSize {
+		t.Fatalf("oversized packet should fail %s, not %s", CheckSize, r.Failed)
+	}
+}
+
+func FuzzPacket(f *testing.F) {
+	keys := newTestKeys(f)
+	_, p, err := common.NewPacket(clock.System, 0, rand.Reader)
+	checkError(f, err)
+	packet, err := common.SerialiseWire(p, keys.pub, keys.signer)
+	checkError(f, err)
+	f.Add(packet)
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		r := Packet(in, keys.priv, nil, &keys.signer.PublicKey, time.Now())
+		if r.Failed == "" && r.Packet == nil {
+			t.Fatal("a packet passed every check without being decoded")
+		}
+	})
+}
@@ -0,0 +1,53 @@
+// Package logging sets up the structured logger shared by the
+// entropyshare daemons. Log events carry their context (such as a
+// target's address, a packet counter, or a peer's address) as
+// fields, and may be written as text or JSON.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// New returns a logger writing to w in the given format, "text" or
+// "json", that discards events below level, which is one of "debug",
+// "info", "warn", or "error".
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("logging: invalid level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("logging: invalid format %q", format)
+	}
+}
+
+// Setup installs a logger writing to standard error as the default
+// logger. Output from the standard log package is redirected to it.
+func Setup(format, level string) error {
+	logger, err := New(os.Stderr, format, level)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(logger)
+	return nil
+}
+
+// Fatal logs msg at the error level with the given fields, and
+// exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
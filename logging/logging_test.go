@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := New(buf, "json", "warn")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	logger.Info("dropped")
+	logger.Warn("packet rejected", "target", "vps.example.net:4141", "counter", 14)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one event, have %d", len(lines))
+	}
+
+	var event map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if event["target"] != "vps.example.net:4141" || event["counter"] != 14.0 {
+		t.Fatalf("missing fields in event: %v", event)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Fatal("invalid formats should be rejected")
+	}
+
+	if _, err := New(&bytes.Buffer{}, "text", "loud"); err == nil {
+		t.Fatal("invalid levels should be rejected")
+	}
+}
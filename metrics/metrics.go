@@ -0,0 +1,228 @@
+// Package metrics exports counters and gauges in the Prometheus text
+// exposition format. Metrics are registered with the package when
+// they are created, and all registered metrics are served by
+// Handler.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+func register(m metric) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.metrics = append(registry.metrics, m)
+}
+
+type desc struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metricName, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metricName, d.kind)
+}
+
+// key joins label values into a map key.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic("metrics: wrong number of label values for " + d.metricName)
+	}
+	return strings.Join(values, "\x00")
+}
+
+func (d *desc) sample(w io.Writer, key string, v float64) {
+	fmt.Fprint(w, d.metricName)
+	if len(d.labels) > 0 {
+		values := strings.Split(key, "\x00")
+		pairs := make([]string, len(d.labels))
+		for i, l := range d.labels {
+			pairs[i] = l + "=" + strconv.Quote(values[i])
+		}
+		fmt.Fprintf(w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// values holds the current value of each labelled series.
+type values struct {
+	desc
+	lock   sync.Mutex
+	series map[string]float64
+}
+
+func newValues(name, help, kind string, labels []string) *values {
+	return &values{
+		desc: desc{
+			metricName: name,
+			help:       help,
+			kind:       kind,
+			labels:     labels,
+		},
+		series: map[string]float64{},
+	}
+}
+
+func (v *values) write(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.header(w)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v.sample(w, k, v.series[k])
+	}
+}
+
+// A Counter is a value that only increases, such as the number of
+// packets sent.
+type Counter struct {
+	*values
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newValues(name, help, "counter", labels)}
+	if len(labels) == 0 {
+		c.series[""] = 0
+	}
+	register(c)
+	return c
+}
+
+// Add adds delta, which must not be negative, to the series with
+// the given label values.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counters can't decrease")
+	}
+
+	k := c.key(labelValues)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.series[k] += delta
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// A Gauge is a value that may go up and down, such as an observed
+// clock skew.
+type Gauge struct {
+	*values
+}
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newValues(name, help, "gauge", labels)}
+	register(g)
+	return g
+}
+
+// Set sets the series with the given label values to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	k := g.key(labelValues)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.series[k] = v
+}
+
+// gaugeFunc is a gauge whose value is read from a function when the
+// metrics are served.
+type gaugeFunc struct {
+	desc
+	f func() float64
+}
+
+// NewGaugeFunc registers an unlabelled gauge whose value is returned
+// by f.
+func NewGaugeFunc(name, help string, f func() float64) {
+	register(&gaugeFunc{
+		desc: desc{metricName: name, help: help, kind: "gauge"},
+		f:    f,
+	})
+}
+
+// NewCounterFunc registers an unlabelled counter whose value is
+// returned by f.
+func NewCounterFunc(name, help string, f func() float64) {
+	register(&gaugeFunc{
+		desc: desc{metricName: name, help: help, kind: "counter"},
+		f:    f,
+	})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.header(w)
+	g.sample(w, "", g.f())
+}
+
+// WriteTo writes every registered metric to w.
+func WriteTo(w io.Writer) {
+	registry.lock.Lock()
+	metrics := make([]metric, len(registry.metrics))
+	copy(metrics, registry.metrics)
+	registry.lock.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name() < metrics[j].name()
+	})
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteTo(w)
+	})
+}
+
+// Serve starts an HTTP server on addr in the background, serving the
+// metrics at /metrics.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	slog.Info("serving metrics", "address", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			slog.Error("metrics server failed", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	c := NewCounter("test_packets_total", "Packets handled.", "result")
+	c.Inc("ok")
+	c.Inc("ok")
+	c.Add(3, "counter")
+
+	g := NewGauge("test_skew_seconds", "Observed skew.")
+	g.Set(-1.5)
+
+	NewGaugeFunc("test_func", "A function gauge.", func() float64 { return 42 })
+
+	buf := &bytes.Buffer{}
+	WriteTo(buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE test_packets_total counter",
+		`test_packets_total{result="counter"} 3`,
+		`test_packets_total{result="ok"} 2`,
+		"# HELP test_skew_seconds Observed skew.",
+		"test_skew_seconds -1.5",
+		"test_func 42",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("missing %q in output:\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Package noise implements the IK handshake of the Noise Protocol
+// Framework, as Noise_IK_25519_AESGCM_SHA256. The initiator knows the
+// responder's static key in advance; both sides contribute ephemeral
+// keys, so the keys for a session's transport messages can't be
+// recovered from the static keys once the session's ephemeral keys
+// are gone.
+//
+// Only what entropyshare needs is provided: the one pattern, no
+// pre-shared keys, and no rekeying.
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Name is the Noise protocol name, which begins the handshake hash.
+const Name = "Noise_IK_25519_AESGCM_SHA256"
+
+const (
+	dhLen  = 32
+	tagLen = 16
+)
+
+var (
+	ErrDecrypt   = errors.New("noise: decryption failure")
+	ErrMessage   = errors.New("noise: malformed handshake message")
+	ErrState     = errors.New("noise: message out of turn")
+	ErrExhausted = errors.New("noise: nonces exhausted")
+)
+
+// A CipherState encrypts or decrypts one direction of a session's
+// transport messages.
+type CipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newCipherState(k []byte) *CipherState {
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		panic(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &CipherState{aead: aead}
+}
+
+func (c *CipherState) nonce() []byte {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], c.n)
+	return nonce[:]
+}
+
+// Encrypt seals plaintext with the associated data ad, appending the
+// result to out.
+func (c *CipherState) Encrypt(out, ad, plaintext []byte) ([]byte, error) {
+	if c.n == math.MaxUint64 {
+		return nil, ErrExhausted
+	}
+
+	out = c.aead.Seal(out, c.nonce(), plaintext, ad)
+	c.n++
+	return out, nil
+}
+
+// Decrypt opens ciphertext with the associated data ad.
+func (c *CipherState) Decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if c.n == math.MaxUint64 {
+		return nil, ErrExhausted
+	}
+
+	out, err := c.aead.Open(nil, c.nonce(), ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	c.n++
+	return out, nil
+}
+
+// symmetricState holds the chaining key and handshake hash.
+type symmetricState struct {
+	cs *CipherState
+	ck []byte
+	h  []byte
+}
+
+func (ss *symmetricState) init(name string) {
+	if len(name) <= sha256.Size {
+		ss.h = make([]byte, sha256.Size)
+		copy(ss.h, name)
+	} else {
+		digest := sha256.Sum256([]byte(name))
+		ss.h = digest[:]
+	}
+	ss.ck = append([]byte{}, ss.h...)
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h)
+	h.Write(data)
+	ss.h = h.Sum(nil)
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	var k []byte
+	ss.ck, k = hkdf(ss.ck, ikm)
+	ss.cs = newCipherState(k)
+}
+
+func (ss *symmetricState) encryptAndHash(out, plaintext []byte) ([]byte, error) {
+	start := len(out)
+	if ss.cs == nil {
+		out = append(out, plaintext...)
+	} else {
+		var err error
+		if out, err = ss.cs.Encrypt(out, ss.h, plaintext); err != nil {
+			return nil, err
+		}
+	}
+	ss.mixHash(out[start:])
+	return out, nil
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if ss.cs != nil {
+		var err error
+		if plaintext, err = ss.cs.Decrypt(ss.h, ciphertext); err != nil {
+			return nil, err
+		}
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (ss *symmetricState) split() (*CipherState, *CipherState) {
+	k1, k2 := hkdf(ss.ck, nil)
+	return newCipherState(k1), newCipherState(k2)
+}
+
+// hkdf is the two-output HKDF defined by Noise.
+func hkdf(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+
+	mac.Reset()
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	return out1, mac.Sum(nil)
+}
+
+// A HandshakeState runs one side of an IK handshake:
+//
+//	<- s
+//	...
+//	-> e, es, s, ss
+//	<- e, ee, se
+type HandshakeState struct {
+	ss        symmetricState
+	initiator bool
+	s, e      *ecdh.PrivateKey
+	rs, re    *ecdh.PublicKey
+	msg       int
+}
+
+// NewInitiator starts a handshake with the responder whose static
+// key is rs. The prologue must match the responder's.
+func NewInitiator(s *ecdh.PrivateKey, rs *ecdh.PublicKey, prologue []byte) *HandshakeState {
+	hs := &HandshakeState{initiator: true, s: s, rs: rs}
+	hs.ss.init(Name)
+	hs.ss.mixHash(prologue)
+	hs.ss.mixHash(rs.Bytes())
+	return hs
+}
+
+// NewResponder prepares to answer a handshake addressed to the static
+// key s.
+func NewResponder(s *ecdh.PrivateKey, prologue []byte) *HandshakeState {
+	hs := &HandshakeState{s: s}
+	hs.ss.init(Name)
+	hs.ss.mixHash(prologue)
+	hs.ss.mixHash(s.PublicKey().Bytes())
+	return hs
+}
+
+func (hs *HandshakeState) dh(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	hs.ss.mixKey(shared)
+	return nil
+}
+
+// WriteMessage writes the side's next handshake message, carrying
+// payload. The initiator writes the first message, and the responder
+// the second.
+func (hs *HandshakeState) WriteMessage(payload []byte) ([]byte, error) {
+	if hs.msg > 1 || hs.initiator != (hs.msg == 0) {
+		return nil, ErrState
+	}
+
+	var err error
+	hs.e, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, hs.e.PublicKey().Bytes()...)
+	hs.ss.mixHash(hs.e.PublicKey().Bytes())
+
+	if hs.initiator {
+		// e, es, s, ss
+		if err = hs.dh(hs.e, hs.rs); err != nil {
+			return nil, err
+		}
+		if out, err = hs.ss.encryptAndHash(out, hs.s.PublicKey().Bytes()); err != nil {
+			return nil, err
+		}
+		if err = hs.dh(hs.s, hs.rs); err != nil {
+			return nil, err
+		}
+	} else {
+		// e, ee, se
+		if err = hs.dh(hs.e, hs.re); err != nil {
+			return nil, err
+		}
+		if err = hs.dh(hs.e, hs.rs); err != nil {
+			return nil, err
+		}
+	}
+
+	hs.msg++
+	return hs.ss.encryptAndHash(out, payload)
+}
+
+// ReadMessage reads the peer's handshake message, returning its
+// payload.
+func (hs *HandshakeState) ReadMessage(msg []byte) ([]byte, error) {
+	if hs.msg > 1 || hs.initiator != (hs.msg == 1) {
+		return nil, ErrState
+	}
+
+	if len(msg) < dhLen {
+		return nil, ErrMessage
+	}
+
+	var err error
+	hs.re, err = ecdh.X25519().NewPublicKey(msg[:dhLen])
+	if err != nil {
+		return nil, ErrMessage
+	}
+	hs.ss.mixHash(msg[:dhLen])
+	msg = msg[dhLen:]
+
+	if !hs.initiator {
+		// e, es, s, ss
+		if err = hs.dh(hs.s, hs.re); err != nil {
+			return nil, err
+		}
+
+		if len(msg) < dhLen+tagLen {
+			return nil, ErrMessage
+		}
+		rs, err := hs.ss.decryptAndHash(msg[:dhLen+tagLen])
+		if err != nil {
+			return nil, err
+		}
+		if hs.rs, err = ecdh.X25519().NewPublicKey(rs); err != nil {
+			return nil, ErrMessage
+		}
+		msg = msg[dhLen+tagLen:]
+
+		if err = hs.dh(hs.s, hs.rs); err != nil {
+			return nil, err
+		}
+	} else {
+		// e, ee, se
+		if err = hs.dh(hs.e, hs.re); err != nil {
+			return nil, err
+		}
+		if err = hs.dh(hs.s, hs.re); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(msg) < tagLen {
+		return nil, ErrMessage
+	}
+
+	payload, err := hs.ss.decryptAndHash(msg)
+	if err != nil {
+		return nil, err
+	}
+	hs.msg++
+	return payload, nil
+}
+
+// Complete reports whether both handshake messages have been
+// exchanged.
+func (hs *HandshakeState) Complete() bool {
+	return hs.msg == 2
+}
+
+// Split returns the cipher states for the session's transport
+// messages, for sending and for receiving. The handshake must be
+// complete.
+func (hs *HandshakeState) Split() (send, recv *CipherState, err error) {
+	if !hs.Complete() {
+		return nil, nil, ErrState
+	}
+
+	c1, c2 := hs.ss.split()
+	if hs.initiator {
+		return c1, c2, nil
+	}
+	return c2, c1, nil
+}
+
+// ChannelBinding returns the handshake hash, which is unique to the
+// session; once the handshake is complete, signing it binds an
+// identity to the session.
+func (hs *HandshakeState) ChannelBinding() []byte {
+	return append([]byte{}, hs.ss.h...)
+}
+
+// PeerStatic returns the peer's static key, once it is known.
+func (hs *HandshakeState) PeerStatic() *ecdh.PublicKey {
+	return hs.rs
+}
@@ -0,0 +1,175 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+var prologue = []byte("noise test")
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func newKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	checkError(t, err)
+	return key
+}
+
+// handshake runs a handshake between fresh initiator and responder
+// keys, returning both sides.
+func handshake(t *testing.T) (*HandshakeState, *HandshakeState) {
+	s, rs := newKey(t), newKey(t)
+	initiator := NewInitiator(s, rs.PublicKey(), prologue)
+	responder := NewResponder(rs, prologue)
+
+	msg, err := initiator.WriteMessage([]byte("hello"))
+	checkError(t, err)
+	payload, err := responder.ReadMessage(msg)
+	checkError(t, err)
+	if string(payload) != "hello" {
+		t.Fatalf("expected payload %q, have %q", "hello", payload)
+	}
+
+	msg, err = responder.WriteMessage(nil)
+	checkError(t, err)
+	payload, err = initiator.ReadMessage(msg)
+	checkError(t, err)
+	if len(payload) != 0 {
+		t.Fatalf("expected an empty payload, have %x", payload)
+	}
+
+	if !responder.PeerStatic().Equal(s.PublicKey()) {
+		t.Fatal("the responder should have learned the initiator's static key")
+	}
+	return initiator, responder
+}
+
+func TestHandshake(t *testing.T) {
+	initiator, responder := handshake(t)
+	if !initiator.Complete() || !responder.Complete() {
+		t.Fatal("the handshake should be complete")
+	}
+
+	if !bytes.Equal(initiator.ChannelBinding(), responder.ChannelBinding()) {
+		t.Fatal("both sides should have the same channel binding")
+	}
+
+	isend, irecv, err := initiator.Split()
+	checkError(t, err)
+	rsend, rrecv, err := responder.Split()
+	checkError(t, err)
+
+	for i := 0; i < 3; i++ {
+		ct, err := isend.Encrypt(nil, nil, []byte("ping"))
+		checkError(t, err)
+		pt, err := rrecv.Decrypt(nil, ct)
+		checkError(t, err)
+		if string(pt) != "ping" {
+			t.Fatalf("expected %q, have %q", "ping", pt)
+		}
+
+		ct, err = rsend.Encrypt(nil, nil, []byte("pong"))
+		checkError(t, err)
+		pt, err = irecv.Decrypt(nil, ct)
+		checkError(t, err)
+		if string(pt) != "pong" {
+			t.Fatalf("expected %q, have %q", "pong", pt)
+		}
+	}
+
+	// A replayed message is out of sequence.
+	ct, err := isend.Encrypt(nil, nil, []byte("once"))
+	checkError(t, err)
+	_, err = rrecv.Decrypt(nil, ct)
+	checkError(t, err)
+	if _, err = rrecv.Decrypt(nil, ct); err != ErrDecrypt {
+		t.Fatalf("expected %v, have %v", ErrDecrypt, err)
+	}
+}
+
+func TestSessionsDiffer(t *testing.T) {
+	a, _ := handshake(t)
+	b, _ := handshake(t)
+	if bytes.Equal(a.ChannelBinding(), b.ChannelBinding()) {
+		t.Fatal("two sessions shouldn't share a channel binding")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	s, rs, other := newKey(t), newKey(t), newKey(t)
+	initiator := NewInitiator(s, other.PublicKey(), prologue)
+	responder := NewResponder(rs, prologue)
+
+	msg, err := initiator.WriteMessage(nil)
+	checkError(t, err)
+	if _, err = responder.ReadMessage(msg); err != ErrDecrypt {
+		t.Fatalf("expected %v, have %v", ErrDecrypt, err)
+	}
+}
+
+func TestPrologueMismatch(t *testing.T) {
+	s, rs := newKey(t), newKey(t)
+	initiator := NewInitiator(s, rs.PublicKey(), prologue)
+	responder := NewResponder(rs, []byte("another protocol"))
+
+	msg, err := initiator.WriteMessage(nil)
+	checkError(t, err)
+	if _, err = responder.ReadMessage(msg); err != ErrDecrypt {
+		t.Fatalf("expected %v, have %v", ErrDecrypt, err)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	s, rs := newKey(t), newKey(t)
+	initiator := NewInitiator(s, rs.PublicKey(), prologue)
+	responder := NewResponder(rs, prologue)
+
+	msg, err := initiator.WriteMessage(nil)
+	checkError(t, err)
+	_, err = responder.ReadMessage(msg)
+	checkError(t, err)
+
+	msg, err = responder.WriteMessage(nil)
+	checkError(t, err)
+	msg[len(msg)-1] ^= 1
+	if _, err = initiator.ReadMessage(msg); err != ErrDecrypt {
+		t.Fatalf("expected %v, have %v", ErrDecrypt, err)
+	}
+
+	if _, err = responder.ReadMessage(msg[:dhLen-1]); err != ErrState {
+		t.Fatalf("expected %v, have %v", ErrState, err)
+	}
+
+	responder = NewResponder(rs, prologue)
+	if _, err = responder.ReadMessage(msg[:dhLen+tagLen]); err != ErrMessage {
+		t.Fatalf("expected %v, have %v", ErrMessage, err)
+	}
+}
+
+func TestOutOfTurn(t *testing.T) {
+	s, rs := newKey(t), newKey(t)
+	initiator := NewInitiator(s, rs.PublicKey(), prologue)
+	responder := NewResponder(rs, prologue)
+
+	if _, err := responder.WriteMessage(nil); err != ErrState {
+		t.Fatalf("expected %v, have %v", ErrState, err)
+	}
+	if _, err := initiator.ReadMessage(make([]byte, dhLen+tagLen)); err != ErrState {
+		t.Fatalf("expected %v, have %v", ErrState, err)
+	}
+	if _, _, err := initiator.Split(); err != ErrState {
+		t.Fatalf("expected %v, have %v", ErrState, err)
+	}
+
+	_, err := initiator.WriteMessage(nil)
+	checkError(t, err)
+	if _, err = initiator.WriteMessage(nil); err != ErrState {
+		t.Fatalf("expected %v, have %v", ErrState, err)
+	}
+}
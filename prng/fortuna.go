@@ -5,12 +5,20 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gokyle/gofortuna/fortuna"
 	"github.com/gokyle/tpm"
+	"github.com/kisom/entropyshare/admin"
+	"github.com/kisom/entropyshare/clock"
+	"github.com/kisom/entropyshare/health"
+	"github.com/kisom/entropyshare/logging"
+	"github.com/kisom/entropyshare/metrics"
+	"github.com/kisom/entropyshare/seal"
 )
 
 var config struct {
@@ -19,12 +27,66 @@ var config struct {
 	tpmSource      *fortuna.SourceWriter
 	devRandSource  *fortuna.SourceWriter
 	connTimeSource *fortuna.SourceWriter
+	relaySource    *fortuna.SourceWriter
+	devRandHealth  *health.Tester
+	tpmHealth      *health.Tester
 	shutdownChan   chan interface{}
+	shutdownOnce   sync.Once
 	seedFile       string
 	entropyChan    chan int64
+	sinceStir      int64
+	reseeds        int64
+	bytesRead      int64
+	seedKey        seal.KeyProvider
+	generationFile string
+	generation     int64
+	seedLock       sync.Mutex
+	tpmLock        sync.Mutex // guards tpmCtx, and serialises refills
+	clock          clock.Clock
 }
 
-var PRNG = config.prng
+// PRNG reads from the source's Fortuna instance; it is set up by
+// Start. Reads are tallied so that the PRNG may be stirred as
+// required.
+var PRNG io.Reader
+
+type reader struct{}
+
+func (reader) Read(p []byte) (int, error) {
+	n, err := config.prng.Read(p)
+	if n > 0 {
+		tally(int64(n))
+	}
+	return n, err
+}
+
+// tally adds n bytes to the count read since the PRNG was last
+// stirred. Once the PRNG is shut down, reads are no longer counted.
+func tally(n int64) {
+	select {
+	case config.entropyChan <- n:
+	case <-config.shutdownChan:
+	}
+}
+
+var (
+	reseeds = metrics.NewCounter("entropyshare_prng_reseeds_total",
+		"Number of times the PRNG has been refilled from its inputs.")
+	bytesRead = metrics.NewCounter("entropyshare_prng_bytes_read_total",
+		"Bytes read from the PRNG.")
+)
+
+func init() {
+	metrics.NewGaugeFunc("entropyshare_prng_bytes_since_stir",
+		"Bytes read from the PRNG since it was last stirred.",
+		func() float64 {
+			return float64(atomic.LoadInt64(&config.sinceStir))
+		})
+}
+
+// Relay mixes entropy received from an upstream source into the
+// PRNG; it is set up by Start.
+var Relay io.Writer
 
 // The Fortuna PRNG requires identifiers for each source. These are
 // represented as single bytes.
@@ -32,6 +94,8 @@ const (
 	SourceTPM byte = iota + 1
 	SourceDevRand
 	SourceConnTime
+	SourceRelay
+	SourceSeed
 )
 
 // readLimit is the number of bytes in a chunk copied over.
@@ -67,48 +131,85 @@ func copyFromPRNG(dst io.Writer) (written int64, err error) {
 			err = er
 			break
 		}
-		config.entropyChan <- int64(nr)
+		tally(int64(nr))
 	}
 	return written, err
 }
 
+// SetClock has the PRNG's refills and seed file updates scheduled by
+// c rather than the system clock. It must be called before the PRNG
+// is started.
+func SetClock(c clock.Clock) {
+	config.clock = c
+}
+
 // Initialise the PRNG, TPM, and add initial entropy from host and TPM.
 func Start(seedFile string) {
+	start(seedFile, true)
+}
+
+// StartWithoutTPM initialises the PRNG for hosts without a TPM, such
+// as relays; the initial entropy is taken from the host alone.
+func StartWithoutTPM(seedFile string) {
+	start(seedFile, false)
+}
+
+func start(seedFile string, useTPM bool) {
 	if seedFile == "" {
-		log.Fatal("no seed file specified")
+		logging.Fatal("no seed file specified")
 	}
 	config.seedFile = seedFile
 	config.shutdownChan = make(chan interface{}, 0)
 	config.entropyChan = make(chan int64, 4)
-	log.Println("initialising PRNG and TPM")
+	slog.Info("initialising PRNG", "tpm", useTPM,
+		"sealed", config.seedKey != nil)
+	if config.seedKey != nil {
+		generation, err := readGeneration()
+		if err != nil {
+			logging.Fatal("failed to read seed generation",
+				"file", config.generationFile, "error", err)
+		}
+		config.generation = generation
+	}
+
 	if _, err := os.Stat(config.seedFile); err == nil {
-		log.Printf("seed file found; loading PRNG state from %s",
-			config.seedFile)
-		config.prng, err = fortuna.FromSeed(config.seedFile)
+		slog.Info("seed file found; loading PRNG state",
+			"seed_file", config.seedFile)
+		config.prng, err = loadSeed()
 		if err != nil {
-			log.Fatalf("%v", err)
+			logging.Fatal("failed to load seed file",
+				"seed_file", config.seedFile, "error", err)
 		}
 	} else {
-		log.Println("no seed file found, initialising new PRNG")
+		slog.Info("no seed file found, initialising new PRNG",
+			"seed_file", config.seedFile)
 		config.prng = fortuna.New()
 	}
+	PRNG = reader{}
 	config.tpmSource = fortuna.NewSourceWriter(config.prng, SourceTPM)
 	config.devRandSource = fortuna.NewSourceWriter(config.prng, SourceDevRand)
 	config.connTimeSource = fortuna.NewSourceWriter(config.prng, SourceConnTime)
+	config.relaySource = fortuna.NewSourceWriter(config.prng, SourceRelay)
+	Relay = config.relaySource
+	config.devRandHealth = health.New(0)
+	config.tpmHealth = health.New(0)
 	var err error
 
-	config.tpmCtx, err = tpm.NewTPMContext()
-	if err != nil {
-		log.Fatalf("%v", err)
+	if useTPM {
+		config.tpmCtx, err = tpm.NewTPMContext()
+		if err != nil {
+			logging.Fatal("failed to open TPM", "error", err)
+		}
 	}
 	err = refillPRNG()
 	if err != nil {
-		log.Fatalf("%v", err)
+		logging.Fatal("failed to fill PRNG", "error", err)
 	}
 
-	err = config.prng.WriteSeed(config.seedFile)
+	err = writeSeed()
 	if err != nil {
-		log.Fatalf("%v", err)
+		logging.Fatal("failed to write seed file",
+			"seed_file", config.seedFile, "error", err)
 	}
 
 	go logAutoUpdate()
@@ -116,60 +217,78 @@ func Start(seedFile string) {
 }
 
 // refillPRNG reloads the PRNG with entropy. It reads 1024 bytes from
-// crypto/rand.Reader and 1024 bytes from the TPM. Finally, the nanosecond
-// component of the current timestamp is written to the PRNG.
+// crypto/rand.Reader and 1024 bytes from the TPM, if one is in use.
+// Finally, the nanosecond component of the current timestamp is
+// written to the PRNG.
 func refillPRNG() (err error) {
-	log.Println("refilling pool (1/2)")
+	config.tpmLock.Lock()
+	defer config.tpmLock.Unlock()
+
+	reseeds.Inc()
+	atomic.AddInt64(&config.reseeds, 1)
+	slog.Debug("refilling pool", "pass", 1)
 	// First fill of pool: each pool receives 16 bytes of entropy
 	// from crypto/rand.Reader, and 16 bytes of entropy from the TPM.
-	var event1 = make([]byte, 16)
 	for i := 0; i < fortuna.PoolSize; i++ {
-		_, err = io.ReadFull(rand.Reader, event1)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
-		_, err = config.devRandSource.Write(event1)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
-		var event2 []byte
-		event2, err = config.tpmCtx.Random(16)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
-		_, err = config.tpmSource.Write(event2)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
+		writeDevRand()
+		writeTPM()
 	}
-	log.Println("refilling pool (2/2)")
+	slog.Debug("refilling pool", "pass", 2)
 	// Second fill: swap order of writes (TPM, then rand).
 	for i := 0; i < fortuna.PoolSize; i++ {
-		var event2 []byte
-		event2, err = config.tpmCtx.Random(16)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
-		_, err = config.tpmSource.Write(event2)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
-		_, err = io.ReadFull(rand.Reader, event1)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
-		_, err = config.devRandSource.Write(event1)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
+		writeTPM()
+		writeDevRand()
 	}
 	writeTimestamp()
 	return nil
 }
 
+// writeDevRand adds a 16-byte event from crypto/rand.Reader to the
+// PRNG. Events that fail the health tests are logged and dropped.
+func writeDevRand() {
+	var event = make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, event)
+	if err != nil {
+		logging.Fatal("failed to read from crypto/rand", "error", err)
+	}
+	if err = config.devRandHealth.Check(event); err != nil {
+		slog.Warn("PRNG input failed health tests",
+			"input", "crypto/rand", "error", err)
+		return
+	}
+	_, err = config.devRandSource.Write(event)
+	if err != nil {
+		logging.Fatal("failed to write to PRNG", "error", err)
+	}
+}
+
+// writeTPM adds a 16-byte event from the TPM to the PRNG. It does
+// nothing if the PRNG was started without a TPM. Events that fail
+// the health tests are logged and dropped. The TPM lock must be held.
+func writeTPM() {
+	if config.tpmCtx == nil {
+		return
+	}
+
+	event, err := config.tpmCtx.Random(16)
+	if err != nil {
+		logging.Fatal("failed to read from TPM", "error", err)
+	}
+	if err = config.tpmHealth.Check(event); err != nil {
+		slog.Warn("PRNG input failed health tests",
+			"input", "tpm", "error", err)
+		return
+	}
+	_, err = config.tpmSource.Write(event)
+	if err != nil {
+		logging.Fatal("failed to write to PRNG", "error", err)
+	}
+}
+
 // writeTimestamp takes the nanosecond component of the current
 // timestamp, packs it as a 32-bit unsigned integer, and adds the
-// SHA-256 digest of that to the PRNG state.
+// SHA-256 digest of that to the PRNG state. The jitter is what's
+// being collected, so it is always read from the system clock.
 func writeTimestamp() {
 	ns := uint32(time.Now().Nanosecond())
 	var ts = make([]byte, 8)
@@ -178,45 +297,68 @@ func writeTimestamp() {
 	config.connTimeSource.Write(sum[:])
 }
 
-// Shutdown closes down the TPM interface and writes out a seed file.
-func shutdown() {
-	log.Println("shutting down")
-	close(config.shutdownChan)
-	close(config.entropyChan)
-	err := config.tpmCtx.Destroy()
-	if err != nil {
-		log.Fatalf("TPM failed to shutdown: %v", err)
-	}
-	err = config.prng.WriteSeed(config.seedFile)
-	if err != nil {
-		log.Printf("failed to write seed file: %v", err)
+// Shutdown stops the PRNG's background updates, closes down the TPM
+// interface, and writes out a seed file. The PRNG may still be read
+// afterwards, but it will no longer be stirred or refilled. Calls
+// after the first do nothing.
+func Shutdown() (err error) {
+	if config.seedFile == "" {
+		logging.Fatal("PRNG has not been started")
 	}
+
+	config.shutdownOnce.Do(func() {
+		slog.Info("shutting down PRNG")
+		close(config.shutdownChan)
+
+		// Waiting for the lock lets a refill in progress finish
+		// with the TPM before it's closed.
+		config.tpmLock.Lock()
+		if config.tpmCtx != nil {
+			err = config.tpmCtx.Destroy()
+			if err != nil {
+				slog.Error("TPM failed to shutdown", "error", err)
+			}
+			config.tpmCtx = nil
+		}
+		config.tpmLock.Unlock()
+
+		werr := writeSeed()
+		if werr != nil {
+			slog.Error("failed to write seed file",
+				"seed_file", config.seedFile, "error", werr)
+			err = werr
+		}
+	})
+	return err
 }
 
 // logAutoUpdate runs the PRNG autoupdate functions. These write
 // out the seed file every ten minutes and refill the PRNG after
 // six hours.
 func logAutoUpdate() {
-	var fsErr = make(chan error, 4)
-	config.prng.AutoUpdate(config.seedFile, config.shutdownChan, fsErr)
-	go func() {
-		for {
-			err := <-fsErr
-			log.Println("autoupdate error: %v", err)
-		}
-	}()
+	if config.seedKey != nil {
+		go autoSeal()
+	} else {
+		var fsErr = make(chan error, 4)
+		config.prng.AutoUpdate(config.seedFile, config.shutdownChan, fsErr)
+		go func() {
+			for err := range fsErr {
+				slog.Error("autoupdate error", "error", err)
+			}
+		}()
+	}
 	go func() {
 		for {
 			select {
-			case <-time.After(6 * time.Hour):
+			case <-clock.Or(config.clock).After(6 * time.Hour):
 				refillPRNG()
 			case _, ok := <-config.shutdownChan:
 				if !ok {
-					break
+					slog.Info("autofill shutting down")
+					return
 				}
 			}
 		}
-		log.Println("autofill shutting down")
 	}()
 }
 
@@ -228,29 +370,94 @@ func entropyCheck() {
 	var printCheck int64
 	const regen int64 = 4294967295 // 2^32-1 bytes
 	for {
-		n, ok := <-config.entropyChan
-		if !ok {
-			break
+		var n int64
+		select {
+		case n = <-config.entropyChan:
+		case <-config.shutdownChan:
+			return
 		}
 		entropy += n
 		printCheck += n
+		bytesRead.Add(float64(n))
+		atomic.AddInt64(&config.bytesRead, n)
+		atomic.StoreInt64(&config.sinceStir, entropy)
 		// 2 ** 32 bits
 		if printCheck >= 536870912 {
-			log.Printf("%d total bytes read from PRNG",
-				entropy)
+			slog.Info("PRNG output", "bytes_since_stir", entropy)
 			printCheck = 0
 		}
 		if entropy >= regen {
-			log.Println("stirring PRNG")
+			slog.Info("stirring PRNG")
 			refillPRNG()
 			entropy = 0
+			atomic.StoreInt64(&config.sinceStir, 0)
 		}
 	}
 }
 
-func StoreSeed() {
+// HealthStats returns the results of the health tests run on the
+// crypto/rand and TPM inputs to the PRNG, respectively.
+func HealthStats() (health.Stats, health.Stats) {
+	return config.devRandHealth.Stats(), config.tpmHealth.Stats()
+}
+
+// StoreSeed writes the PRNG's state to its seed file.
+func StoreSeed() error {
+	if config.seedFile == "" {
+		logging.Fatal("PRNG has not been started")
+	}
+	return writeSeed()
+}
+
+// Refill reloads the PRNG with fresh entropy from its inputs, as is
+// done every six hours.
+func Refill() error {
 	if config.seedFile == "" {
-		log.Fatal("PRNG has not been started")
+		logging.Fatal("PRNG has not been started")
 	}
-	config.prng.WriteSeed(config.seedFile)
+	return refillPRNG()
+}
+
+// Stats describes the state of the PRNG.
+type Stats struct {
+	SeedFile       string
+	TPM            bool
+	Reseeds        int64
+	BytesRead      int64
+	BytesSinceStir int64
+	DevRandHealth  health.Stats
+	TPMHealth      health.Stats
+}
+
+// GetStats returns the current state of the PRNG.
+func GetStats() Stats {
+	devRandStats, tpmStats := HealthStats()
+	config.tpmLock.Lock()
+	useTPM := config.tpmCtx != nil
+	config.tpmLock.Unlock()
+
+	return Stats{
+		SeedFile:       config.seedFile,
+		TPM:            useTPM,
+		Reseeds:        atomic.LoadInt64(&config.reseeds),
+		BytesRead:      atomic.LoadInt64(&config.bytesRead),
+		BytesSinceStir: atomic.LoadInt64(&config.sinceStir),
+		DevRandHealth:  devRandStats,
+		TPMHealth:      tpmStats,
+	}
+}
+
+// RegisterAdmin adds the PRNG's commands to a control socket:
+// "prng" shows its stats, "refill" refills it, and "write-seed"
+// writes its seed file.
+func RegisterAdmin(a *admin.Server) {
+	a.Handle("prng", "show PRNG stats", func([]string) (interface{}, error) {
+		return GetStats(), nil
+	})
+	a.Handle("refill", "refill the PRNG from its inputs", func([]string) (interface{}, error) {
+		return nil, Refill()
+	})
+	a.Handle("write-seed", "write the PRNG seed file", func([]string) (interface{}, error) {
+		return nil, StoreSeed()
+	})
 }
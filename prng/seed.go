@@ -0,0 +1,153 @@
+package prng
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gokyle/gofortuna/fortuna"
+	"github.com/kisom/entropyshare/clock"
+	"github.com/kisom/entropyshare/seal"
+)
+
+// seedSize is the number of bytes of PRNG output stored in a sealed
+// seed file.
+const seedSize = 64
+
+// seedEventSize is the size of the events the seed is mixed into the
+// PRNG with.
+const seedEventSize = 32
+
+// ErrStaleSeed is returned when a sealed seed file is older than the
+// last one written, as happens when it is restored from a backup.
+// Reusing it would repeat the PRNG's earlier output.
+var ErrStaleSeed = errors.New("prng: seed file is older than the last one written; remove it to start a fresh PRNG")
+
+// SealSeed has the seed file sealed with a key from kp. Each seed
+// written is given a new generation, which is recorded in
+// generationFile; a seed file older than the recorded generation is
+// refused. The generation file should be kept somewhere that won't
+// be restored from a backup along with the seed file. SealSeed must
+// be called before the PRNG is started.
+func SealSeed(kp seal.KeyProvider, generationFile string) {
+	config.seedKey = kp
+	config.generationFile = generationFile
+}
+
+// loadSeed starts a PRNG from the seed file.
+func loadSeed() (*fortuna.Fortuna, error) {
+	if config.seedKey == nil {
+		return fortuna.FromSeed(config.seedFile)
+	}
+
+	in, err := ioutil.ReadFile(config.seedFile)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, h, err := seal.Open(config.seedKey, in)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Generation < config.generation {
+		return nil, ErrStaleSeed
+	}
+	config.generation = h.Generation
+
+	prng := fortuna.New()
+	src := fortuna.NewSourceWriter(prng, SourceSeed)
+	for len(seed) > 0 {
+		n := seedEventSize
+		if n > len(seed) {
+			n = len(seed)
+		}
+
+		_, err = src.Write(seed[:n])
+		if err != nil {
+			return nil, err
+		}
+		seed = seed[n:]
+	}
+	return prng, nil
+}
+
+// writeSeed writes the PRNG's state to the seed file, sealing it if
+// a key has been set.
+func writeSeed() error {
+	if config.seedKey == nil {
+		return config.prng.WriteSeed(config.seedFile)
+	}
+
+	config.seedLock.Lock()
+	defer config.seedLock.Unlock()
+
+	seed := make([]byte, seedSize)
+	_, err := io.ReadFull(config.prng, seed)
+	if err != nil {
+		return err
+	}
+
+	generation := config.generation + 1
+	out, err := seal.Seal(config.seedKey, generation, seed)
+	if err != nil {
+		return err
+	}
+
+	err = replaceFile(config.seedFile, out)
+	if err != nil {
+		return err
+	}
+
+	err = replaceFile(config.generationFile, []byte(strconv.FormatInt(generation, 10)+"\n"))
+	if err != nil {
+		return err
+	}
+	config.generation = generation
+	return nil
+}
+
+// readGeneration returns the generation of the last sealed seed
+// written, or 0 if none has been.
+func readGeneration() (int64, error) {
+	in, err := ioutil.ReadFile(config.generationFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(in)), 10, 64)
+}
+
+// replaceFile atomically replaces the file at path, so that a crash
+// never leaves a partly written seed.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// autoSeal rewrites a sealed seed file every ten minutes, in place
+// of the PRNG's own plaintext updates.
+func autoSeal() {
+	for {
+		select {
+		case <-clock.Or(config.clock).After(10 * time.Minute):
+			err := writeSeed()
+			if err != nil {
+				slog.Error("failed to write seed file",
+					"seed_file", config.seedFile, "error", err)
+			}
+		case <-config.shutdownChan:
+			return
+		}
+	}
+}
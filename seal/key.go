@@ -0,0 +1,152 @@
+package seal
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"code.google.com/p/go.crypto/ssh/terminal"
+)
+
+// KeyBlockType is the PEM block type of a sealed private key.
+const KeyBlockType = "SEALED PRIVATE KEY"
+
+var (
+	// ErrNotSealedKey is returned by OpenKey when it isn't given
+	// a sealed private key.
+	ErrNotSealedKey = errors.New("seal: not a sealed private key")
+
+	// ErrPassphraseSpec is returned for a passphrase
+	// specification that ReadPassphrase doesn't recognise.
+	ErrPassphraseSpec = errors.New("seal: invalid passphrase specification")
+
+	// ErrEmptyPassphrase is returned when the passphrase read is
+	// empty.
+	ErrEmptyPassphrase = errors.New("seal: empty passphrase")
+
+	// ErrPassphraseMismatch is returned when a passphrase
+	// entered for confirmation doesn't match.
+	ErrPassphraseMismatch = errors.New("seal: passphrases don't match")
+)
+
+type sealedKey struct {
+	Type string
+	Key  []byte
+}
+
+// SealKey seals a private key with a key from the provider,
+// returning it as a PEM block. The key's type, such as "RSA PRIVATE
+// KEY", is sealed along with it.
+func SealKey(kp KeyProvider, keyType string, key []byte) ([]byte, error) {
+	plain, err := asn1.Marshal(sealedKey{Type: keyType, Key: key})
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := Seal(kp, 0, plain)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: KeyBlockType, Bytes: out}), nil
+}
+
+// IsSealedKey reports whether in holds a sealed private key.
+func IsSealedKey(in []byte) bool {
+	p, _ := pem.Decode(in)
+	return p != nil && p.Type == KeyBlockType
+}
+
+// OpenKey opens a sealed private key, returning its type and the
+// key.
+func OpenKey(kp KeyProvider, in []byte) (string, []byte, error) {
+	p, _ := pem.Decode(in)
+	if p == nil || p.Type != KeyBlockType {
+		return "", nil, ErrNotSealedKey
+	}
+
+	plain, _, err := Open(kp, p.Bytes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var key sealedKey
+	rest, err := asn1.Unmarshal(plain, &key)
+	if err != nil || len(rest) != 0 {
+		return "", nil, ErrFormat
+	}
+	return key.Type, key.Key, nil
+}
+
+// ReadPassphrase returns the passphrase described by spec, which is
+// one of
+//
+//	file:PATH  the contents of a file, without a trailing newline
+//	env:VAR    the value of an environment variable
+//	prompt     read from the terminal; this is the default
+//
+// If confirm is set, a passphrase read from the terminal must be
+// entered twice.
+func ReadPassphrase(spec string, confirm bool) (Passphrase, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+
+	var p []byte
+	switch kind {
+	case "file":
+		in, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return nil, err
+		}
+		p = bytes.TrimRight(in, "\r\n")
+	case "env":
+		p = []byte(os.Getenv(arg))
+	case "prompt", "":
+		var err error
+		p, err = promptPassphrase(confirm)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrPassphraseSpec
+	}
+
+	if len(p) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+	return Passphrase(p), nil
+}
+
+// promptPassphrase reads a passphrase from the terminal without
+// echoing it.
+func promptPassphrase(confirm bool) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	read := func(prompt string) ([]byte, error) {
+		fmt.Fprint(tty, prompt)
+		defer fmt.Fprintln(tty)
+		return terminal.ReadPassword(int(tty.Fd()))
+	}
+
+	p, err := read("Passphrase: ")
+	if err != nil || !confirm {
+		return p, err
+	}
+
+	again, err := read("Confirm passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(p, again) {
+		return nil, ErrPassphraseMismatch
+	}
+	return p, nil
+}
@@ -0,0 +1,151 @@
+package seal
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"code.google.com/p/go.crypto/scrypt"
+)
+
+// KeySize is the size of the keys used to seal files.
+const KeySize = 32
+
+// The scrypt parameters used to derive keys from passphrases.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// hkdfInfo binds keys derived from key files and credentials to
+// their use for sealing.
+const hkdfInfo = "entropyshare seal"
+
+var (
+	// ErrKeySpec is returned for a key specification that
+	// ParseKeyProvider doesn't recognise.
+	ErrKeySpec = errors.New("seal: invalid key specification")
+
+	// ErrKeySize is returned when a key file or credential is
+	// too short to be used as a key.
+	ErrKeySize = errors.New("seal: key material is too short")
+)
+
+// A KeyProvider supplies the key a file is sealed with.
+type KeyProvider interface {
+	// Name identifies the kind of key; it is recorded in the
+	// sealed file.
+	Name() string
+
+	// Key returns the key for the salt stored in the sealed
+	// file.
+	Key(salt []byte) ([]byte, error)
+}
+
+// ParseKeyProvider returns the key provider described by spec, which
+// is one of
+//
+//	file:PATH        a file holding at least 32 random bytes
+//	passphrase:PATH  a file holding a passphrase
+//	tpm2:PATH        a credential sealed to the TPM by systemd-creds
+func ParseKeyProvider(spec string) (KeyProvider, error) {
+	kind, path, ok := strings.Cut(spec, ":")
+	if !ok || path == "" {
+		return nil, ErrKeySpec
+	}
+
+	switch kind {
+	case "file":
+		return KeyFile(path), nil
+	case "passphrase":
+		return PassphraseFile(path), nil
+	case "tpm2":
+		return TPM2Credential(path), nil
+	default:
+		return nil, ErrKeySpec
+	}
+}
+
+// deriveKey turns high-entropy key material into a sealing key.
+func deriveKey(material, salt []byte) ([]byte, error) {
+	if len(material) < KeySize {
+		return nil, ErrKeySize
+	}
+	return hkdf.Key(sha256.New, material, salt, hkdfInfo, KeySize)
+}
+
+// A KeyFile is the path to a file of random key material.
+type KeyFile string
+
+// Name returns "file".
+func (kf KeyFile) Name() string {
+	return "file"
+}
+
+// Key derives a key from the contents of the file.
+func (kf KeyFile) Key(salt []byte) ([]byte, error) {
+	material, err := ioutil.ReadFile(string(kf))
+	if err != nil {
+		return nil, err
+	}
+	return deriveKey(material, salt)
+}
+
+// A Passphrase derives keys from a passphrase with scrypt.
+type Passphrase []byte
+
+// Name returns "passphrase".
+func (p Passphrase) Name() string {
+	return "passphrase"
+}
+
+// Key derives a key from the passphrase.
+func (p Passphrase) Key(salt []byte) ([]byte, error) {
+	return scrypt.Key(p, salt, scryptN, scryptR, scryptP, KeySize)
+}
+
+// A PassphraseFile is the path to a file holding a passphrase, such
+// as a systemd credential. A trailing newline is ignored.
+type PassphraseFile string
+
+// Name returns "passphrase"; a file sealed with a PassphraseFile may
+// be opened with the same Passphrase.
+func (pf PassphraseFile) Name() string {
+	return "passphrase"
+}
+
+// Key derives a key from the passphrase in the file.
+func (pf PassphraseFile) Key(salt []byte) ([]byte, error) {
+	in, err := ioutil.ReadFile(string(pf))
+	if err != nil {
+		return nil, err
+	}
+	return Passphrase(bytes.TrimRight(in, "\r\n")).Key(salt)
+}
+
+// A TPM2Credential is the path to key material that has been sealed
+// to the host's TPM with systemd-creds, for example with
+//
+//	head -c 32 /dev/urandom | systemd-creds encrypt --with-key=tpm2 - seed.cred
+//
+// The material can only be recovered on the same host.
+type TPM2Credential string
+
+// Name returns "tpm2".
+func (c TPM2Credential) Name() string {
+	return "tpm2"
+}
+
+// Key unseals the credential and derives a key from it.
+func (c TPM2Credential) Key(salt []byte) ([]byte, error) {
+	material, err := exec.Command("systemd-creds", "decrypt", string(c), "-").Output()
+	if err != nil {
+		return nil, err
+	}
+	return deriveKey(material, salt)
+}
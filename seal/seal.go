@@ -0,0 +1,143 @@
+// Package seal encrypts small files, such as PRNG seeds and private
+// keys, at rest. A sealed file carries a header recording the kind of
+// key it was sealed with and a generation number; the header is
+// authenticated along with the contents, so that tampering with
+// either is detected when the file is opened.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	version  = 1
+	saltSize = 16
+)
+
+var (
+	// ErrFormat is returned when a sealed file can't be parsed.
+	ErrFormat = errors.New("seal: invalid sealed file")
+
+	// ErrOpen is returned when a sealed file fails
+	// authentication: it has been tampered with, or the key is
+	// wrong.
+	ErrOpen = errors.New("seal: sealed file failed authentication")
+
+	// ErrProvider is returned when a file was sealed with a
+	// different kind of key than the one it is being opened
+	// with.
+	ErrProvider = errors.New("seal: file was sealed with a different kind of key")
+)
+
+// A Header describes a sealed file. It is stored in the clear, but
+// is authenticated.
+type Header struct {
+	Version    int
+	Provider   string
+	Salt       []byte
+	Generation int64
+	Timestamp  int64
+}
+
+type sealed struct {
+	Header     []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts message with a key from the provider, recording the
+// generation in the header.
+func Seal(kp KeyProvider, generation int64, message []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr, err := asn1.Marshal(Header{
+		Version:    version,
+		Provider:   kp.Name(),
+		Salt:       salt,
+		Generation: generation,
+		Timestamp:  time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := kp.Key(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(sealed{
+		Header:     hdr,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, message, hdr),
+	})
+}
+
+// Open decrypts a sealed file with a key from the provider,
+// returning its contents and its authenticated header.
+func Open(kp KeyProvider, in []byte) ([]byte, *Header, error) {
+	var s sealed
+	rest, err := asn1.Unmarshal(in, &s)
+	if err != nil || len(rest) != 0 {
+		return nil, nil, ErrFormat
+	}
+
+	var h Header
+	rest, err = asn1.Unmarshal(s.Header, &h)
+	if err != nil || len(rest) != 0 || h.Version != version {
+		return nil, nil, ErrFormat
+	}
+
+	if h.Provider != kp.Name() {
+		return nil, nil, ErrProvider
+	}
+
+	key, err := kp.Key(h.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, nil, ErrFormat
+	}
+
+	out, err := aead.Open(nil, s.Nonce, s.Ciphertext, s.Header)
+	if err != nil {
+		return nil, nil, ErrOpen
+	}
+	return out, &h, nil
+}
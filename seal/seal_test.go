@@ -0,0 +1,169 @@
+package seal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/asn1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	dir, err := os.MkdirTemp("", "seal")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	material := make([]byte, KeySize)
+	rand.Read(material)
+	keyFile := filepath.Join(dir, "seed.key")
+	checkError(t, ioutil.WriteFile(keyFile, material, 0600))
+
+	passFile := filepath.Join(dir, "passphrase")
+	checkError(t, ioutil.WriteFile(passFile, []byte("correct horse\n"), 0600))
+
+	message := []byte("Fortuna seed")
+	for _, spec := range []string{"file:" + keyFile, "passphrase:" + passFile} {
+		kp, err := ParseKeyProvider(spec)
+		checkError(t, err)
+
+		out, err := Seal(kp, 42, message)
+		checkError(t, err)
+
+		if bytes.Contains(out, message) {
+			t.Fatalf("%s: sealed file contains the plaintext", spec)
+		}
+
+		opened, h, err := Open(kp, out)
+		checkError(t, err)
+		if !bytes.Equal(opened, message) {
+			t.Fatalf("%s: opened file doesn't match", spec)
+		}
+		if h.Generation != 42 || h.Provider != kp.Name() {
+			t.Fatalf("%s: bad header %+v", spec, h)
+		}
+	}
+
+	// A passphrase file and a passphrase are interchangeable.
+	out, err := Seal(PassphraseFile(passFile), 1, message)
+	checkError(t, err)
+	_, _, err = Open(Passphrase("correct horse"), out)
+	checkError(t, err)
+
+	_, _, err = Open(Passphrase("wrong horse"), out)
+	if err != ErrOpen {
+		t.Fatalf("wrong passphrase: expected %v, have %v", ErrOpen, err)
+	}
+
+	_, _, err = Open(KeyFile(keyFile), out)
+	if err != ErrProvider {
+		t.Fatalf("wrong provider: expected %v, have %v", ErrProvider, err)
+	}
+
+	if _, err = ParseKeyProvider("vault:secret"); err != ErrKeySpec {
+		t.Fatalf("expected %v, have %v", ErrKeySpec, err)
+	}
+
+	short := filepath.Join(dir, "short.key")
+	checkError(t, ioutil.WriteFile(short, material[:16], 0600))
+	if _, err = Seal(KeyFile(short), 1, message); err != ErrKeySize {
+		t.Fatalf("expected %v, have %v", ErrKeySize, err)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	kp := Passphrase("correct horse")
+	out, err := Seal(kp, 7, []byte("Fortuna seed"))
+	checkError(t, err)
+
+	var s sealed
+	_, err = asn1.Unmarshal(out, &s)
+	checkError(t, err)
+
+	var h Header
+	_, err = asn1.Unmarshal(s.Header, &h)
+	checkError(t, err)
+
+	// Rolling the generation forward must be detected.
+	h.Generation = 8
+	s.Header, err = asn1.Marshal(h)
+	checkError(t, err)
+	tampered, err := asn1.Marshal(s)
+	checkError(t, err)
+
+	if _, _, err = Open(kp, tampered); err != ErrOpen {
+		t.Fatalf("tampered header: expected %v, have %v", ErrOpen, err)
+	}
+
+	out[len(out)-1] ^= 1
+	if _, _, err = Open(kp, out); err != ErrOpen {
+		t.Fatalf("tampered contents: expected %v, have %v", ErrOpen, err)
+	}
+
+	if _, _, err = Open(kp, out[:10]); err != ErrFormat {
+		t.Fatalf("truncated file: expected %v, have %v", ErrFormat, err)
+	}
+}
+
+func TestSealKey(t *testing.T) {
+	kp := Passphrase("correct horse")
+	key := []byte("a Curve25519 private key, say..")
+	out, err := SealKey(kp, "CURVE25519 PRIVATE KEY", key)
+	checkError(t, err)
+
+	if !IsSealedKey(out) {
+		t.Fatal("sealed key wasn't recognised")
+	}
+	if IsSealedKey(key) {
+		t.Fatal("raw key was taken to be sealed")
+	}
+
+	keyType, opened, err := OpenKey(kp, out)
+	checkError(t, err)
+	if keyType != "CURVE25519 PRIVATE KEY" || !bytes.Equal(opened, key) {
+		t.Fatalf("opened key doesn't match: %s", keyType)
+	}
+
+	if _, _, err = OpenKey(Passphrase("wrong horse"), out); err != ErrOpen {
+		t.Fatalf("wrong passphrase: expected %v, have %v", ErrOpen, err)
+	}
+	if _, _, err = OpenKey(kp, key); err != ErrNotSealedKey {
+		t.Fatalf("raw key: expected %v, have %v", ErrNotSealedKey, err)
+	}
+}
+
+func TestReadPassphrase(t *testing.T) {
+	dir, err := os.MkdirTemp("", "seal")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	passFile := filepath.Join(dir, "passphrase")
+	checkError(t, ioutil.WriteFile(passFile, []byte("correct horse\n"), 0600))
+
+	p, err := ReadPassphrase("file:"+passFile, false)
+	checkError(t, err)
+	if string(p) != "correct horse" {
+		t.Fatalf("read %q from file", p)
+	}
+
+	t.Setenv("TEST_PASSPHRASE", "battery staple")
+	p, err = ReadPassphrase("env:TEST_PASSPHRASE", false)
+	checkError(t, err)
+	if string(p) != "battery staple" {
+		t.Fatalf("read %q from environment", p)
+	}
+
+	if _, err = ReadPassphrase("env:TEST_UNSET_PASSPHRASE", false); err != ErrEmptyPassphrase {
+		t.Fatalf("expected %v, have %v", ErrEmptyPassphrase, err)
+	}
+	if _, err = ReadPassphrase("vault:secret", false); err != ErrPassphraseSpec {
+		t.Fatalf("expected %v, have %v", ErrPassphraseSpec, err)
+	}
+}
@@ -0,0 +1,214 @@
+package sim
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kisom/entropyshare/clock"
+)
+
+// Faults describe how a link mistreats the packets sent over it.
+type Faults struct {
+	// Latency is the simulated time a packet takes to arrive.
+	Latency time.Duration
+
+	// Drop is the probability that a packet is lost.
+	Drop float64
+
+	// Truncate is the probability that the connection is cut
+	// partway through a packet.
+	Truncate float64
+
+	// Reorder delivers the packets that arrive together in a
+	// random order, rather than the order they were sent in.
+	Reorder bool
+}
+
+// LinkStats count what became of the packets sent over a link.
+type LinkStats struct {
+	Sent      int
+	Delivered int
+	Dropped   int
+	Truncated int
+}
+
+type message struct {
+	due  time.Time
+	data []byte
+}
+
+// A Link stands between the source and a sink: the source sends to
+// the link's address, and the link holds each packet until the
+// simulated clock reaches its arrival time, then delivers it to the
+// sink with its faults applied.
+type Link struct {
+	faults   Faults
+	listener net.Listener
+	dest     string
+	clock    clock.Clock
+	rand     *rand.Rand
+
+	lock  sync.Mutex
+	queue []*message
+	stats LinkStats
+}
+
+func newLink(dest string, clk clock.Clock, faults Faults, seed int64) (*Link, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Link{
+		faults:   faults,
+		listener: listener,
+		dest:     dest,
+		clock:    clk,
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+	go l.accept()
+	return l, nil
+}
+
+// Address is the address the source sends to.
+func (l *Link) Address() string {
+	return l.listener.Addr().String()
+}
+
+// SetFaults changes the faults applied to packets sent from now on.
+func (l *Link) SetFaults(faults Faults) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.faults = faults
+}
+
+// Stats returns the link's counts so far.
+func (l *Link) Stats() LinkStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.stats
+}
+
+// Pending returns the number of packets that haven't yet arrived.
+func (l *Link) Pending() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.queue)
+}
+
+func (l *Link) close() {
+	l.listener.Close()
+}
+
+func (l *Link) accept() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		data, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil || len(data) < 2 {
+			continue
+		}
+
+		l.lock.Lock()
+		l.queue = append(l.queue, &message{
+			due:  l.clock.Now().Add(l.faults.Latency),
+			data: data[2:],
+		})
+		l.stats.Sent++
+		l.lock.Unlock()
+	}
+}
+
+// due removes and returns the packets that have arrived by now, in
+// the order they're to be delivered.
+func (l *Link) due() []*message {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.clock.Now()
+	var due, waiting []*message
+	for _, m := range l.queue {
+		if m.due.After(now) {
+			waiting = append(waiting, m)
+		} else {
+			due = append(due, m)
+		}
+	}
+	l.queue = waiting
+
+	if l.faults.Reorder {
+		l.rand.Shuffle(len(due), func(i, j int) {
+			due[i], due[j] = due[j], due[i]
+		})
+	}
+	return due
+}
+
+// fate decides whether a packet is dropped, and how much of it is
+// sent if the connection is cut.
+func (l *Link) fate(m *message) (drop bool, length int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	length = len(m.data)
+	switch {
+	case l.rand.Float64() < l.faults.Drop:
+		l.stats.Dropped++
+		return true, 0
+	case l.rand.Float64() < l.faults.Truncate:
+		l.stats.Truncated++
+		length = l.rand.Intn(len(m.data))
+	default:
+		l.stats.Delivered++
+	}
+	return false, length
+}
+
+// deliver sends the packets that have arrived to the sink, waiting
+// for the sink to finish with each one.
+func (l *Link) deliver() error {
+	for _, m := range l.due() {
+		drop, length := l.fate(m)
+		if drop {
+			continue
+		}
+
+		if err := l.send(m.data, length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Link) send(data []byte, length int) error {
+	conn, err := net.Dial("tcp", l.dest)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(data)))
+	if _, err = conn.Write(header[:]); err != nil {
+		return err
+	}
+
+	if _, err = conn.Write(data[:length]); err != nil {
+		return err
+	}
+
+	// The sink closes the connection once it has applied or
+	// rejected the packet.
+	conn.(*net.TCPConn).CloseWrite()
+	_, err = io.Copy(ioutil.Discard, conn)
+	return err
+}
@@ -0,0 +1,305 @@
+// Package sim runs a source and its sinks together in one process,
+// for end-to-end tests. The sinks listen on loopback with generated
+// keys, the source draws from a deterministic entropy input instead
+// of a TPM, and the packets between them pass through links that can
+// delay, drop, truncate, and reorder them. Time is simulated: packets
+// are stamped and checked by a fake clock that only moves when the
+// test advances it.
+//
+// A harness replaces the process-wide PRNG, so tests using one
+// mustn't run in parallel.
+package sim
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kisom/entropyshare/clock"
+	"github.com/kisom/entropyshare/cmd/entropy-source/source"
+	"github.com/kisom/entropyshare/prng"
+	"github.com/kisom/entropyshare/sink"
+	"github.com/kisom/entropyshare/target"
+)
+
+// syncTimeout bounds the wait for the source's packets to reach the
+// links.
+const syncTimeout = 10 * time.Second
+
+// Entropy returns a deterministic stream of random-looking bytes,
+// the AES-CTR keystream for a key derived from seed. It passes the
+// sinks' health tests, but is of course predictable.
+func Entropy(seed int64) io.Reader {
+	var in [8]byte
+	binary.BigEndian.PutUint64(in[:], uint64(seed))
+	key := sha256.Sum256(in[:])
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+
+	stream := cipher.NewCTR(block, make([]byte, aes.BlockSize))
+	return &cipher.StreamReader{S: stream, R: zeroes{}}
+}
+
+type zeroes struct{}
+
+func (zeroes) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Options configure a harness.
+type Options struct {
+	// Sinks is the number of sinks; if it is 0, one is started.
+	Sinks int
+
+	// Drift is the sinks' allowed drift, in seconds.
+	Drift int64
+
+	// Faults are applied by every link.
+	Faults Faults
+
+	// Seed seeds the entropy input and the links' faults.
+	Seed int64
+
+	// Start is the clock's initial time; if it is zero, a fixed
+	// time is used.
+	Start time.Time
+}
+
+// A Sink is one of the harness's sinks.
+type Sink struct {
+	Server *sink.Server
+
+	// Link carries packets from the source to the sink; the
+	// source's target for the sink has the link's address.
+	Link *Link
+
+	lock       sync.Mutex
+	chunks     [][]byte
+	rejections []error
+}
+
+// Write records a chunk of entropy accepted by the sink.
+func (s *Sink) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.chunks = append(s.chunks, append([]byte{}, p...))
+	return len(p), nil
+}
+
+// Chunks returns the chunks the sink has accepted.
+func (s *Sink) Chunks() [][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([][]byte{}, s.chunks...)
+}
+
+// Rejections returns the errors for the packets the sink couldn't
+// read or rejected.
+func (s *Sink) Rejections() []error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]error{}, s.rejections...)
+}
+
+// recorder is the sink's log handler; it records the errors logged,
+// so that rejections can be examined.
+type recorder struct {
+	s *Sink
+}
+
+func (r recorder) Handle(_ context.Context, rec slog.Record) error {
+	rec.Attrs(func(a slog.Attr) bool {
+		if err, ok := a.Value.Any().(error); ok && a.Key == "error" {
+			r.s.lock.Lock()
+			r.s.rejections = append(r.s.rejections, err)
+			r.s.lock.Unlock()
+		}
+		return true
+	})
+	return nil
+}
+
+func (r recorder) Enabled(context.Context, slog.Level) bool { return true }
+func (r recorder) WithAttrs([]slog.Attr) slog.Handler       { return r }
+func (r recorder) WithGroup(string) slog.Handler            { return r }
+
+// A Harness is a source and its sinks.
+type Harness struct {
+	Clock  *clock.Fake
+	Sinks  []*Sink
+	Source *source.Scheduler
+
+	// TargetFile is the source's targets file.
+	TargetFile string
+
+	tb testing.TB
+}
+
+// New starts a source and its sinks, which are stopped when the test
+// finishes.
+func New(tb testing.TB, opts Options) *Harness {
+	tb.Helper()
+	if opts.Sinks == 0 {
+		opts.Sinks = 1
+	}
+	if opts.Start.IsZero() {
+		opts.Start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	h := &Harness{
+		Clock:      clock.NewFake(opts.Start),
+		TargetFile: filepath.Join(tb.TempDir(), "targets.json"),
+		tb:         tb,
+	}
+
+	entropy := prng.PRNG
+	prng.PRNG = Entropy(opts.Seed)
+	tb.Cleanup(func() { prng.PRNG = entropy })
+
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	spub, err := x509.MarshalPKIXPublicKey(&signer.PublicKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var targets []*target.Target
+	for i := 0; i < opts.Sinks; i++ {
+		s, t, err := h.startSink(spub, opts, int64(i))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		h.Sinks = append(h.Sinks, s)
+		targets = append(targets, t)
+	}
+
+	if err = target.Store(h.TargetFile, targets); err != nil {
+		tb.Fatal(err)
+	}
+	h.Source = source.NewScheduler(signer, h.TargetFile)
+	h.Source.Clock = h.Clock
+	return h
+}
+
+func (h *Harness) startSink(signer []byte, opts Options, i int64) (*Sink, *target.Target, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &sink.Config{
+		Address: "127.0.0.1:0",
+		Signer:  signer,
+		Private: priv.Bytes(),
+		Drift:   opts.Drift,
+	}
+
+	s := &Sink{}
+	s.Server, err = sink.New(cfg, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.Server.Logger = slog.New(recorder{s})
+	s.Server.Clock = h.Clock
+
+	listener, err := s.Server.Listen()
+	if err != nil {
+		return nil, nil, err
+	}
+	go s.Server.Serve(listener)
+	h.tb.Cleanup(func() { s.Server.Shutdown(context.Background()) })
+
+	s.Link, err = newLink(listener.Addr().String(), h.Clock, opts.Faults, opts.Seed+i+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.tb.Cleanup(s.Link.close)
+
+	t := &target.Target{
+		Address: s.Link.Address(),
+		Public:  priv.PublicKey().Bytes(),
+	}
+	return s, t, nil
+}
+
+// Targets returns the source's targets, as stored in its targets
+// file.
+func (h *Harness) Targets() []*target.Target {
+	h.tb.Helper()
+	targets, err := h.Source.Targets()
+	if err != nil {
+		h.tb.Fatal(err)
+	}
+	return targets
+}
+
+// Scan has the source send a packet to each target that is due, and
+// waits for the packets to reach the links. Packets whose latency has
+// passed are then delivered.
+func (h *Harness) Scan() {
+	h.tb.Helper()
+	h.Source.Scan(context.Background())
+
+	// Each packet sent advances its target's counter, so the
+	// counters total the packets the links should have.
+	var sent int64
+	for _, t := range h.Targets() {
+		sent += t.Counter
+	}
+
+	deadline := time.Now().Add(syncTimeout)
+	for {
+		var received int64
+		for _, s := range h.Sinks {
+			received += int64(s.Link.Stats().Sent)
+		}
+
+		if received == sent {
+			break
+		} else if time.Now().After(deadline) {
+			h.tb.Fatalf("sim: the source sent %d packets, but the links received %d", sent, received)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	h.Deliver()
+}
+
+// Deliver delivers the packets whose latency has passed.
+func (h *Harness) Deliver() {
+	h.tb.Helper()
+	for i, s := range h.Sinks {
+		if err := s.Link.deliver(); err != nil {
+			h.tb.Fatal(fmt.Errorf("sim: delivering to sink %d: %w", i, err))
+		}
+	}
+}
+
+// Advance moves the clock forward by d, and delivers the packets
+// that have arrived by then.
+func (h *Harness) Advance(d time.Duration) {
+	h.tb.Helper()
+	h.Clock.Advance(d)
+	h.Deliver()
+}
@@ -0,0 +1,160 @@
+package sim
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/kisom/entropyshare/common"
+)
+
+// interval is the time after which a target is due again.
+const interval = 6*time.Hour + time.Second
+
+func TestDelivery(t *testing.T) {
+	h := New(t, Options{Sinks: 3, Drift: 60})
+
+	h.Scan()
+	for i, s := range h.Sinks {
+		chunks := s.Chunks()
+		if len(chunks) != 1 || len(chunks[0]) != common.ChunkSize {
+			t.Fatalf("sink %d: expected one %d byte chunk, have %d chunks", i, common.ChunkSize, len(chunks))
+		}
+		if s.Server.Counter() != 1 {
+			t.Fatalf("sink %d: expected counter 1, have %d", i, s.Server.Counter())
+		}
+	}
+
+	if bytes.Equal(h.Sinks[0].Chunks()[0], h.Sinks[1].Chunks()[0]) {
+		t.Fatal("two sinks were sent the same chunk")
+	}
+
+	// The targets aren't due again until the interval has passed.
+	h.Advance(6 * time.Hour)
+	h.Scan()
+	if n := len(h.Sinks[0].Chunks()); n != 1 {
+		t.Fatalf("a target was sent a packet early; it has %d chunks", n)
+	}
+
+	h.Advance(time.Second)
+	h.Scan()
+	for i, s := range h.Sinks {
+		if n := len(s.Chunks()); n != 2 || s.Server.Counter() != 2 {
+			t.Fatalf("sink %d: expected 2 chunks and counter 2, have %d and %d", i, n, s.Server.Counter())
+		}
+		if rejections := s.Rejections(); len(rejections) != 0 {
+			t.Fatalf("sink %d rejected packets: %v", i, rejections)
+		}
+	}
+}
+
+func TestReorder(t *testing.T) {
+	const rounds = 8
+	h := New(t, Options{
+		Drift:  7 * 86400,
+		Faults: Faults{Latency: 48 * time.Hour, Reorder: true},
+		Seed:   1,
+	})
+
+	for i := 0; i < rounds; i++ {
+		if i > 0 {
+			h.Advance(interval)
+		}
+		h.Scan()
+	}
+
+	s := h.Sinks[0]
+	if s.Link.Pending() != rounds {
+		t.Fatalf("expected %d packets in flight, have %d", rounds, s.Link.Pending())
+	}
+	h.Advance(48 * time.Hour)
+
+	// Packets that arrive after one with a higher counter are
+	// rejected, but the highest is always accepted.
+	accepted, rejections := len(s.Chunks()), s.Rejections()
+	if accepted+len(rejections) != rounds {
+		t.Fatalf("expected %d packets, have %d accepted and %d rejected", rounds, accepted, len(rejections))
+	}
+	if len(rejections) == 0 {
+		t.Fatal("the packets weren't reordered")
+	}
+	for _, err := range rejections {
+		if !errors.Is(err, common.ErrCounter) {
+			t.Fatalf("expected %v, have %v", common.ErrCounter, err)
+		}
+	}
+	if s.Server.Counter() != rounds {
+		t.Fatalf("expected counter %d, have %d", rounds, s.Server.Counter())
+	}
+}
+
+func TestDrift(t *testing.T) {
+	const drift = 60
+	h := New(t, Options{Sinks: 2, Drift: drift})
+	onTime, late := h.Sinks[0], h.Sinks[1]
+	onTime.Link.SetFaults(Faults{Latency: drift * time.Second})
+	late.Link.SetFaults(Faults{Latency: (drift + 1) * time.Second})
+
+	h.Scan()
+	h.Advance(drift * time.Second)
+	if len(onTime.Chunks()) != 1 {
+		t.Fatalf("a packet exactly %ds old was rejected: %v", drift, onTime.Rejections())
+	}
+
+	h.Advance(time.Second)
+	rejections := late.Rejections()
+	if len(rejections) != 1 || !errors.Is(rejections[0], common.ErrTimestamp) {
+		t.Fatalf("expected %v, have %v", common.ErrTimestamp, rejections)
+	}
+	if late.Server.Counter() != 0 {
+		t.Fatalf("a rejected packet advanced the counter to %d", late.Server.Counter())
+	}
+
+	// The source doesn't know the packet was rejected; the next
+	// one is accepted, skipping the lost counter.
+	late.Link.SetFaults(Faults{})
+	h.Advance(interval)
+	h.Scan()
+	if len(late.Chunks()) != 1 || late.Server.Counter() != 2 {
+		t.Fatalf("expected one chunk and counter 2, have %d and %d", len(late.Chunks()), late.Server.Counter())
+	}
+}
+
+func TestLossyLink(t *testing.T) {
+	const rounds = 20
+	h := New(t, Options{
+		Drift:  60,
+		Faults: Faults{Drop: 0.3, Truncate: 0.3},
+		Seed:   2,
+	})
+
+	for i := 0; i < rounds; i++ {
+		h.Scan()
+		h.Advance(interval)
+	}
+
+	s := h.Sinks[0]
+	stats := s.Link.Stats()
+	if stats.Sent != rounds || stats.Delivered+stats.Dropped+stats.Truncated != rounds {
+		t.Fatalf("bad link stats %+v", stats)
+	}
+	if stats.Dropped == 0 || stats.Truncated == 0 {
+		t.Fatalf("faults weren't injected: %+v", stats)
+	}
+
+	if len(s.Chunks()) != stats.Delivered {
+		t.Fatalf("expected %d chunks, have %d", stats.Delivered, len(s.Chunks()))
+	}
+
+	rejections := s.Rejections()
+	if len(rejections) != stats.Truncated {
+		t.Fatalf("expected %d rejections, have %d", stats.Truncated, len(rejections))
+	}
+	for _, err := range rejections {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Fatalf("a truncated packet failed with %v", err)
+		}
+	}
+}
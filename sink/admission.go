@@ -0,0 +1,330 @@
+package sink
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kisom/entropyshare/clock"
+	"github.com/kisom/entropyshare/common"
+)
+
+// DefaultMaxConns and DefaultTimeout are the connection limits used
+// when a sink's admission configuration doesn't give them.
+const (
+	DefaultMaxConns = 64
+	DefaultTimeout  = 10
+)
+
+// cookieWindow is how long a cookie stays valid; a cookie from the
+// previous window is also accepted, so that one issued just before
+// the window turns over isn't refused.
+const cookieWindow = 30 * time.Second
+
+// maxBuckets bounds the number of addresses whose connection rate is
+// tracked. Past it, the buckets of addresses that have gone quiet are
+// dropped, and if none have, the one used least recently is.
+const maxBuckets = 4096
+
+// bucketPrefix is the length of the prefix an IPv6 peer's connection
+// rate is tracked by, as a single host is usually given a whole /64.
+const bucketPrefix = 64
+
+// AdmissionConfig controls which peers may connect to a sink, and how
+// much of its time they may take, before any cryptography is done on
+// their behalf.
+type AdmissionConfig struct {
+	// Allow and Deny list addresses and CIDR prefixes. A peer
+	// matching Deny is refused; if Allow isn't empty, a peer must
+	// also match it.
+	Allow []string `json:",omitempty" toml:"allow"`
+	Deny  []string `json:",omitempty" toml:"deny"`
+
+	// Rate is the number of connections per second each address
+	// may open, in bursts of up to Burst (at least 1). If Rate is
+	// 0, the connection rate isn't limited.
+	Rate  float64 `json:",omitempty" toml:"rate"`
+	Burst int     `json:",omitempty" toml:"burst"`
+
+	// MaxConns caps the connections served at once, and defaults
+	// to DefaultMaxConns. MaxConnsPerAddress caps those from a
+	// single address; if it is 0, only MaxConns applies.
+	MaxConns           int `json:",omitempty" toml:"max_conns"`
+	MaxConnsPerAddress int `json:",omitempty" toml:"max_conns_per_address"`
+
+	// Timeout is the time, in seconds, that a peer has to deliver
+	// its packet once it has connected. It defaults to
+	// DefaultTimeout.
+	Timeout int64 `json:",omitempty" toml:"timeout"`
+
+	// Cookie has the sink send each peer a cookie, derived from
+	// the peer's address and the time, that the peer must echo
+	// before its packet is read. Targets for the sink must have
+	// Cookie set.
+	Cookie bool `json:",omitempty" toml:"cookie"`
+}
+
+var (
+	ErrDenied       = errors.New("sink: address not admitted")
+	ErrRateLimited  = errors.New("sink: connection rate exceeded")
+	ErrTooManyConns = errors.New("sink: too many connections")
+	ErrCookie       = errors.New("sink: invalid cookie")
+)
+
+// bucket is a token bucket limiting an address's connection rate.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// admission enforces an AdmissionConfig.
+type admission struct {
+	allow, deny []netip.Prefix
+	rate, burst float64
+	maxConns    int
+	maxPerAddr  int
+	timeout     time.Duration
+	secret      []byte
+
+	lock    sync.Mutex
+	conns   int
+	perAddr map[netip.Addr]int
+	buckets map[netip.Addr]*bucket
+}
+
+func newAdmission(cfg *AdmissionConfig) (*admission, error) {
+	if cfg == nil {
+		cfg = &AdmissionConfig{}
+	}
+
+	a := &admission{
+		rate:       cfg.Rate,
+		burst:      math.Max(float64(cfg.Burst), 1),
+		maxConns:   cfg.MaxConns,
+		maxPerAddr: cfg.MaxConnsPerAddress,
+		timeout:    time.Duration(cfg.Timeout) * time.Second,
+		perAddr:    map[netip.Addr]int{},
+		buckets:    map[netip.Addr]*bucket{},
+	}
+
+	switch {
+	case cfg.Rate < 0, cfg.Burst < 0:
+		return nil, errors.New("sink: the admission rate and burst can't be negative")
+	case cfg.MaxConns < 0, cfg.MaxConnsPerAddress < 0, cfg.Timeout < 0:
+		return nil, errors.New("sink: admission limits can't be negative")
+	}
+
+	if a.maxConns == 0 {
+		a.maxConns = DefaultMaxConns
+	}
+	if a.timeout == 0 {
+		a.timeout = DefaultTimeout * time.Second
+	}
+
+	var err error
+	if a.allow, err = parsePrefixes(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parsePrefixes(cfg.Deny); err != nil {
+		return nil, err
+	}
+
+	if cfg.Cookie {
+		a.secret = make([]byte, sha256.Size)
+		if _, err = io.ReadFull(rand.Reader, a.secret); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// parsePrefixes parses a list of addresses and CIDR prefixes; an
+// address is taken as a prefix holding only itself.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(s, "/") {
+			prefix, err = netip.ParsePrefix(s)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(s)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sink: invalid admission address %q", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func matches(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the address of the connection's peer, or the
+// zero address if it isn't an IP address.
+func remoteAddr(conn net.Conn) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+// admit decides whether a connection from addr may be served. If it
+// may, it is counted until release is called.
+func (a *admission) admit(addr netip.Addr, now time.Time) error {
+	if matches(a.deny, addr) || (len(a.allow) != 0 && !matches(a.allow, addr)) {
+		return ErrDenied
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.conns >= a.maxConns {
+		return ErrTooManyConns
+	} else if a.maxPerAddr != 0 && a.perAddr[addr] >= a.maxPerAddr {
+		return ErrTooManyConns
+	}
+
+	if a.rate != 0 && !a.take(addr, now) {
+		return ErrRateLimited
+	}
+
+	a.conns++
+	a.perAddr[addr]++
+	return nil
+}
+
+// take takes a token from addr's bucket, reporting whether there was
+// one; the caller must hold the lock.
+func (a *admission) take(addr netip.Addr, now time.Time) bool {
+	key := bucketKey(addr)
+	b := a.buckets[key]
+	if b == nil {
+		if len(a.buckets) >= maxBuckets {
+			a.prune(now)
+		}
+		if len(a.buckets) >= maxBuckets {
+			a.evict()
+		}
+		b = &bucket{tokens: a.burst, last: now}
+		a.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(a.burst, b.tokens+elapsed*a.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops the buckets that would have refilled by now, which
+// behave as new ones would; the caller must hold the lock.
+func (a *admission) prune(now time.Time) {
+	for addr, b := range a.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*a.rate >= a.burst {
+			delete(a.buckets, addr)
+		}
+	}
+}
+
+// evict drops the bucket that was used least recently; the caller
+// must hold the lock.
+func (a *admission) evict() {
+	var oldest netip.Addr
+	var last time.Time
+	for addr, b := range a.buckets {
+		if !oldest.IsValid() || b.last.Before(last) {
+			oldest, last = addr, b.last
+		}
+	}
+	delete(a.buckets, oldest)
+}
+
+// bucketKey returns the address whose bucket limits addr: addr itself
+// for IPv4, and the start of its /64 for IPv6.
+func bucketKey(addr netip.Addr) netip.Addr {
+	if !addr.Is6() {
+		return addr
+	}
+	prefix, err := addr.Prefix(bucketPrefix)
+	if err != nil {
+		return addr
+	}
+	return prefix.Addr()
+}
+
+// release ends the count of a connection that was admitted.
+func (a *admission) release(addr netip.Addr) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.conns--
+	if a.perAddr[addr]--; a.perAddr[addr] <= 0 {
+		delete(a.perAddr, addr)
+	}
+}
+
+// cookie returns the cookie for addr in the given window.
+func (a *admission) cookie(addr netip.Addr, window int64) []byte {
+	var w [8]byte
+	binary.BigEndian.PutUint64(w[:], uint64(window))
+
+	h := hmac.New(sha256.New, a.secret)
+	h.Write(addr.AsSlice())
+	h.Write(w[:])
+	return h.Sum(nil)[:common.CookieSize]
+}
+
+// exchangeCookie sends the peer its cookie and checks the one it
+// echoes. The cookie is recomputed rather than remembered, so the
+// sink holds no state for the peer. It does nothing if cookies
+// aren't required.
+func (a *admission) exchangeCookie(conn net.Conn, clk clock.Clock) error {
+	if a.secret == nil {
+		return nil
+	}
+
+	addr := remoteAddr(conn)
+	window := clk.Now().UnixNano() / int64(cookieWindow)
+	if _, err := conn.Write(a.cookie(addr, window)); err != nil {
+		return err
+	}
+
+	echoed := make([]byte, common.CookieSize)
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		return err
+	}
+
+	window = clk.Now().UnixNano() / int64(cookieWindow)
+	if !hmac.Equal(echoed, a.cookie(addr, window)) &&
+		!hmac.Equal(echoed, a.cookie(addr, window-1)) {
+		return ErrCookie
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package sink
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/kisom/entropyshare/clock"
+	"github.com/kisom/entropyshare/prng"
+	"github.com/kisom/entropyshare/target"
+)
+
+func TestAdmissionLists(t *testing.T) {
+	a, err := newAdmission(&AdmissionConfig{
+		Allow: []string{"192.0.2.0/24", "2001:db8::1"},
+		Deny:  []string{"192.0.2.13"},
+	})
+	checkError(t, err)
+
+	var tests = []struct {
+		addr string
+		err  error
+	}{
+		{"192.0.2.1", nil},
+		{"192.0.2.13", ErrDenied},
+		{"198.51.100.1", ErrDenied},
+		{"2001:db8::1", nil},
+		{"2001:db8::2", ErrDenied},
+	}
+
+	now := time.Now()
+	for _, test := range tests {
+		if err = a.admit(netip.MustParseAddr(test.addr), now); err != test.err {
+			t.Fatalf("%s: expected %v, have %v", test.addr, test.err, err)
+		}
+	}
+
+	if _, err = newAdmission(&AdmissionConfig{Deny: []string{"192.0.2.0/33"}}); err == nil {
+		t.Fatal("an invalid prefix should be rejected")
+	}
+}
+
+func TestAdmissionRate(t *testing.T) {
+	a, err := newAdmission(&AdmissionConfig{Rate: 0.5, Burst: 2})
+	checkError(t, err)
+
+	addr, other := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	start := time.Unix(1400000000, 0)
+	for i := 0; i < 2; i++ {
+		checkError(t, a.admit(addr, start))
+		a.release(addr)
+	}
+
+	if err = a.admit(addr, start); err != ErrRateLimited {
+		t.Fatalf("expected %v, have %v", ErrRateLimited, err)
+	}
+	checkError(t, a.admit(other, start))
+	a.release(other)
+
+	// A token is earned every two seconds.
+	if err = a.admit(addr, start.Add(time.Second)); err != ErrRateLimited {
+		t.Fatalf("expected %v, have %v", ErrRateLimited, err)
+	}
+	checkError(t, a.admit(addr, start.Add(2*time.Second)))
+}
+
+func TestAdmissionBuckets(t *testing.T) {
+	a, err := newAdmission(&AdmissionConfig{Rate: 0.5, Burst: 1})
+	checkError(t, err)
+
+	// Addresses in the same /64 share a bucket.
+	now := time.Unix(1400000000, 0)
+	addr := netip.MustParseAddr("2001:db8::1")
+	checkError(t, a.admit(addr, now))
+	a.release(addr)
+	if err = a.admit(netip.MustParseAddr("2001:db8::2"), now); err != ErrRateLimited {
+		t.Fatalf("expected %v, have %v", ErrRateLimited, err)
+	}
+	checkError(t, a.admit(netip.MustParseAddr("2001:db8:0:1::1"), now))
+
+	// No more than maxBuckets are kept, even if none have refilled.
+	for i := 0; i < 2*maxBuckets; i++ {
+		var b [16]byte
+		b[0], b[1] = 0x20, 0x01
+		b[4], b[5], b[6] = byte(i>>16), byte(i>>8), byte(i)
+		other := netip.AddrFrom16(b)
+		checkError(t, a.admit(other, now))
+		a.release(other)
+	}
+	if len(a.buckets) > maxBuckets {
+		t.Fatalf("expected at most %d buckets, have %d", maxBuckets, len(a.buckets))
+	}
+}
+
+func TestAdmissionConns(t *testing.T) {
+	a, err := newAdmission(&AdmissionConfig{MaxConns: 3, MaxConnsPerAddress: 2})
+	checkError(t, err)
+
+	addr, other := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	now := time.Now()
+	checkError(t, a.admit(addr, now))
+	checkError(t, a.admit(addr, now))
+	if err = a.admit(addr, now); err != ErrTooManyConns {
+		t.Fatalf("expected %v, have %v", ErrTooManyConns, err)
+	}
+
+	checkError(t, a.admit(other, now))
+	if err = a.admit(netip.MustParseAddr("192.0.2.3"), now); err != ErrTooManyConns {
+		t.Fatalf("expected %v, have %v", ErrTooManyConns, err)
+	}
+
+	a.release(addr)
+	checkError(t, a.admit(addr, now))
+}
+
+func TestServeDenied(t *testing.T) {
+	keys := newTestKeys(t)
+	keys.config.Admission = &AdmissionConfig{Deny: []string{"127.0.0.0/8"}}
+	srv, err := New(keys.config, NewPool(0))
+	checkError(t, err)
+
+	listener, err := net.Listen("tcp", keys.config.Address)
+	checkError(t, err)
+	go srv.Serve(listener)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	checkError(t, err)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("a denied connection should be closed at once, have %v", err)
+	}
+}
+
+func TestCookie(t *testing.T) {
+	keys := newTestKeys(t)
+	keys.config.Admission = &AdmissionConfig{Cookie: true, Timeout: 5}
+	srv, err := New(keys.config, NewPool(0))
+	checkError(t, err)
+
+	entropy := prng.PRNG
+	prng.PRNG = rand.Reader
+	defer func() { prng.PRNG = entropy }()
+
+	listener, err := net.Listen("tcp", keys.config.Address)
+	checkError(t, err)
+	defer listener.Close()
+
+	receive := func() chan error {
+		received := make(chan error, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				received <- err
+				return
+			}
+			received <- srv.Receive(conn)
+		}()
+		return received
+	}
+
+	// A source that echoes the cookie is heard.
+	received := receive()
+	tgt := &target.Target{Address: listener.Addr().String(), Public: keys.pub, Cookie: true}
+	checkError(t, tgt.Send(clock.System, keys.signer))
+	checkError(t, <-received)
+	if srv.Counter() != 1 {
+		t.Fatalf("Counter: expected 1, have %d", srv.Counter())
+	}
+
+	// One that sends its packet at once isn't.
+	received = receive()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	checkError(t, err)
+	defer conn.Close()
+
+	_, packet := keys.packet(t, 2)
+	_, err = conn.Write(framePacket(packet))
+	checkError(t, err)
+	if err = <-received; err != ErrCookie {
+		t.Fatalf("expected %v, have %v", ErrCookie, err)
+	}
+}
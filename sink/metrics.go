@@ -0,0 +1,91 @@
+package sink
+
+import (
+	"crypto/rsa"
+	"time"
+
+	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/common/crypt"
+	"github.com/kisom/entropyshare/health"
+	"github.com/kisom/entropyshare/metrics"
+	"github.com/kisom/entropyshare/noise"
+)
+
+var (
+	packetsReceived = metrics.NewCounter("entropyshare_sink_packets_received_total",
+		"Packets received, by result.", "result")
+	bytesReceived = metrics.NewCounter("entropyshare_sink_bytes_received_total",
+		"Bytes of entropy accepted from packets.")
+	clockSkew = metrics.NewGauge("entropyshare_sink_clock_skew_seconds",
+		"Difference between the sink's clock and the timestamp of the last authenticated packet.")
+	outputWrites = metrics.NewCounter("entropyshare_sink_output_writes_total",
+		"Writes to each output, by result.", "output", "result")
+	connectionsRefused = metrics.NewCounter("entropyshare_sink_connections_refused_total",
+		"Connections refused by the admission controls, by reason.", "reason")
+)
+
+// refusal classifies an admission error for the connections refused
+// metric.
+func refusal(err error) string {
+	switch err {
+	case ErrDenied:
+		return "denied"
+	case ErrRateLimited:
+		return "rate"
+	case ErrTooManyConns:
+		return "connections"
+	case ErrCookie:
+		return "cookie"
+	case ErrSessionRequired:
+		return "session"
+	case common.ErrHybridRequired:
+		return "hybrid"
+	default:
+		return "error"
+	}
+}
+
+// result classifies the outcome of applying a packet for the
+// packets received metric.
+func result(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case err == common.ErrTimestamp:
+		return "timestamp"
+	case err == common.ErrCounter:
+		return "counter"
+	case err == common.ErrUnsignedPacket:
+		return "unsigned"
+	case err == crypt.ErrDecrypt, err == noise.ErrDecrypt:
+		return "decrypt"
+	case err == crypt.ErrBoxSize, err == common.ErrPacketSize, err == noise.ErrMessage:
+		return "malformed"
+	case err == rsa.ErrVerification, err == common.ErrBinding:
+		return "signature"
+	case err == common.ErrBadChunk, err == common.ErrChunkSize:
+		return "chunk"
+	case err == common.ErrHybridRequired:
+		return "hybrid"
+	case health.IsFailure(err):
+		return "health"
+	case err == ErrAllOutputs:
+		return "output"
+	default:
+		return "error"
+	}
+}
+
+// observe records the outcome of applying a packet at now. The packet
+// may be nil if it couldn't be parsed.
+func observe(p *common.Packet, err error, now time.Time) {
+	packetsReceived.Inc(result(err))
+	if p == nil {
+		return
+	}
+
+	clockSkew.Set(float64(now.Unix() - p.Timestamp))
+	if err == nil {
+		bytesReceived.Add(float64(len(p.Chunk)))
+	}
+}
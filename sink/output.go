@@ -0,0 +1,332 @@
+package sink
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The output types that may be given in an OutputConfig.
+const (
+	OutputRandom        = "random"
+	OutputRndAddEntropy = "rndaddentropy"
+	OutputFile          = "file"
+	OutputFIFO          = "fifo"
+	OutputRngd          = "rngd"
+	OutputFortuna       = "fortuna"
+	OutputWebhook       = "webhook"
+)
+
+// DefaultRandomDevice is the device written to by random and
+// rndaddentropy outputs if no path is given.
+const DefaultRandomDevice = "/dev/random"
+
+// DefaultCredit is the number of bits credited to the kernel for
+// each byte written by an rndaddentropy output that doesn't set its
+// own credit. It is deliberately low: the sink can't know how much
+// entropy its sources gathered, and overcrediting weakens the pool.
+const DefaultCredit = 1
+
+// fifoTimeout is how long a FIFO output waits for its reader before
+// giving up on a write.
+const fifoTimeout = time.Second
+
+// webhookTimeout bounds the time spent delivering to a webhook.
+const webhookTimeout = 5 * time.Second
+
+// OutputConfig describes a destination for received entropy.
+type OutputConfig struct {
+	// Type is one of the output type constants.
+	Type string `toml:"type"`
+
+	// Path is the device, file, or FIFO written to.
+	Path string `json:",omitempty" toml:"path"`
+
+	// Credit is the number of bits of entropy credited to the
+	// kernel for each byte written by an rndaddentropy
+	// output. If it is 0, each byte is credited with
+	// DefaultCredit bits.
+	Credit int `json:",omitempty" toml:"credit"`
+
+	// URL is the address entropy is POSTed to by a webhook
+	// output.
+	URL string `json:",omitempty" toml:"url"`
+}
+
+var (
+	// ErrAllOutputs is returned when entropy couldn't be
+	// delivered to any output.
+	ErrAllOutputs = errors.New("sink: all outputs failed")
+
+	errWebhookBusy = errors.New("sink: webhook is still delivering the last chunk")
+)
+
+// OutputStats records the delivery history of an output.
+type OutputStats struct {
+	Name     string
+	Writes   int64
+	Failures int64
+}
+
+type output struct {
+	OutputStats
+	w    io.Writer
+	busy bool // a webhook POST is in flight
+}
+
+// Outputs delivers entropy to a set of outputs. A failure in one
+// output is logged and counted, but doesn't stop delivery to the
+// others; a write only fails if every output failed.
+//
+// Webhooks are POSTed a copy of the entropy in the background, so
+// that a slow endpoint holds up neither the other outputs nor the
+// sink. A webhook still delivering the last chunk misses the next.
+type Outputs struct {
+	lock    sync.Mutex
+	outputs []*output
+	posts   sync.WaitGroup
+}
+
+// OpenOutputs sets up the configured outputs. Fortuna outputs write
+// to local, which should mix its input into a local PRNG; it may be
+// nil if no Fortuna outputs are configured.
+func OpenOutputs(cfgs []OutputConfig, local io.Writer) (*Outputs, error) {
+	outs := &Outputs{}
+	for i := range cfgs {
+		w, err := openOutput(&cfgs[i], local)
+		if err != nil {
+			outs.Close()
+			return nil, err
+		}
+		outs.Add(outputName(&cfgs[i]), w)
+	}
+	return outs, nil
+}
+
+// Add appends a writer to the set of outputs.
+func (outs *Outputs) Add(name string, w io.Writer) {
+	outs.lock.Lock()
+	defer outs.lock.Unlock()
+	outs.outputs = append(outs.outputs, &output{
+		OutputStats: OutputStats{Name: name},
+		w:           w,
+	})
+}
+
+// Write delivers p to each output.
+func (outs *Outputs) Write(p []byte) (int, error) {
+	outs.lock.Lock()
+	defer outs.lock.Unlock()
+
+	if len(outs.outputs) == 0 {
+		return 0, ErrAllOutputs
+	}
+
+	var delivered bool
+	for _, o := range outs.outputs {
+		if wh, ok := o.w.(*webhook); ok {
+			if o.busy {
+				o.record(errWebhookBusy)
+				continue
+			}
+
+			o.busy = true
+			outs.posts.Add(1)
+			go outs.post(o, wh, append([]byte(nil), p...))
+			delivered = true
+			continue
+		}
+
+		_, err := o.w.Write(p)
+		o.record(err)
+		if err == nil {
+			delivered = true
+		}
+	}
+
+	if !delivered {
+		return 0, ErrAllOutputs
+	}
+	return len(p), nil
+}
+
+// post delivers p to a webhook without holding the lock, recording
+// the outcome once it's done.
+func (outs *Outputs) post(o *output, wh *webhook, p []byte) {
+	defer outs.posts.Done()
+	_, err := wh.Write(p)
+	zero(p)
+
+	outs.lock.Lock()
+	defer outs.lock.Unlock()
+	o.busy = false
+	o.record(err)
+}
+
+// record counts the outcome of a write to o. The lock must be held.
+func (o *output) record(err error) {
+	if err != nil {
+		o.Failures++
+		outputWrites.Inc(o.Name, "error")
+		slog.Warn("output failed", "output", o.Name, "error", err)
+		return
+	}
+	o.Writes++
+	outputWrites.Inc(o.Name, "ok")
+}
+
+// Stats returns the delivery history of each output.
+func (outs *Outputs) Stats() []OutputStats {
+	outs.lock.Lock()
+	defer outs.lock.Unlock()
+
+	stats := make([]OutputStats, 0, len(outs.outputs))
+	for _, o := range outs.outputs {
+		stats = append(stats, o.OutputStats)
+	}
+	return stats
+}
+
+// Close waits for any webhook deliveries in flight, and closes any
+// outputs holding open files.
+func (outs *Outputs) Close() error {
+	outs.posts.Wait()
+	outs.lock.Lock()
+	defer outs.lock.Unlock()
+
+	var err error
+	for _, o := range outs.outputs {
+		if c, ok := o.w.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+func outputName(cfg *OutputConfig) string {
+	switch {
+	case cfg.Path != "":
+		return cfg.Type + ":" + cfg.Path
+	case cfg.URL != "":
+		return cfg.Type + ":" + cfg.URL
+	default:
+		return cfg.Type
+	}
+}
+
+func openOutput(cfg *OutputConfig, local io.Writer) (io.Writer, error) {
+	switch cfg.Type {
+	case OutputRandom:
+		path := cfg.Path
+		if path == "" {
+			path = DefaultRandomDevice
+		}
+		return os.OpenFile(path, os.O_WRONLY, 0)
+	case OutputRndAddEntropy:
+		path := cfg.Path
+		if path == "" {
+			path = DefaultRandomDevice
+		}
+
+		credit := cfg.Credit
+		if credit == 0 {
+			credit = DefaultCredit
+		} else if credit < 0 || credit > 8 {
+			return nil, fmt.Errorf("sink: invalid entropy credit %d", credit)
+		}
+		return newRndAddEntropy(path, credit)
+	case OutputFile:
+		if cfg.Path == "" {
+			return nil, errors.New("sink: file output requires a path")
+		}
+		return os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	case OutputFIFO, OutputRngd:
+		if cfg.Path == "" {
+			return nil, errors.New("sink: FIFO output requires a path")
+		}
+		return &fifo{path: cfg.Path}, nil
+	case OutputFortuna:
+		if local == nil {
+			return nil, errors.New("sink: no local PRNG for Fortuna output")
+		}
+		return local, nil
+	case OutputWebhook:
+		if cfg.URL == "" {
+			return nil, errors.New("sink: webhook output requires a URL")
+		}
+		return &webhook{
+			url:    cfg.URL,
+			client: &http.Client{Timeout: webhookTimeout},
+		}, nil
+	default:
+		return nil, fmt.Errorf("sink: unknown output type %q", cfg.Type)
+	}
+}
+
+// fifo writes to a named pipe, such as one read by rngd. The pipe
+// is opened on demand and reopened after an error, so the reader may
+// be restarted without restarting the sink.
+type fifo struct {
+	path string
+	f    *os.File
+}
+
+func (ff *fifo) Write(p []byte) (int, error) {
+	if ff.f == nil {
+		// Opening without blocking fails if there is no
+		// reader, rather than waiting for one.
+		f, err := os.OpenFile(ff.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return 0, err
+		}
+		ff.f = f
+	}
+
+	ff.f.SetWriteDeadline(time.Now().Add(fifoTimeout))
+	n, err := ff.f.Write(p)
+	if err != nil {
+		ff.f.Close()
+		ff.f = nil
+	}
+	return n, err
+}
+
+func (ff *fifo) Close() error {
+	if ff.f == nil {
+		return nil
+	}
+	err := ff.f.Close()
+	ff.f = nil
+	return err
+}
+
+// webhook POSTs entropy to an HTTP endpoint, which should be a
+// daemon on the local host.
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+func (wh *webhook) Write(p []byte) (int, error) {
+	resp, err := wh.client.Post(wh.url, "application/octet-stream", bytes.NewReader(p))
+	if err != nil {
+		return 0, err
+	}
+	// Draining the body lets the connection be reused.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("sink: webhook returned %s", resp.Status)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sink
+
+import (
+	"errors"
+	"io"
+)
+
+func newRndAddEntropy(path string, credit int) (io.Writer, error) {
+	return nil, errors.New("sink: RNDADDENTROPY is only supported on Linux")
+}
@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken output")
+}
+
+func TestOutputsIsolateFailures(t *testing.T) {
+	outs := &Outputs{}
+	buf := &bytes.Buffer{}
+	outs.Add("broken", failWriter{})
+	outs.Add("buffer", buf)
+
+	n, err := outs.Write([]byte("entropy"))
+	checkError(t, err)
+	if n != 7 || buf.String() != "entropy" {
+		t.Fatal("a broken output should not block the others")
+	}
+
+	stats := outs.Stats()
+	if stats[0].Failures != 1 || stats[1].Writes != 1 {
+		t.Fatalf("unexpected output stats: %+v", stats)
+	}
+
+	outs = &Outputs{}
+	outs.Add("broken", failWriter{})
+	_, err = outs.Write([]byte("entropy"))
+	if err != ErrAllOutputs {
+		t.Fatal("write should fail when every output fails")
+	}
+}
+
+func TestOpenOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "entropyshare")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	var posted []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(dir, "entropy.bin")
+	local := &bytes.Buffer{}
+	outs, err := OpenOutputs([]OutputConfig{
+		{Type: OutputFile, Path: path},
+		{Type: OutputFortuna},
+		{Type: OutputWebhook, URL: srv.URL},
+	}, local)
+	checkError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = outs.Write([]byte("chunk"))
+		checkError(t, err)
+	}
+	checkError(t, outs.Close())
+
+	in, err := ioutil.ReadFile(path)
+	checkError(t, err)
+	if string(in) != "chunkchunk" {
+		t.Fatalf("file output should be appended to, have %q", in)
+	}
+
+	if local.String() != "chunkchunk" {
+		t.Fatal("Fortuna output wasn't written to")
+	}
+
+	if string(posted) != "chunk" {
+		t.Fatal("webhook wasn't posted to")
+	}
+
+	_, err = OpenOutputs([]OutputConfig{{Type: "carrier-pigeon"}}, nil)
+	if err == nil {
+		t.Fatal("unknown output types should be rejected")
+	}
+}
+
+func TestSlowWebhook(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+
+	outs, err := OpenOutputs([]OutputConfig{{Type: OutputWebhook, URL: srv.URL}}, nil)
+	checkError(t, err)
+	buf := &bytes.Buffer{}
+	outs.Add("buffer", buf)
+
+	// Neither write waits on the webhook; the second arrives while
+	// the first is still being delivered, so the webhook misses it.
+	for i := 0; i < 2; i++ {
+		_, err = outs.Write([]byte("chunk"))
+		checkError(t, err)
+	}
+	if buf.String() != "chunkchunk" {
+		t.Fatal("a slow webhook should not block the other outputs")
+	}
+
+	close(release)
+	checkError(t, outs.Close())
+
+	stats := outs.Stats()
+	if stats[0].Writes != 1 || stats[0].Failures != 1 {
+		t.Fatalf("unexpected webhook stats: %+v", stats[0])
+	}
+}
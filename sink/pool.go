@@ -0,0 +1,103 @@
+package sink
+
+import (
+	"io"
+	"sync"
+)
+
+// DefaultPoolSize is the number of bytes a Pool holds if no size is
+// given.
+const DefaultPoolSize = 65536
+
+// A Pool buffers received entropy for programs that want to read it
+// directly, such as to seed their own DRBG. Each byte written to
+// the pool is read out at most once. When the pool is full, further
+// entropy is discarded until it has been drained.
+type Pool struct {
+	lock   sync.Mutex
+	ready  *sync.Cond
+	buf    []byte
+	size   int
+	closed bool
+}
+
+// NewPool returns a pool holding at most size bytes; a size of 0
+// selects DefaultPoolSize.
+func NewPool(size int) *Pool {
+	if size <= 0 {
+		size = DefaultPoolSize
+	}
+
+	p := &Pool{size: size}
+	p.ready = sync.NewCond(&p.lock)
+	return p
+}
+
+// Write adds entropy to the pool. It never fails on an open pool;
+// any entropy that doesn't fit is discarded.
+func (p *Pool) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n := len(b)
+	if room := p.size - len(p.buf); n > room {
+		n = room
+	}
+	p.buf = append(p.buf, b[:n]...)
+	if n > 0 {
+		p.ready.Broadcast()
+	}
+	return len(b), nil
+}
+
+// Read removes up to len(b) bytes of entropy from the pool. It
+// blocks until entropy is available, and returns io.EOF once the
+// pool has been closed and drained.
+func (p *Pool) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for len(p.buf) == 0 {
+		if p.closed {
+			return 0, io.EOF
+		}
+		p.ready.Wait()
+	}
+
+	n := copy(b, p.buf)
+	zero(p.buf[:n])
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// Len returns the number of bytes of entropy in the pool.
+func (p *Pool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.buf)
+}
+
+// Close stops the pool from accepting entropy, and wakes any blocked
+// readers once the remaining entropy is drained.
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	p.ready.Broadcast()
+	return nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
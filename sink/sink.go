@@ -0,0 +1,779 @@
+// Package sink implements the receiving end of entropyshare: a
+// server that accepts packets from a source, verifies them, and
+// hands the entropy to a writer. Programs that want to consume the
+// entropy directly, rather than feeding it to the kernel, may use a
+// Pool as the writer and read from it.
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kisom/entropyshare/clock"
+	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/common/crypt"
+	"github.com/kisom/entropyshare/health"
+	"github.com/kisom/entropyshare/util"
+)
+
+// ErrServerClosed is returned by the server's Serve, ListenAndServe,
+// and Import methods after a call to Shutdown.
+var ErrServerClosed = errors.New("sink: server closed")
+
+// ErrSessionRequired is returned by Receive when a source sends a
+// packet outside a session to a sink that requires one.
+var ErrSessionRequired = errors.New("sink: session required")
+
+// Config contains a sink's configuration.
+type Config struct {
+	Address  string
+	Signer   []byte
+	Counter  int64
+	Private  []byte `json:",omitempty"`
+	Drift    int64
+	MinChunk int            `json:",omitempty"`
+	MaxChunk int            `json:",omitempty"`
+	Outputs  []OutputConfig `json:",omitempty"`
+	Relay    *RelayConfig   `json:",omitempty"`
+
+	// PrivateFile, if set, is the path to the private key in
+	// place of Private. The key file may be sealed with a
+	// passphrase.
+	PrivateFile string `json:",omitempty"`
+
+	// KEMPrivate is the sink's ML-KEM-768 key, as its seed. With
+	// it, the sink accepts packets sealed with the hybrid key
+	// agreement as well as those sealed to Private alone.
+	// KEMPrivateFile, if set, is the path to the key in its
+	// place, and may be sealed like PrivateFile.
+	KEMPrivate     []byte `json:",omitempty"`
+	KEMPrivateFile string `json:",omitempty"`
+
+	// HealthEntropy is the min-entropy, in bits per byte,
+	// claimed for received chunks; the health test cutoffs are
+	// derived from it. If it is 0, full entropy is assumed.
+	HealthEntropy float64 `json:",omitempty"`
+
+	// Admission limits the connections the sink serves; if it is
+	// nil, the defaults described by AdmissionConfig apply.
+	Admission *AdmissionConfig `json:",omitempty"`
+
+	// RequireSession refuses packets that aren't delivered in a
+	// session, whose keys are forgotten once it ends; see
+	// common.SendSession.
+	RequireSession bool `json:",omitempty"`
+
+	// RequireHybrid refuses packets that aren't sealed with the
+	// hybrid key agreement, including those delivered in a
+	// session, once every source has been given the sink's
+	// ML-KEM key. It requires KEMPrivate, and can't be set with
+	// RequireSession.
+	RequireHybrid bool `json:",omitempty"`
+
+	// stateFile is the file the counter is kept in when the
+	// configuration was loaded from a TOML file.
+	stateFile string
+}
+
+// RelayConfig describes the downstream hop of a relay. A relay uses
+// its own signature key, distinct from the upstream source's, to
+// sign packets for its downstream targets.
+type RelayConfig struct {
+	SignerKey string `toml:"signer_key"`
+	Targets   string `toml:"targets"`
+	SeedFile  string `toml:"seed_file"`
+	TPM       bool   `json:",omitempty" toml:"tpm"`
+}
+
+// LoadConfig reads a sink configuration from filespec. A file ending
+// in .toml is read as LoadTOML describes; any other is read as JSON.
+// If the configuration names a PrivateFile, the key is read from it,
+// and if the key is sealed, the passphrase is read as
+// util.ReadPrivateKey describes.
+func LoadConfig(filespec string) (*Config, error) {
+	if isTOML(filespec) {
+		return LoadTOML(filespec)
+	}
+
+	in, err := ioutil.ReadFile(filespec)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := parseConfig(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.PrivateFile != "" {
+		if err = cfg.readPrivateFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.KEMPrivateFile != "" {
+		if err = cfg.readKEMPrivateFile(); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// parseConfig decodes a JSON configuration without reading its
+// PrivateFile.
+func parseConfig(in []byte) (*Config, error) {
+	var cfg Config
+	err := json.Unmarshal(in, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// readPrivateFile reads the private key from the PrivateFile.
+func (cfg *Config) readPrivateFile() (err error) {
+	cfg.Private, err = util.ReadPrivateKey(cfg.PrivateFile, "CURVE25519 PRIVATE KEY")
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Private) != 32 {
+		return errors.New("sink: invalid private key")
+	}
+	return nil
+}
+
+// readKEMPrivateFile reads the ML-KEM key from the KEMPrivateFile.
+func (cfg *Config) readKEMPrivateFile() (err error) {
+	cfg.KEMPrivate, err = util.ReadPrivateKey(cfg.KEMPrivateFile, "ML-KEM-768 PRIVATE KEY")
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.KEMPrivate) != crypt.KEMPrivateKeySize {
+		return errors.New("sink: invalid ML-KEM private key")
+	}
+	return nil
+}
+
+// Validate checks that the configuration has a usable private key
+// and signer, and that its chunk size bounds are sane.
+func (cfg *Config) Validate() error {
+	if len(cfg.Private) != 32 && cfg.PrivateFile == "" {
+		return errors.New("sink: invalid private key")
+	}
+
+	if _, err := parseSigner(cfg.Signer); err != nil {
+		return err
+	}
+
+	if cfg.KEMPrivate != nil && len(cfg.KEMPrivate) != crypt.KEMPrivateKeySize {
+		return errors.New("sink: invalid ML-KEM private key")
+	}
+
+	if cfg.RequireHybrid && cfg.KEMPrivate == nil && cfg.KEMPrivateFile == "" {
+		return errors.New("sink: requiring hybrid packets needs an ML-KEM private key")
+	} else if cfg.RequireHybrid && cfg.RequireSession {
+		return errors.New("sink: sessions don't use the ML-KEM key, so both can't be required")
+	}
+
+	if cfg.MinChunk != 0 && cfg.MinChunk < common.MinChunkSize {
+		return fmt.Errorf("sink: minimum chunk size must be at least %d", common.MinChunkSize)
+	}
+
+	if cfg.MaxChunk > common.MaxChunkSize {
+		return fmt.Errorf("sink: maximum chunk size must be at most %d", common.MaxChunkSize)
+	}
+
+	if cfg.MaxChunk != 0 && cfg.MinChunk > cfg.MaxChunk {
+		return errors.New("sink: minimum chunk size exceeds the maximum")
+	}
+
+	if _, err := newAdmission(cfg.Admission); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateLoaded checks a configuration that is about to be served:
+// as well as passing Validate, its keys must have been read from any
+// key files.
+func (cfg *Config) validateLoaded() error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if len(cfg.Private) != 32 {
+		return errors.New("sink: invalid private key")
+	} else if cfg.RequireHybrid && cfg.KEMPrivate == nil {
+		return errors.New("sink: requiring hybrid packets needs an ML-KEM private key")
+	}
+	return nil
+}
+
+// Store writes the configuration to filespec. Private keys read from
+// a PrivateFile or KEMPrivateFile aren't written out. A configuration
+// loaded from a TOML file only has its state written, to its state
+// file; otherwise, a filespec ending in .toml is written as WriteTOML
+// describes.
+func (cfg *Config) Store(filespec string) error {
+	if isTOML(filespec) {
+		if cfg.stateFile != "" {
+			return cfg.writeState()
+		}
+		return cfg.WriteTOML(filespec)
+	}
+
+	stored := *cfg
+	if stored.PrivateFile != "" {
+		stored.Private = nil
+	}
+	if stored.KEMPrivateFile != "" {
+		stored.KEMPrivate = nil
+	}
+
+	out, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filespec, out, 0644)
+}
+
+// A Server receives packets from a source and writes the verified
+// entropy to its output.
+type Server struct {
+	// If StateFile is set, the configuration is written to it,
+	// with the updated counter, after each accepted packet.
+	StateFile string
+
+	// Logger receives the server's log events; if it is nil,
+	// the default logger is used.
+	Logger *slog.Logger
+
+	// Clock is used to check packets' timestamps and to pace
+	// imports; if it is nil, the system clock is used.
+	Clock clock.Clock
+
+	config    *Config
+	signer    *rsa.PublicKey
+	health    *health.Tester
+	out       io.Writer
+	admission *admission
+	lock      sync.Mutex
+
+	// serveLock guards the listeners and the closed flag; active
+	// counts the Serve and Import calls, and the connections,
+	// that are running.
+	serveLock sync.Mutex
+	listeners map[net.Listener]bool
+	closed    bool
+	done      chan struct{}
+	active    sync.WaitGroup
+}
+
+// New sets up a server from the configuration; verified entropy will
+// be written to out once it has passed the health tests.
+func New(cfg *Config, out io.Writer) (*Server, error) {
+	if out == nil {
+		return nil, errors.New("sink: invalid writer")
+	}
+
+	if err := cfg.validateLoaded(); err != nil {
+		return nil, err
+	}
+
+	signer, err := parseSigner(cfg.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	admission, err := newAdmission(cfg.Admission)
+	if err != nil {
+		return nil, err
+	}
+
+	tester := health.New(cfg.HealthEntropy)
+	return &Server{
+		config:    cfg,
+		signer:    signer,
+		health:    tester,
+		out:       health.NewWriter(tester, out),
+		admission: admission,
+		listeners: map[net.Listener]bool{},
+		done:      make(chan struct{}),
+	}, nil
+}
+
+func parseSigner(in []byte) (*rsa.PublicKey, error) {
+	pub, err := x509.ParsePKIXPublicKey(in)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("sink: invalid public key")
+	} else if signer.N.BitLen() > common.MaxSignerBits {
+		return nil, fmt.Errorf("sink: signer keys must be at most %d bits", common.MaxSignerBits)
+	}
+	return signer, nil
+}
+
+// Reload replaces the server's configuration with cfg, which takes
+// effect from the next packet. The counter is never moved backwards,
+// so that reloading a stale configuration can't allow packets to be
+// replayed. Changes to the address, outputs, relay, health tests,
+// and admission controls only take effect when the server is
+// restarted. A configuration that doesn't validate is refused, and
+// the current one kept.
+func (srv *Server) Reload(cfg *Config) error {
+	if err := cfg.validateLoaded(); err != nil {
+		return err
+	}
+
+	signer, err := parseSigner(cfg.Signer)
+	if err != nil {
+		return err
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	if cfg.Counter < srv.config.Counter {
+		cfg.Counter = srv.config.Counter
+	}
+	srv.config = cfg
+	srv.signer = signer
+	srv.log().Info("reloaded configuration", "counter", cfg.Counter)
+	return nil
+}
+
+// Health returns the results of the health tests run on received
+// chunks.
+func (srv *Server) Health() health.Stats {
+	return srv.health.Stats()
+}
+
+// Counter returns the counter of the last accepted packet.
+func (srv *Server) Counter() int64 {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.config.Counter
+}
+
+// ListenAndServe listens on the configured address and serves
+// incoming connections.
+func (srv *Server) ListenAndServe() error {
+	if srv.isClosed() {
+		return ErrServerClosed
+	}
+
+	listener, err := srv.Listen()
+	if err != nil {
+		return err
+	}
+	return srv.Serve(listener)
+}
+
+// Listen opens a listener on the configured address, to be passed
+// to Serve.
+func (srv *Server) Listen() (net.Listener, error) {
+	srv.lock.Lock()
+	address := srv.config.Address
+	srv.lock.Unlock()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.log().Info("listening", "address", listener.Addr().String())
+	return listener, nil
+}
+
+// Serve accepts connections on the listener, receiving a packet from
+// each one that the admission controls allow; the rest are closed
+// at once. It only returns once the listener is closed, or the server
+// is shut down.
+func (srv *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	if !srv.begin(listener) {
+		return ErrServerClosed
+	}
+	defer srv.end(listener)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			srv.log().Error("accept failed", "error", err)
+			continue
+		}
+
+		addr := remoteAddr(conn)
+		err = srv.admission.admit(addr, clock.Or(srv.Clock).Now())
+		if err != nil {
+			connectionsRefused.Inc(refusal(err))
+			srv.log().Debug("connection refused", "remote", conn.RemoteAddr().String(),
+				"error", err)
+			conn.Close()
+			continue
+		}
+
+		srv.active.Add(1)
+		go func() {
+			defer srv.active.Done()
+			defer srv.admission.release(addr)
+
+			// The outcome has already been logged.
+			srv.Receive(conn)
+		}()
+	}
+}
+
+// begin registers a running Serve or Import call, and its listener
+// if it has one. It returns false if the server has been shut down.
+func (srv *Server) begin(listener net.Listener) bool {
+	srv.serveLock.Lock()
+	defer srv.serveLock.Unlock()
+	if srv.closed {
+		return false
+	}
+
+	if listener != nil {
+		srv.listeners[listener] = true
+	}
+	srv.active.Add(1)
+	return true
+}
+
+func (srv *Server) end(listener net.Listener) {
+	srv.serveLock.Lock()
+	defer srv.serveLock.Unlock()
+	if listener != nil {
+		delete(srv.listeners, listener)
+	}
+	srv.active.Done()
+}
+
+func (srv *Server) isClosed() bool {
+	srv.serveLock.Lock()
+	defer srv.serveLock.Unlock()
+	return srv.closed
+}
+
+// Shutdown stops the server: its listeners are closed, and any
+// bundle being imported is stopped. Once the packets being received
+// have been applied, the server's state is stored. If ctx expires
+// first, its error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.serveLock.Lock()
+	if !srv.closed {
+		srv.closed = true
+		close(srv.done)
+		for listener := range srv.listeners {
+			listener.Close()
+		}
+	}
+	srv.serveLock.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		srv.active.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.log().Info("sink shut down", "counter", srv.config.Counter)
+	return srv.storeState()
+}
+
+// Receive reads a single length-prefixed packet, or a session, from
+// the connection and applies the packet, first exchanging a cookie if
+// the admission controls require one. The packet must arrive within
+// the admission timeout. The connection is closed afterwards.
+func (srv *Server) Receive(conn net.Conn) error {
+	defer conn.Close()
+
+	logger := srv.log().With("remote", conn.RemoteAddr().String())
+	logger.Debug("new connection")
+	conn.SetDeadline(time.Now().Add(srv.admission.timeout))
+
+	err := srv.admission.exchangeCookie(conn, clock.Or(srv.Clock))
+	if err == ErrCookie {
+		connectionsRefused.Inc(refusal(err))
+		logger.Warn("connection refused", "error", err,
+			"error_class", "cookie")
+		return err
+	} else if err != nil {
+		logger.Warn("failed to exchange cookie", "error", err,
+			"error_class", "read")
+		return err
+	}
+
+	var header [2]byte
+	if _, err = io.ReadFull(conn, header[:]); err != nil {
+		logger.Warn("failed to read packet", "error", err,
+			"error_class", "read")
+		return err
+	}
+
+	srv.lock.Lock()
+	requireSession := srv.config.RequireSession
+	requireHybrid := srv.config.RequireHybrid
+	srv.lock.Unlock()
+
+	if binary.BigEndian.Uint16(header[:]) == common.SessionMarker {
+		if requireHybrid {
+			// Sessions only use X25519.
+			connectionsRefused.Inc(refusal(common.ErrHybridRequired))
+			logger.Warn("connection refused", "error", common.ErrHybridRequired,
+				"error_class", "hybrid")
+			return common.ErrHybridRequired
+		}
+		return srv.receiveSession(conn, logger)
+	}
+
+	if requireSession {
+		connectionsRefused.Inc(refusal(ErrSessionRequired))
+		logger.Warn("connection refused", "error", ErrSessionRequired,
+			"error_class", "session")
+		return ErrSessionRequired
+	}
+
+	packet, err := readPacket(io.MultiReader(bytes.NewReader(header[:]), conn))
+	if err == common.ErrPacketSize {
+		srv.report(logger, nil, err)
+		return err
+	} else if err != nil {
+		logger.Warn("failed to read packet", "error", err,
+			"error_class", "read")
+		return err
+	}
+
+	return srv.apply(packet, logger)
+}
+
+// receiveSession answers a session whose marker has been read, and
+// applies its packet. The source is told the outcome once it has
+// been authenticated.
+func (srv *Server) receiveSession(conn net.Conn, logger *slog.Logger) error {
+	srv.lock.Lock()
+	private, signer := srv.config.Private, srv.signer
+	srv.lock.Unlock()
+
+	logger = logger.With("session", true)
+	p, session, err := common.AcceptSession(conn, private, signer)
+	if err != nil && isReadError(err) {
+		logger.Warn("failed to read session", "error", err,
+			"error_class", "read")
+		return err
+	} else if err != nil {
+		srv.report(logger, nil, err)
+	} else {
+		srv.lock.Lock()
+		err = srv.accept(p, logger)
+		srv.lock.Unlock()
+	}
+
+	if session != nil {
+		if rerr := session.Reply(err); rerr != nil {
+			logger.Debug("failed to reply to session", "error", rerr)
+		}
+	}
+	return err
+}
+
+// isReadError reports whether err came from the connection, rather
+// than from what was read on it.
+func isReadError(err error) bool {
+	var netErr net.Error
+	return err == io.EOF || err == io.ErrUnexpectedEOF || errors.As(err, &netErr)
+}
+
+// readPacket reads a length-prefixed packet. A length over
+// common.MaxPacketSize is rejected before the packet is read.
+func readPacket(r io.Reader) ([]byte, error) {
+	var b [2]byte
+	_, err := io.ReadFull(r, b[:])
+	if err != nil {
+		return nil, err
+	}
+
+	l := int(binary.BigEndian.Uint16(b[:]))
+	if l > common.MaxPacketSize {
+		return nil, common.ErrPacketSize
+	}
+
+	packet := make([]byte, l)
+	_, err = io.ReadFull(r, packet)
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// Apply verifies a wire packet and writes its entropy to the
+// server's output.
+func (srv *Server) Apply(packet []byte) error {
+	return srv.apply(packet, srv.log())
+}
+
+// parse opens a sealed packet with the sink's keys. The lock must be
+// held.
+func (srv *Server) parse(packet []byte) (*common.Packet, error) {
+	cfg := srv.config
+	if cfg.RequireHybrid {
+		return common.ParseHybridOnlyPacket(packet, cfg.Private, cfg.KEMPrivate, srv.signer)
+	}
+	return common.ParseHybridPacket(packet, cfg.Private, cfg.KEMPrivate, srv.signer)
+}
+
+func (srv *Server) apply(packet []byte, logger *slog.Logger) error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	p, err := srv.parse(packet)
+	if err != nil {
+		srv.report(logger, nil, err)
+		return err
+	}
+	return srv.accept(p, logger)
+}
+
+// accept checks a parsed packet against the server's counter and
+// clock and writes its entropy to the output; the caller must hold
+// the server's lock.
+func (srv *Server) accept(p *common.Packet, logger *slog.Logger) error {
+	cfg := srv.config
+	var err error
+	cfg.Counter, err = common.WritePacket(clock.Or(srv.Clock), p, cfg.Drift, cfg.Counter,
+		cfg.MinChunk, cfg.MaxChunk, srv.out)
+	srv.report(logger, p, err)
+	if err != nil {
+		return err
+	}
+	return srv.storeState()
+}
+
+// report records the outcome of applying a packet in the metrics and
+// the log. The packet is nil if it couldn't be parsed.
+func (srv *Server) report(logger *slog.Logger, p *common.Packet, err error) {
+	observe(p, err, clock.Or(srv.Clock).Now())
+	if p != nil {
+		logger = logger.With("counter", p.Counter)
+	}
+
+	if err != nil {
+		logger.Warn("packet rejected", "error", err,
+			"error_class", result(err))
+		return
+	}
+	logger.Info("accepted packet", "bytes", len(p.Chunk))
+}
+
+func (srv *Server) log() *slog.Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	return slog.Default()
+}
+
+// Import applies the packets in an offline bundle, waiting rate
+// between each packet. Packets that are rejected are logged and
+// skipped; the number of packets applied is returned. If the server
+// is shut down, the import stops with ErrServerClosed.
+func (srv *Server) Import(in []byte, rate time.Duration) (int, error) {
+	if !srv.begin(nil) {
+		return 0, ErrServerClosed
+	}
+	defer srv.end(nil)
+
+	srv.lock.Lock()
+	signer := srv.signer
+	srv.lock.Unlock()
+
+	bundle, err := common.ParseBundle(in, signer)
+	if err != nil {
+		return 0, err
+	}
+
+	var applied int
+	srv.log().Info("importing bundle", "packets", len(bundle.Packets))
+	for i, packet := range bundle.Packets {
+		if i > 0 {
+			select {
+			case <-clock.Or(srv.Clock).After(rate):
+			case <-srv.done:
+				return applied, ErrServerClosed
+			}
+		}
+
+		err = srv.applyOffline(packet, bundle, srv.log().With("packet", i))
+		if err != nil {
+			continue
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+func (srv *Server) applyOffline(packet []byte, bundle *common.Bundle, logger *slog.Logger) error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	p, err := srv.parse(packet)
+	if err != nil {
+		srv.report(logger, nil, err)
+		return err
+	}
+
+	cfg := srv.config
+	cfg.Counter, err = common.WriteOfflinePacket(clock.Or(srv.Clock), p, bundle.NotBefore,
+		bundle.NotAfter, cfg.Counter, cfg.MinChunk, cfg.MaxChunk,
+		srv.out)
+	srv.report(logger, p, err)
+	if err != nil {
+		return err
+	}
+	return srv.storeState()
+}
+
+// storeState persists the configuration; the caller must hold the
+// server's lock.
+func (srv *Server) storeState() error {
+	if srv.StateFile == "" {
+		return nil
+	}
+	return srv.config.Store(srv.StateFile)
+}
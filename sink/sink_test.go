@@ -0,0 +1,594 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"code.google.com/p/go.crypto/nacl/box"
+	"github.com/kisom/entropyshare/clock"
+	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/common/crypt"
+	"github.com/kisom/entropyshare/health"
+	"github.com/kisom/entropyshare/seal"
+	"github.com/kisom/entropyshare/util"
+)
+
+func checkError(t testing.TB, err error) {
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+type testKeys struct {
+	signer *rsa.PrivateKey
+	pub    []byte
+	config *Config
+}
+
+func newTestKeys(t testing.TB) *testKeys {
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	checkError(t, err)
+
+	spub, err := x509.MarshalPKIXPublicKey(&signer.PublicKey)
+	checkError(t, err)
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	checkError(t, err)
+
+	return &testKeys{
+		signer: signer,
+		pub:    pub[:],
+		config: &Config{
+			Address: "127.0.0.1:0",
+			Signer:  spub,
+			Private: priv[:],
+			Drift:   60,
+		},
+	}
+}
+
+func (keys *testKeys) packet(t testing.TB, counter int64) (*common.Packet, []byte) {
+	_, p, err := common.NewPacket(clock.System, counter-1, rand.Reader)
+	checkError(t, err)
+
+	out, err := common.SerialiseWire(p, keys.pub, keys.signer)
+	checkError(t, err)
+	return p, out
+}
+
+func send(t *testing.T, addr string, packet []byte) {
+	conn, err := net.Dial("tcp", addr)
+	checkError(t, err)
+	defer conn.Close()
+
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(packet)))
+	_, err = conn.Write(append(header[:], packet...))
+	checkError(t, err)
+}
+
+func TestServerPool(t *testing.T) {
+	keys := newTestKeys(t)
+	pool := NewPool(0)
+
+	srv, err := New(keys.config, pool)
+	checkError(t, err)
+
+	listener, err := net.Listen("tcp", keys.config.Address)
+	checkError(t, err)
+	go srv.Serve(listener)
+	defer listener.Close()
+
+	p, out := keys.packet(t, 1)
+	send(t, listener.Addr().String(), out)
+
+	chunk := make([]byte, len(p.Chunk))
+	_, err = io.ReadFull(pool, chunk)
+	checkError(t, err)
+
+	if !bytes.Equal(chunk, p.Chunk) {
+		t.Fatal("pool entropy doesn't match the packet's chunk")
+	}
+
+	if srv.Counter() != 1 {
+		t.Fatalf("Counter: expected 1, have %d", srv.Counter())
+	}
+
+	// A replayed packet must not add entropy to the pool.
+	err = srv.Apply(out)
+	if err != common.ErrCounter {
+		t.Fatalf("expected counter regression, have %v", err)
+	}
+
+	if pool.Len() != 0 {
+		t.Fatal("replayed packet should not have been written")
+	}
+
+	// An authentic packet carrying a broken chunk must fail the
+	// health tests.
+	out, err = common.SerialiseWire(&common.Packet{
+		Timestamp: p.Timestamp,
+		Counter:   2,
+		Chunk:     make([]byte, common.ChunkSize),
+	}, keys.pub, keys.signer)
+	checkError(t, err)
+
+	err = srv.Apply(out)
+	if !health.IsFailure(err) {
+		t.Fatalf("expected a health test failure, have %v", err)
+	}
+
+	if pool.Len() != 0 || srv.Health().Failures() != 1 {
+		t.Fatal("unhealthy chunk should have been rejected and counted")
+	}
+}
+
+func TestReload(t *testing.T) {
+	keys := newTestKeys(t)
+	pool := NewPool(0)
+
+	srv, err := New(keys.config, pool)
+	checkError(t, err)
+
+	_, out := keys.packet(t, 5)
+	checkError(t, srv.Apply(out))
+
+	// Reloading a stale configuration with new keys mustn't roll
+	// the counter back.
+	rotated := newTestKeys(t)
+	checkError(t, srv.Reload(rotated.config))
+	if srv.Counter() != 5 {
+		t.Fatalf("Counter: expected 5, have %d", srv.Counter())
+	}
+
+	_, out = keys.packet(t, 6)
+	if err = srv.Apply(out); err == nil {
+		t.Fatal("packet for the old keys should be rejected")
+	}
+
+	_, out = rotated.packet(t, 5)
+	if err = srv.Apply(out); err != common.ErrCounter {
+		t.Fatalf("expected counter regression, have %v", err)
+	}
+
+	_, out = rotated.packet(t, 6)
+	checkError(t, srv.Apply(out))
+
+	invalid := *rotated.config
+	invalid.Signer = nil
+	if err = srv.Reload(&invalid); err == nil {
+		t.Fatal("a configuration without a signer should be rejected")
+	}
+
+	invalid = *rotated.config
+	invalid.RequireHybrid = true
+	if err = srv.Reload(&invalid); err == nil {
+		t.Fatal("requiring hybrid packets without an ML-KEM key should be rejected")
+	}
+	if _, err = New(&invalid, pool); err == nil {
+		t.Fatal("a sink requiring hybrid packets without an ML-KEM key shouldn't start")
+	}
+
+	invalid = *rotated.config
+	invalid.Private = invalid.Private[:16]
+	if _, err = New(&invalid, pool); err == nil {
+		t.Fatal("a sink with a short private key shouldn't start")
+	}
+
+	// The rejected configurations left the last good one in place.
+	_, out = rotated.packet(t, 7)
+	checkError(t, srv.Apply(out))
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sink")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	keys := newTestKeys(t)
+	srv, err := New(keys.config, NewPool(0))
+	checkError(t, err)
+	srv.StateFile = filepath.Join(dir, "config.json")
+
+	listener, err := net.Listen("tcp", keys.config.Address)
+	checkError(t, err)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	_, out := keys.packet(t, 1)
+	checkError(t, srv.Apply(out))
+	checkError(t, srv.Shutdown(context.Background()))
+
+	if err = <-served; err != ErrServerClosed {
+		t.Fatalf("Serve: expected %v, have %v", ErrServerClosed, err)
+	}
+
+	cfg, err := LoadConfig(srv.StateFile)
+	checkError(t, err)
+	if cfg.Counter != 1 {
+		t.Fatalf("stored counter: expected 1, have %d", cfg.Counter)
+	}
+
+	if _, err = srv.Import(nil, 0); err != ErrServerClosed {
+		t.Fatalf("Import: expected %v, have %v", ErrServerClosed, err)
+	}
+	if err = srv.Serve(listener); err != ErrServerClosed {
+		t.Fatalf("Serve: expected %v, have %v", ErrServerClosed, err)
+	}
+}
+
+func TestConfigPrivateFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sink")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	keys := newTestKeys(t)
+	sealed, err := seal.SealKey(seal.Passphrase("correct horse"),
+		"CURVE25519 PRIVATE KEY", keys.config.Private)
+	checkError(t, err)
+
+	keyFile := filepath.Join(dir, "decrypt.key")
+	checkError(t, os.WriteFile(keyFile, sealed, 0600))
+
+	cfg := *keys.config
+	cfg.Private = nil
+	cfg.PrivateFile = keyFile
+	cfgFile := filepath.Join(dir, "config.json")
+	checkError(t, cfg.Store(cfgFile))
+
+	t.Setenv("TEST_SINK_PASSPHRASE", "correct horse")
+	util.PassphraseSpec = "env:TEST_SINK_PASSPHRASE"
+	loaded, err := LoadConfig(cfgFile)
+	checkError(t, err)
+
+	if !bytes.Equal(loaded.Private, keys.config.Private) {
+		t.Fatal("private key wasn't read from the key file")
+	}
+
+	// Storing the state mustn't write the opened key out.
+	checkError(t, loaded.Store(cfgFile))
+	out, err := os.ReadFile(cfgFile)
+	checkError(t, err)
+	if bytes.Contains(out, []byte(`"Private"`)) {
+		t.Fatal("stored configuration contains the private key")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	keys := newTestKeys(t)
+	checkError(t, keys.config.Validate())
+
+	invalid := []func(cfg *Config){
+		func(cfg *Config) { cfg.Private = cfg.Private[:16] },
+		func(cfg *Config) { cfg.Signer = cfg.Signer[1:] },
+		func(cfg *Config) { cfg.MinChunk = common.MinChunkSize - 1 },
+		func(cfg *Config) { cfg.MaxChunk = common.MaxChunkSize + 1 },
+		func(cfg *Config) { cfg.MinChunk, cfg.MaxChunk = 2048, 1024 },
+	}
+	for i, f := range invalid {
+		cfg := *keys.config
+		f(&cfg)
+		if cfg.Validate() == nil {
+			t.Fatalf("invalid configuration %d was accepted", i)
+		}
+	}
+}
+
+func TestConfigTOML(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sink")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	keys := newTestKeys(t)
+	cfg := *keys.config
+	cfg.Counter = 42
+	cfg.Outputs = []OutputConfig{{Type: OutputFile, Path: filepath.Join(dir, "out")}}
+	cfg.Admission = &AdmissionConfig{
+		Allow:    []string{"192.0.2.0/24", "2001:db8::1"},
+		Rate:     0.5,
+		MaxConns: 8,
+		Cookie:   true,
+	}
+	cfg.RequireSession = true
+	_, cfg.KEMPrivate, err = crypt.GenerateKEMKey()
+	checkError(t, err)
+	jsonFile := filepath.Join(dir, "config.json")
+	checkError(t, cfg.Store(jsonFile))
+
+	tomlFile := filepath.Join(dir, "sink.toml")
+	checkError(t, Migrate(jsonFile, tomlFile))
+	if Migrate(jsonFile, tomlFile) == nil {
+		t.Fatal("migration overwrote an existing configuration")
+	}
+
+	loaded, err := LoadConfig(tomlFile)
+	checkError(t, err)
+
+	if !bytes.Equal(loaded.Private, cfg.Private) || !bytes.Equal(loaded.Signer, cfg.Signer) {
+		t.Fatal("keys weren't carried over")
+	}
+	if loaded.Address != cfg.Address || loaded.Drift != cfg.Drift || loaded.Counter != cfg.Counter {
+		t.Fatalf("expected %+v, have %+v", cfg, *loaded)
+	}
+	if len(loaded.Outputs) != 1 || loaded.Outputs[0] != cfg.Outputs[0] {
+		t.Fatalf("outputs weren't carried over: %+v", loaded.Outputs)
+	}
+	if !reflect.DeepEqual(loaded.Admission, cfg.Admission) {
+		t.Fatalf("expected admission %+v, have %+v", cfg.Admission, loaded.Admission)
+	}
+	if !loaded.RequireSession {
+		t.Fatal("require_session wasn't carried over")
+	}
+	if !bytes.Equal(loaded.KEMPrivate, cfg.KEMPrivate) {
+		t.Fatal("the ML-KEM key wasn't carried over")
+	}
+
+	before, err := os.ReadFile(tomlFile)
+	checkError(t, err)
+
+	// Storing only updates the state file.
+	loaded.Counter++
+	checkError(t, loaded.Store(tomlFile))
+
+	after, err := os.ReadFile(tomlFile)
+	checkError(t, err)
+	if !bytes.Equal(before, after) {
+		t.Fatal("storing the state rewrote the TOML configuration")
+	}
+
+	loaded, err = LoadConfig(tomlFile)
+	checkError(t, err)
+	if loaded.Counter != cfg.Counter+1 {
+		t.Fatalf("expected counter %d, have %d", cfg.Counter+1, loaded.Counter)
+	}
+}
+
+func TestConfigTOMLFingerprint(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sink")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyDir := filepath.Join(dir, "keys")
+	checkError(t, os.Mkdir(keyDir, 0700))
+
+	keys := newTestKeys(t)
+	checkError(t, util.WritePublicKey(filepath.Join(keyDir, "source.pub"),
+		"PUBLIC KEY", keys.config.Signer, true))
+	checkError(t, util.WritePrivateKey(filepath.Join(keyDir, "decrypt.key"),
+		"CURVE25519 PRIVATE KEY", keys.config.Private, true, nil))
+
+	tomlFile := filepath.Join(dir, "sink.toml")
+	checkError(t, os.WriteFile(tomlFile, []byte(`# A hand-written configuration.
+address = ":9437"   # all interfaces
+private_key = "keys/decrypt.key"
+signer = "`+util.Fingerprint(keys.config.Signer)+`"
+key_dir = "keys"
+drift = 60
+`), 0644))
+
+	loaded, err := LoadConfig(tomlFile)
+	checkError(t, err)
+	if !bytes.Equal(loaded.Signer, keys.config.Signer) {
+		t.Fatal("signer wasn't found by its fingerprint")
+	}
+	if loaded.Counter != 0 {
+		t.Fatalf("expected a fresh counter, have %d", loaded.Counter)
+	}
+
+	checkError(t, os.WriteFile(tomlFile, []byte("adress = \":9437\"\n"), 0644))
+	if _, err = LoadConfig(tomlFile); err == nil {
+		t.Fatal("an unknown key was accepted")
+	}
+}
+
+func TestPool(t *testing.T) {
+	pool := NewPool(4)
+
+	n, err := pool.Write([]byte{1, 2, 3, 4, 5, 6})
+	checkError(t, err)
+	if n != 6 || pool.Len() != 4 {
+		t.Fatalf("pool should hold 4 bytes, has %d", pool.Len())
+	}
+
+	var buf [3]byte
+	n, err = pool.Read(buf[:])
+	checkError(t, err)
+	if n != 3 || !bytes.Equal(buf[:], []byte{1, 2, 3}) {
+		t.Fatalf("unexpected read from pool: %x", buf[:n])
+	}
+
+	pool.Close()
+	n, err = pool.Read(buf[:])
+	checkError(t, err)
+	if n != 1 || buf[0] != 4 {
+		t.Fatalf("unexpected read from pool: %x", buf[:n])
+	}
+
+	_, err = pool.Read(buf[:])
+	if err != io.EOF {
+		t.Fatal("closed, drained pool should return io.EOF")
+	}
+}
+
+func TestReceiveOversized(t *testing.T) {
+	keys := newTestKeys(t)
+	srv, err := New(keys.config, ioutil.Discard)
+	checkError(t, err)
+
+	client, conn := net.Pipe()
+	go func() {
+		var header [2]byte
+		binary.BigEndian.PutUint16(header[:], common.MaxPacketSize+1)
+		client.Write(header[:])
+		client.Close()
+	}()
+
+	if err = srv.Receive(conn); err != common.ErrPacketSize {
+		t.Fatalf("expected %v, have %v", common.ErrPacketSize, err)
+	}
+}
+
+func TestReceiveSession(t *testing.T) {
+	keys := newTestKeys(t)
+	keys.config.RequireSession = true
+	srv, err := New(keys.config, ioutil.Discard)
+	checkError(t, err)
+
+	sendSession := func(p *common.Packet) (error, error) {
+		source, conn := net.Pipe()
+		received := make(chan error, 1)
+		go func() { received <- srv.Receive(conn) }()
+
+		err := common.SendSession(source, p, keys.pub, keys.signer)
+		source.Close()
+		return err, <-received
+	}
+
+	p, packet := keys.packet(t, 1)
+	sent, received := sendSession(p)
+	checkError(t, sent)
+	checkError(t, received)
+	if srv.Counter() != 1 {
+		t.Fatalf("Counter: expected 1, have %d", srv.Counter())
+	}
+
+	// A replayed packet is rejected, and the source is told why.
+	sent, received = sendSession(p)
+	if received != common.ErrCounter || !errors.Is(sent, common.ErrRejected) {
+		t.Fatalf("expected %v, have %v and %v", common.ErrCounter, sent, received)
+	}
+
+	// A packet outside a session isn't read.
+	client, conn := net.Pipe()
+	go func() {
+		client.Write(framePacket(packet))
+		client.Close()
+	}()
+	if err = srv.Receive(conn); err != ErrSessionRequired {
+		t.Fatalf("expected %v, have %v", ErrSessionRequired, err)
+	}
+}
+
+func TestApplyHybrid(t *testing.T) {
+	keys := newTestKeys(t)
+	kemPub, kemPriv, err := crypt.GenerateKEMKey()
+	checkError(t, err)
+	keys.config.KEMPrivate = kemPriv
+	srv, err := New(keys.config, ioutil.Discard)
+	checkError(t, err)
+
+	_, p, err := common.NewPacket(clock.System, 0, rand.Reader)
+	checkError(t, err)
+	packet, err := common.SerialiseHybridWire(p, keys.pub, kemPub, keys.signer)
+	checkError(t, err)
+	checkError(t, srv.Apply(packet))
+
+	// Packets sealed to the Curve25519 key alone are still accepted.
+	_, packet = keys.packet(t, 2)
+	checkError(t, srv.Apply(packet))
+	if srv.Counter() != 2 {
+		t.Fatalf("Counter: expected 2, have %d", srv.Counter())
+	}
+
+	// Once hybrid packets are required, they're the only ones
+	// accepted, in or out of a session.
+	keys.config.RequireHybrid = true
+	srv, err = New(keys.config, ioutil.Discard)
+	checkError(t, err)
+
+	p, packet = keys.packet(t, 3)
+	if err = srv.Apply(packet); err != common.ErrHybridRequired {
+		t.Fatalf("expected %v, have %v", common.ErrHybridRequired, err)
+	}
+
+	source, conn := net.Pipe()
+	go func() {
+		common.SendSession(source, p, keys.pub, keys.signer)
+		source.Close()
+	}()
+	if err = srv.Receive(conn); err != common.ErrHybridRequired {
+		t.Fatalf("expected %v, have %v", common.ErrHybridRequired, err)
+	}
+	conn.Close()
+
+	packet, err = common.SerialiseHybridWire(p, keys.pub, kemPub, keys.signer)
+	checkError(t, err)
+	checkError(t, srv.Apply(packet))
+
+	keys.config.RequireSession = true
+	if keys.config.Validate() == nil {
+		t.Fatal("requiring both sessions and hybrid packets should be rejected")
+	}
+	keys.config.RequireSession = false
+
+	keys.config.KEMPrivate = nil
+	if keys.config.Validate() == nil {
+		t.Fatal("requiring hybrid packets without an ML-KEM key should be rejected")
+	}
+
+	keys.config.KEMPrivate = kemPriv[1:]
+	if keys.config.Validate() == nil {
+		t.Fatal("an invalid ML-KEM key should be rejected")
+	}
+}
+
+// framePacket prepends the length header to a packet.
+func framePacket(packet []byte) []byte {
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(packet)))
+	return append(header[:], packet...)
+}
+
+func FuzzReceive(f *testing.F) {
+	keys := newTestKeys(f)
+	srv, err := New(keys.config, ioutil.Discard)
+	checkError(f, err)
+
+	_, packet := keys.packet(f, 1)
+	f.Add(framePacket(packet))
+	f.Add(framePacket(packet)[:len(packet)/2])
+	f.Add([]byte{0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		packet, err := readPacket(bytes.NewReader(in))
+		if err != nil {
+			return
+		}
+
+		if len(packet) > common.MaxPacketSize {
+			t.Fatalf("read a %d byte packet", len(packet))
+		}
+		srv.Apply(packet)
+	})
+}
+
+func FuzzParseConfig(f *testing.F) {
+	keys := newTestKeys(f)
+	in, err := json.Marshal(keys.config)
+	checkError(f, err)
+	f.Add(in)
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		cfg, err := parseConfig(in)
+		if err != nil {
+			return
+		}
+		cfg.Validate()
+	})
+}
@@ -0,0 +1,352 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kisom/entropyshare/common/crypt"
+	"github.com/kisom/entropyshare/toml"
+	"github.com/kisom/entropyshare/util"
+)
+
+// tomlConfig is the layout of a TOML sink configuration.
+type tomlConfig struct {
+	Address       string           `toml:"address"`
+	PrivateKey    string           `toml:"private_key"`
+	KEMPrivateKey string           `toml:"kem_private_key"`
+	Signer        string           `toml:"signer"`
+	KeyDir        string           `toml:"key_dir"`
+	State         string           `toml:"state"`
+	Drift         int64            `toml:"drift"`
+	MinChunk      int              `toml:"min_chunk"`
+	MaxChunk      int              `toml:"max_chunk"`
+	HealthEntropy float64          `toml:"health_entropy"`
+	Outputs       []OutputConfig   `toml:"outputs"`
+	Relay         *RelayConfig     `toml:"relay"`
+	Admission     *AdmissionConfig `toml:"admission"`
+
+	RequireSession bool `toml:"require_session"`
+	RequireHybrid  bool `toml:"require_hybrid"`
+}
+
+// configState is the part of a configuration that the sink changes
+// as it runs, kept in the state file beside a TOML configuration.
+type configState struct {
+	Counter int64
+}
+
+func isTOML(path string) bool {
+	return filepath.Ext(path) == ".toml"
+}
+
+// stateFile returns the path of the state file for a TOML
+// configuration: the one it names, or else the configuration's path
+// with a .state extension.
+func stateFile(filespec, state string) string {
+	if state != "" {
+		return util.ResolvePath(filepath.Dir(filespec), state)
+	}
+	return strings.TrimSuffix(filespec, filepath.Ext(filespec)) + ".state"
+}
+
+// LoadTOML reads a TOML sink configuration, which refers to its keys
+// rather than holding them: private_key is the path to the private
+// key, and signer is the path to the source's public key or its
+// fingerprint (as given by util.Fingerprint) among the keys in
+// key_dir. Relative paths are taken from the file's directory. The
+// counter is read from the state file, which is created as the sink
+// runs.
+func LoadTOML(filespec string) (*Config, error) {
+	in, err := ioutil.ReadFile(filespec)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tomlConfig
+	if err = toml.Unmarshal(in, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", filespec, err)
+	}
+
+	if file.PrivateKey == "" {
+		return nil, errors.New("sink: no private_key given")
+	} else if file.Signer == "" {
+		return nil, errors.New("sink: no signer given")
+	}
+
+	dir := filepath.Dir(filespec)
+	keyDir := dir
+	if file.KeyDir != "" {
+		keyDir = util.ResolvePath(dir, file.KeyDir)
+	}
+
+	cfg := &Config{
+		Address:        file.Address,
+		Drift:          file.Drift,
+		MinChunk:       file.MinChunk,
+		MaxChunk:       file.MaxChunk,
+		Outputs:        file.Outputs,
+		Relay:          file.Relay,
+		HealthEntropy:  file.HealthEntropy,
+		Admission:      file.Admission,
+		RequireSession: file.RequireSession,
+		RequireHybrid:  file.RequireHybrid,
+		PrivateFile:    util.ResolvePath(dir, file.PrivateKey),
+		stateFile:      stateFile(filespec, file.State),
+	}
+
+	for i := range cfg.Outputs {
+		cfg.Outputs[i].Path = util.ResolvePath(dir, cfg.Outputs[i].Path)
+	}
+
+	if cfg.Relay != nil {
+		cfg.Relay.SignerKey = util.ResolvePath(dir, cfg.Relay.SignerKey)
+		cfg.Relay.Targets = util.ResolvePath(dir, cfg.Relay.Targets)
+		cfg.Relay.SeedFile = util.ResolvePath(dir, cfg.Relay.SeedFile)
+	}
+
+	cfg.Signer, err = util.FindPublicKey(file.Signer, keyDir, "PUBLIC KEY", "RSA PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cfg.readPrivateFile(); err != nil {
+		return nil, err
+	}
+
+	if file.KEMPrivateKey != "" {
+		cfg.KEMPrivateFile = util.ResolvePath(dir, file.KEMPrivateKey)
+		if err = cfg.readKEMPrivateFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	in, err = ioutil.ReadFile(cfg.stateFile)
+	if err == nil {
+		var state configState
+		if err = json.Unmarshal(in, &state); err != nil {
+			return nil, fmt.Errorf("%s: %v", cfg.stateFile, err)
+		}
+		cfg.Counter = state.Counter
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// writeState writes the configuration's state file.
+func (cfg *Config) writeState() error {
+	out, err := json.Marshal(&configState{Counter: cfg.Counter})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfg.stateFile, out, 0644)
+}
+
+// writeKey writes a key to path, encoded as out, unless the file
+// already holds it; it is an error for the file to hold anything else.
+func writeKey(path string, key, out []byte, perm os.FileMode, keyTypes ...string) error {
+	existing, err := util.ReadPublicKey(path, keyTypes...)
+	if err == nil {
+		if !bytes.Equal(existing, key) {
+			return fmt.Errorf("sink: %s already holds a different key", path)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("sink: %s: %v", path, err)
+	}
+	return ioutil.WriteFile(path, out, perm)
+}
+
+// absPath makes a path given relative to the working directory
+// absolute, so that it still names the same file from a TOML file.
+func absPath(path string) string {
+	if path == "" {
+		return path
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+// WriteTOML writes the configuration to filespec as TOML, with its
+// counter in a state file beside it. Keys that the configuration
+// holds rather than refers to are written to decrypt.key, kem.key,
+// and signer.pub in the same directory.
+func (cfg *Config) WriteTOML(filespec string) error {
+	dir := filepath.Dir(filespec)
+
+	privateFile := absPath(cfg.PrivateFile)
+	if privateFile == "" {
+		privateFile = "decrypt.key"
+		err := writeKey(filepath.Join(dir, privateFile), cfg.Private, cfg.Private,
+			0600, "CURVE25519 PRIVATE KEY")
+		if err != nil {
+			return err
+		}
+	}
+
+	kemFile := absPath(cfg.KEMPrivateFile)
+	if kemFile == "" && cfg.KEMPrivate != nil {
+		kemFile = "kem.key"
+		err := writeKey(filepath.Join(dir, kemFile), cfg.KEMPrivate, cfg.KEMPrivate,
+			0600, "ML-KEM-768 PRIVATE KEY")
+		if err != nil {
+			return err
+		}
+	}
+
+	signer := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: cfg.Signer})
+	err := writeKey(filepath.Join(dir, "signer.pub"), cfg.Signer, signer,
+		0644, "PUBLIC KEY", "RSA PUBLIC KEY")
+	if err != nil {
+		return err
+	}
+
+	state := strings.TrimSuffix(filepath.Base(filespec), filepath.Ext(filespec)) + ".state"
+	stored := *cfg
+	stored.stateFile = filepath.Join(dir, state)
+	if err = stored.writeState(); err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, `# entropyshare sink configuration.
+#
+# Relative paths are taken from this file's directory. The signer may
+# also be given as the sha256: fingerprint of one of the keys in
+# key_dir. The packet counter is kept in the state file, which the
+# sink rewrites as it runs.
+
+address = %s
+private_key = %s
+# %s
+signer = "signer.pub"
+state = %s
+drift = %d
+`, toml.Quote(cfg.Address), toml.Quote(privateFile), util.Fingerprint(cfg.Signer),
+		toml.Quote(state), cfg.Drift)
+
+	if cfg.MinChunk != 0 {
+		fmt.Fprintf(buf, "min_chunk = %d\n", cfg.MinChunk)
+	}
+	if cfg.MaxChunk != 0 {
+		fmt.Fprintf(buf, "max_chunk = %d\n", cfg.MaxChunk)
+	}
+	if cfg.HealthEntropy != 0 {
+		fmt.Fprintf(buf, "health_entropy = %s\n", strconv.FormatFloat(cfg.HealthEntropy, 'g', -1, 64))
+	}
+	if kemFile != "" {
+		fmt.Fprintf(buf, "kem_private_key = %s\n", toml.Quote(kemFile))
+	}
+	if cfg.RequireSession {
+		buf.WriteString("require_session = true\n")
+	}
+	if cfg.RequireHybrid {
+		buf.WriteString("require_hybrid = true\n")
+	}
+
+	for _, out := range cfg.Outputs {
+		fmt.Fprintf(buf, "\n[[outputs]]\ntype = %s\n", toml.Quote(out.Type))
+		if out.Path != "" {
+			fmt.Fprintf(buf, "path = %s\n", toml.Quote(absPath(out.Path)))
+		}
+		if out.Credit != 0 {
+			fmt.Fprintf(buf, "credit = %d\n", out.Credit)
+		}
+		if out.URL != "" {
+			fmt.Fprintf(buf, "url = %s\n", toml.Quote(out.URL))
+		}
+	}
+
+	if relay := cfg.Relay; relay != nil {
+		fmt.Fprintf(buf, "\n[relay]\nsigner_key = %s\ntargets = %s\n",
+			toml.Quote(absPath(relay.SignerKey)), toml.Quote(absPath(relay.Targets)))
+		if relay.SeedFile != "" {
+			fmt.Fprintf(buf, "seed_file = %s\n", toml.Quote(absPath(relay.SeedFile)))
+		}
+		if relay.TPM {
+			fmt.Fprintf(buf, "tpm = true\n")
+		}
+	}
+
+	if cfg.Admission != nil {
+		writeAdmission(buf, cfg.Admission)
+	}
+	return ioutil.WriteFile(filespec, buf.Bytes(), 0644)
+}
+
+// writeAdmission writes the [admission] table for a to buf, leaving
+// out the settings that are at their defaults.
+func writeAdmission(buf *bytes.Buffer, a *AdmissionConfig) {
+	buf.WriteString("\n[admission]\n")
+	for _, list := range []struct {
+		key   string
+		addrs []string
+	}{{"allow", a.Allow}, {"deny", a.Deny}} {
+		if len(list.addrs) == 0 {
+			continue
+		}
+
+		quoted := make([]string, len(list.addrs))
+		for i, addr := range list.addrs {
+			quoted[i] = toml.Quote(addr)
+		}
+		fmt.Fprintf(buf, "%s = [%s]\n", list.key, strings.Join(quoted, ", "))
+	}
+
+	if a.Rate != 0 {
+		fmt.Fprintf(buf, "rate = %s\n", strconv.FormatFloat(a.Rate, 'g', -1, 64))
+	}
+	if a.Burst != 0 {
+		fmt.Fprintf(buf, "burst = %d\n", a.Burst)
+	}
+	if a.MaxConns != 0 {
+		fmt.Fprintf(buf, "max_conns = %d\n", a.MaxConns)
+	}
+	if a.MaxConnsPerAddress != 0 {
+		fmt.Fprintf(buf, "max_conns_per_address = %d\n", a.MaxConnsPerAddress)
+	}
+	if a.Timeout != 0 {
+		fmt.Fprintf(buf, "timeout = %d\n", a.Timeout)
+	}
+	if a.Cookie {
+		buf.WriteString("cookie = true\n")
+	}
+}
+
+// Migrate converts the JSON configuration in from to a TOML
+// configuration in to, as WriteTOML describes. The private keys
+// aren't read, so a sealed key needn't be opened.
+func Migrate(from, to string) error {
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("sink: %s already exists", to)
+	}
+
+	in, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := parseConfig(in)
+	if err != nil {
+		return err
+	}
+
+	if cfg.PrivateFile == "" && len(cfg.Private) != 32 {
+		return errors.New("sink: invalid private key")
+	} else if cfg.KEMPrivate != nil && len(cfg.KEMPrivate) != crypt.KEMPrivateKeySize {
+		return errors.New("sink: invalid ML-KEM private key")
+	}
+	return cfg.WriteTOML(to)
+}
@@ -0,0 +1,131 @@
+// Package systemd implements the parts of the systemd service
+// protocol used by the daemons, without linking against libsystemd:
+// socket activation, readiness notification, and the service
+// watchdog.
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States that may be sent with Notify.
+const (
+	Ready     = "READY=1"
+	Reloading = "RELOADING=1"
+	Stopping  = "STOPPING=1"
+	Watchdog  = "WATCHDOG=1"
+)
+
+// listenFDsStart is the first file descriptor passed for socket
+// activation.
+const listenFDsStart = 3
+
+var (
+	// ErrListenFDs is returned if the socket activation
+	// environment is malformed.
+	ErrListenFDs = errors.New("systemd: invalid LISTEN_FDS")
+
+	// ErrWatchdog is returned if the watchdog environment is
+	// malformed.
+	ErrWatchdog = errors.New("systemd: invalid WATCHDOG_USEC")
+)
+
+// Listeners returns the listening sockets passed to the process by
+// systemd for socket activation. If the process wasn't socket
+// activated, no listeners are returned. The activation environment
+// variables are unset, so that they aren't inherited by children.
+func Listeners() ([]net.Listener, error) {
+	return listeners(listenFDsStart)
+}
+
+func listeners(start int) ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, ErrListenFDs
+	}
+
+	var ls []net.Listener
+	for fd := start; fd < start+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+
+		// FileListener duplicates the descriptor, so the
+		// original is closed either way.
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// Notify sends a state, such as Ready, to the service manager. It
+// returns false if the process wasn't started with a notification
+// socket, in which case nothing is sent.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+
+	// A leading @ names a socket in the abstract namespace.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval within which the service
+// manager expects a Watchdog notification, or 0 if the watchdog
+// isn't enabled for this process. Heartbeats should be sent at
+// half this interval.
+func WatchdogInterval() (time.Duration, error) {
+	s := os.Getenv("WATCHDOG_USEC")
+	if s == "" {
+		return 0, nil
+	}
+
+	if p := os.Getenv("WATCHDOG_PID"); p != "" {
+		pid, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, ErrWatchdog
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	usec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, ErrWatchdog
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
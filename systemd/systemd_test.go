@@ -0,0 +1,136 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	sent, err := Notify(Ready)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !sent {
+		t.Fatal("notification wasn't sent")
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(buf[:n]) != Ready {
+		t.Fatalf("expected %q, have %q", Ready, buf[:n])
+	}
+}
+
+func TestNotifyDisabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := Notify(Ready)
+	if sent || err != nil {
+		t.Fatalf("expected nothing to be sent, have %v, %v", sent, err)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// listeners takes ownership of the descriptor it is passed.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Listeners for another process are ignored.
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	ls, err := listeners(fd)
+	if err != nil || len(ls) != 0 {
+		t.Fatalf("expected no listeners, have %d, %v", len(ls), err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	ls, err = listeners(fd)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(ls) != 1 {
+		t.Fatalf("expected 1 listener, have %d", len(ls))
+	}
+	defer ls[0].Close()
+
+	if ls[0].Addr().String() != l.Addr().String() {
+		t.Fatalf("expected a listener on %s, have %s", l.Addr(), ls[0].Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("the activation environment should be unset")
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := ls[0].Accept()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	conn.Close()
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	interval, err := WatchdogInterval()
+	if interval != 0 || err != nil {
+		t.Fatalf("expected no watchdog, have %v, %v", interval, err)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	interval, err = WatchdogInterval()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if interval != 30*time.Second {
+		t.Fatalf("expected 30s, have %v", interval)
+	}
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	interval, err = WatchdogInterval()
+	if interval != 0 || err != nil {
+		t.Fatalf("expected no watchdog, have %v, %v", interval, err)
+	}
+
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "soon")
+	if _, err = WatchdogInterval(); err != ErrWatchdog {
+		t.Fatalf("expected %v, have %v", ErrWatchdog, err)
+	}
+}
@@ -5,70 +5,264 @@ import (
 	"crypto/rsa"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
+	"time"
 
+	"github.com/kisom/entropyshare/clock"
 	"github.com/kisom/entropyshare/common"
+	"github.com/kisom/entropyshare/logging"
+	"github.com/kisom/entropyshare/metrics"
 	"github.com/kisom/entropyshare/prng"
 )
 
 type Target struct {
-	Address string
-	Public  []byte
-	Counter int64
-	Next    int64
+	Address   string
+	Public    []byte
+	Counter   int64
+	Next      int64
+	ChunkSize int  `json:",omitempty"`
+	Paused    bool `json:",omitempty"`
+
+	// Cookie is set for sinks that require a cookie: the cookie
+	// the sink sends on connecting is echoed before the packet.
+	Cookie bool `json:",omitempty"`
+
+	// Session delivers packets in a session with the sink, whose
+	// keys are forgotten once it ends, rather than sealing them to
+	// the sink's key; see common.SendSession.
+	Session bool `json:",omitempty"`
+
+	// KEMPublic is the sink's ML-KEM-768 public key. If it is
+	// set, packets are sealed with a key agreed with both it and
+	// Public, so that they stay secret unless both are broken.
+	// Sessions don't use the ML-KEM key, so it can't be set with
+	// Session.
+	KEMPublic []byte `json:",omitempty"`
 }
 
-func (t *Target) Send(signer *rsa.PrivateKey) (err error) {
+// ErrSessionKEM is returned for a target with both Session and
+// KEMPublic set: a session's handshake only uses X25519, so it would
+// quietly drop the protection the ML-KEM key was given for.
+var ErrSessionKEM = errors.New("target: sessions can't be used with an ML-KEM key")
+
+// sendTimeout bounds the time taken to deliver a packet, including
+// waiting for a sink's cookie.
+const sendTimeout = 30 * time.Second
+
+var (
+	packetsSent = metrics.NewCounter("entropyshare_source_packets_sent_total",
+		"Packets sent to each target, by result.", "target", "result")
+	bytesSent = metrics.NewCounter("entropyshare_source_bytes_sent_total",
+		"Bytes of entropy delivered to each target.", "target")
+)
+
+// Send generates the target's next packet, stamped with the time from
+// clk, and delivers it.
+func (t *Target) Send(clk clock.Clock, signer *rsa.PrivateKey) (err error) {
 	var packet *common.Packet
-	t.Counter, packet, err = common.NewPacket(t.Counter, prng.PRNG)
+	defer func() {
+		if err != nil {
+			packetsSent.Inc(t.Address, "error")
+			return
+		}
+		packetsSent.Inc(t.Address, "ok")
+		bytesSent.Add(float64(len(packet.Chunk)), t.Address)
+	}()
+
+	if t.Session && t.KEMPublic != nil {
+		err = ErrSessionKEM
+		return
+	}
+
+	t.Counter, packet, err = common.NewSizedPacket(clk, t.Counter, t.ChunkSize, prng.PRNG)
 	if err != nil {
 		return
 	}
 
-	out, err := common.SerialiseWire(packet, t.Public, signer)
+	if t.Session {
+		err = t.sendSession(packet, signer)
+		return
+	}
+
+	out, err := t.seal(packet, signer)
 	if err != nil {
 		return
 	}
 
-	log.Printf("sending %d byte packet", len(out))
+	slog.Debug("sending packet", "target", t.Address,
+		"counter", t.Counter, "bytes", len(out))
 	var header [2]byte
 	binary.BigEndian.PutUint16(header[:], uint16(len(out)))
 
-	conn, err := net.Dial("tcp", t.Address)
+	conn, err := t.dial()
 	if err != nil {
 		return
 	}
+	defer conn.Close()
 
-	if _, err = conn.Write(header[:]); err != nil {
-		return
+	var msg []byte
+	if t.Cookie {
+		msg = make([]byte, common.CookieSize)
+		if _, err = io.ReadFull(conn, msg); err != nil {
+			return
+		}
 	}
 
-	if _, err = conn.Write(out); err != nil {
+	msg = append(msg, header[:]...)
+	if _, err = conn.Write(append(msg, out...)); err != nil {
 		return
 	}
+	return nil
+}
+
+// seal packs and encrypts a packet for the target, with the hybrid
+// key agreement if the target has an ML-KEM key.
+func (t *Target) seal(packet *common.Packet, signer *rsa.PrivateKey) ([]byte, error) {
+	if t.KEMPublic != nil {
+		return common.SerialiseHybridWire(packet, t.Public, t.KEMPublic, signer)
+	}
+	return common.SerialiseWire(packet, t.Public, signer)
+}
+
+// sendSession delivers the packet in a session.
+func (t *Target) sendSession(packet *common.Packet, signer *rsa.PrivateKey) error {
+	slog.Debug("sending packet in a session", "target", t.Address,
+		"counter", t.Counter, "bytes", len(packet.Chunk))
+	conn, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	conn.Close()
+	if t.Cookie {
+		cookie := make([]byte, common.CookieSize)
+		if _, err = io.ReadFull(conn, cookie); err != nil {
+			return err
+		}
+		if _, err = conn.Write(cookie); err != nil {
+			return err
+		}
+	}
+	return common.SendSession(conn, packet, t.Public, signer)
+}
+
+// dial connects to the target, with a deadline of sendTimeout for
+// the delivery.
+func (t *Target) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", t.Address, sendTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+	return conn, nil
+}
+
+// Bundle generates count packets for the target, to be delivered
+// offline, and packs them into a signed bundle that is valid for
+// validity seconds from the time given by clk. The target's counter
+// is advanced past the bundled packets so that later network
+// deliveries aren't rejected.
+func (t *Target) Bundle(clk clock.Clock, signer *rsa.PrivateKey, count int, validity int64) ([]byte, error) {
+	now := clk.Now().Unix()
+	b := &common.Bundle{
+		NotBefore: now,
+		NotAfter:  now + validity,
+	}
+
+	counter := t.Counter
+	for i := 0; i < count; i++ {
+		var packet *common.Packet
+		var err error
+		counter, packet, err = common.NewSizedPacket(clk, counter, t.ChunkSize, prng.PRNG)
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := t.seal(packet, signer)
+		if err != nil {
+			return nil, err
+		}
+		b.Packets = append(b.Packets, out)
+	}
+
+	out, err := common.SerialiseBundle(b, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Counter = counter
+	return out, nil
+}
+
+// Find returns the target with the given address, or nil if there is
+// no such target.
+func Find(targets []*Target, address string) *Target {
+	for _, t := range targets {
+		if t.Address == address {
+			return t
+		}
+	}
 	return nil
 }
 
 func Load(fileName string) []*Target {
-	var targets = []*Target{}
+	targets, err := Read(fileName)
+	if err != nil {
+		logging.Fatal("failed to load targets", "file", fileName, "error", err)
+	}
+	return targets
+}
+
+// Read parses the targets file; unlike Load, it returns an error
+// rather than exiting if the file can't be read. A file ending in
+// .toml is read as TOML, with the targets' state in a separate state
+// file; any other is read as JSON.
+func Read(fileName string) ([]*Target, error) {
+	if isTOML(fileName) {
+		return readTOML(fileName)
+	}
+
 	in, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return nil, err
 	}
+	return parseTargets(in)
+}
 
-	err = json.Unmarshal(in, &targets)
+// parseTargets decodes a JSON targets file. Every entry must have an
+// address; a null entry or one without an address is rejected rather
+// than left for the scheduler to trip over, as is one that asks for
+// both a session and the hybrid key agreement.
+func parseTargets(in []byte) ([]*Target, error) {
+	var targets = []*Target{}
+	err := json.Unmarshal(in, &targets)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return nil, err
 	}
 
-	return targets
+	for _, t := range targets {
+		if t == nil || t.Address == "" {
+			return nil, errors.New("target: a target has no address")
+		} else if t.Session && t.KEMPublic != nil {
+			return nil, fmt.Errorf("%s: %w", t.Address, ErrSessionKEM)
+		}
+	}
+	return targets, nil
 }
 
+// Store writes the targets to the targets file. For a TOML file, only
+// the state file is rewritten, and new targets are appended to the
+// TOML file; removing a target listed there returns ErrStaticTarget.
 func Store(fileName string, targets []*Target) (err error) {
+	if isTOML(fileName) {
+		return storeTOML(fileName, targets)
+	}
+
 	out, err := json.Marshal(targets)
 	if err != nil {
 		return
@@ -0,0 +1,47 @@
+package target
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	targets, err := parseTargets([]byte(`[{"Address": "127.0.0.1:4141", "Counter": 3}]`))
+	checkError(t, err)
+	if len(targets) != 1 || targets[0].Counter != 3 {
+		t.Fatalf("bad targets %+v", targets)
+	}
+
+	for _, in := range []string{`[null]`, `[{"Counter": 1}]`,
+		`[{"Address": "127.0.0.1:4141", "Session": true, "KEMPublic": "AAAA"}]`} {
+		if _, err = parseTargets([]byte(in)); err == nil {
+			t.Fatalf("%s should be rejected", in)
+		}
+	}
+}
+
+func FuzzParseTargets(f *testing.F) {
+	in, err := json.Marshal([]*Target{
+		{Address: "127.0.0.1:4141", Public: testKey(1), Counter: 41},
+		{Address: "[::1]:4141", Public: testKey(2), ChunkSize: 256, Paused: true},
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(in)
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		targets, err := parseTargets(in)
+		if err != nil {
+			return
+		}
+
+		for _, tgt := range targets {
+			if tgt == nil || tgt.Address == "" {
+				t.Fatal("accepted a target without an address")
+			} else if tgt.Session && tgt.KEMPublic != nil {
+				t.Fatal("accepted a session target with an ML-KEM key")
+			}
+		}
+	})
+}
@@ -0,0 +1,290 @@
+package target
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kisom/entropyshare/toml"
+	"github.com/kisom/entropyshare/util"
+)
+
+// ErrStaticTarget is returned when storing targets would remove one
+// that is listed in a TOML targets file, which is only edited by
+// hand.
+var ErrStaticTarget = errors.New("target: targets listed in a TOML file must be removed from it by hand")
+
+// tomlHeader begins a TOML targets file written by Store.
+const tomlHeader = `# entropyshare targets.
+#
+# Each [[target]] is a sink that entropy is sent to. Relative paths are
+# taken from this file's directory, and public_key may also be given
+# as the sha256: fingerprint of one of the keys in key_dir. Counters,
+# update times, and pauses are kept in the state file, which the
+# source rewrites as it runs.
+`
+
+// tomlTargets is the layout of a TOML targets file.
+type tomlTargets struct {
+	State   string       `toml:"state"`
+	KeyDir  string       `toml:"key_dir"`
+	Targets []tomlTarget `toml:"target"`
+}
+
+type tomlTarget struct {
+	Address   string `toml:"address"`
+	PublicKey string `toml:"public_key"`
+	ChunkSize int    `toml:"chunk_size"`
+	Cookie    bool   `toml:"cookie"`
+	Session   bool   `toml:"session"`
+
+	KEMPublicKey string `toml:"kem_public_key"`
+}
+
+// targetState is the part of a target that the source changes as it
+// runs, kept in the state file beside a TOML targets file.
+type targetState struct {
+	Counter int64
+	Next    int64
+	Paused  bool `json:",omitempty"`
+}
+
+func isTOML(path string) bool {
+	return filepath.Ext(path) == ".toml"
+}
+
+// readTOMLFile parses a TOML targets file, returning the paths of its
+// state file and key directory.
+func readTOMLFile(fileName string) (file *tomlTargets, state, keyDir string, err error) {
+	in, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+
+	file = &tomlTargets{}
+	if err = toml.Unmarshal(in, file); err != nil {
+		err = fmt.Errorf("%s: %v", fileName, err)
+		return
+	}
+
+	dir := filepath.Dir(fileName)
+	state = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".state"
+	if file.State != "" {
+		state = util.ResolvePath(dir, file.State)
+	}
+
+	keyDir = dir
+	if file.KeyDir != "" {
+		keyDir = util.ResolvePath(dir, file.KeyDir)
+	}
+	return
+}
+
+// readState reads a state file; a missing one holds no state.
+func readState(path string) (map[string]*targetState, error) {
+	states := map[string]*targetState{}
+	in, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(in, &states); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return states, nil
+}
+
+// readTOML reads a TOML targets file. Each [[target]] gives its
+// address, its public_key as a path or as a fingerprint among the
+// keys in key_dir, and optionally its chunk_size. Counters, update
+// times, and pauses are read from the state file.
+func readTOML(fileName string) ([]*Target, error) {
+	file, state, keyDir, err := readTOMLFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := readState(state)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []*Target{}
+	for _, tt := range file.Targets {
+		if tt.Address == "" {
+			return nil, fmt.Errorf("%s: a target has no address", fileName)
+		} else if tt.Session && tt.KEMPublicKey != "" {
+			return nil, fmt.Errorf("%s: %w", tt.Address, ErrSessionKEM)
+		}
+
+		t := &Target{Address: tt.Address, ChunkSize: tt.ChunkSize, Cookie: tt.Cookie,
+			Session: tt.Session}
+		t.Public, err = util.FindPublicKey(tt.PublicKey, keyDir, "CURVE25519 PUBLIC KEY")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", tt.Address, err)
+		}
+
+		if tt.KEMPublicKey != "" {
+			t.KEMPublic, err = util.FindPublicKey(tt.KEMPublicKey, keyDir, "ML-KEM-768 PUBLIC KEY")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", tt.Address, err)
+			}
+		}
+
+		if st := states[t.Address]; st != nil {
+			t.Counter, t.Next, t.Paused = st.Counter, st.Next, st.Paused
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// keyFileName returns the name a target's public key is written to.
+func keyFileName(address string) string {
+	return strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(address) + ".pub"
+}
+
+// kemKeyFileName returns the name a target's ML-KEM key is written
+// to.
+func kemKeyFileName(address string) string {
+	return strings.TrimSuffix(keyFileName(address), ".pub") + ".kem.pub"
+}
+
+// appendTarget writes the [[target]] entry for t to buf. The target's
+// ML-KEM key is left out unless kemRef is set.
+func appendTarget(buf *bytes.Buffer, t *Target, keyRef, kemRef string) {
+	fmt.Fprintf(buf, "\n[[target]]\naddress = %s\npublic_key = %s\n",
+		toml.Quote(t.Address), toml.Quote(keyRef))
+	if kemRef != "" {
+		fmt.Fprintf(buf, "kem_public_key = %s\n", toml.Quote(kemRef))
+	}
+	if t.ChunkSize != 0 {
+		fmt.Fprintf(buf, "chunk_size = %d\n", t.ChunkSize)
+	}
+	if t.Cookie {
+		fmt.Fprintf(buf, "cookie = true\n")
+	}
+	if t.Session {
+		fmt.Fprintf(buf, "session = true\n")
+	}
+}
+
+// writeKey writes one of a target's public keys to the named file in
+// the key directory, returning its path relative to the TOML file's
+// directory. A file already holding the key, such as one left behind
+// by a store that failed, is kept; any other file isn't replaced.
+func writeKey(dir, keyDir, name, keyType string, key []byte) (string, error) {
+	path := filepath.Join(keyDir, name)
+	out := pem.EncodeToMemory(&pem.Block{Type: keyType, Bytes: key})
+	if existing, err := ioutil.ReadFile(path); err == nil {
+		if !bytes.Equal(existing, out) {
+			return "", fmt.Errorf("target: %s already exists", path)
+		}
+	} else if err = ioutil.WriteFile(path, out, 0644); err != nil {
+		return "", err
+	}
+
+	if rel, err := filepath.Rel(dir, path); err == nil {
+		return rel, nil
+	}
+	return path, nil
+}
+
+// storeTOML writes the targets' state to the state file. Targets that
+// aren't yet in the TOML file are appended to it, with their keys
+// written to the key directory; the file is created if it doesn't
+// exist.
+func storeTOML(fileName string, targets []*Target) error {
+	file, state, keyDir, err := readTOMLFile(fileName)
+	if os.IsNotExist(err) {
+		err = ioutil.WriteFile(fileName, []byte(tomlHeader), 0644)
+		if err != nil {
+			return err
+		}
+		file, state, keyDir, err = readTOMLFile(fileName)
+	}
+	if err != nil {
+		return err
+	}
+
+	listed := map[string]bool{}
+	for _, tt := range file.Targets {
+		listed[tt.Address] = true
+		if Find(targets, tt.Address) == nil {
+			return ErrStaticTarget
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	states := map[string]*targetState{}
+	for _, t := range targets {
+		states[t.Address] = &targetState{Counter: t.Counter, Next: t.Next, Paused: t.Paused}
+		if listed[t.Address] {
+			continue
+		}
+
+		keyRef, err := writeKey(filepath.Dir(fileName), keyDir, keyFileName(t.Address),
+			"CURVE25519 PUBLIC KEY", t.Public)
+		if err != nil {
+			return err
+		}
+
+		var kemRef string
+		if t.KEMPublic != nil {
+			kemRef, err = writeKey(filepath.Dir(fileName), keyDir, kemKeyFileName(t.Address),
+				"ML-KEM-768 PUBLIC KEY", t.KEMPublic)
+			if err != nil {
+				return err
+			}
+		}
+		appendTarget(buf, t, keyRef, kemRef)
+		listed[t.Address] = true
+	}
+
+	out, err := json.MarshalIndent(states, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(state, out, 0644); err != nil {
+		return err
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Migrate converts the JSON targets file in from to a TOML targets
+// file in to, writing the targets' public keys to files in the same
+// directory and their state to a state file beside it.
+func Migrate(from, to string) error {
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("target: %s already exists", to)
+	}
+
+	targets, err := Read(from)
+	if err != nil {
+		return err
+	}
+	return storeTOML(to, targets)
+}
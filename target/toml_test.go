@@ -0,0 +1,152 @@
+package target
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kisom/entropyshare/util"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestTOML(t *testing.T) {
+	dir, err := os.MkdirTemp("", "target")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	targets := []*Target{
+		{Address: "sink1.example.net:9437", Public: testKey(1), Counter: 12, Next: 1700000000},
+		{Address: "[::1]:9437", Public: testKey(2), ChunkSize: 2048, Paused: true,
+			KEMPublic: bytes.Repeat([]byte{4}, 1184)},
+	}
+
+	jsonFile := filepath.Join(dir, "targets.json")
+	checkError(t, Store(jsonFile, targets))
+
+	tomlFile := filepath.Join(dir, "targets.toml")
+	checkError(t, Migrate(jsonFile, tomlFile))
+
+	loaded, err := Read(tomlFile)
+	checkError(t, err)
+	if len(loaded) != len(targets) {
+		t.Fatalf("expected %d targets, have %d", len(targets), len(loaded))
+	}
+
+	for i, tgt := range targets {
+		l := loaded[i]
+		if l.Address != tgt.Address || !bytes.Equal(l.Public, tgt.Public) ||
+			l.Counter != tgt.Counter || l.Next != tgt.Next ||
+			l.ChunkSize != tgt.ChunkSize || l.Paused != tgt.Paused ||
+			!bytes.Equal(l.KEMPublic, tgt.KEMPublic) {
+			t.Fatalf("expected %+v, have %+v", *tgt, *l)
+		}
+	}
+
+	before, err := os.ReadFile(tomlFile)
+	checkError(t, err)
+
+	// Updating state leaves the TOML file alone.
+	loaded[0].Counter++
+	checkError(t, Store(tomlFile, loaded))
+	after, err := os.ReadFile(tomlFile)
+	checkError(t, err)
+	if !bytes.Equal(before, after) {
+		t.Fatal("storing the state rewrote the TOML file")
+	}
+
+	// A new target is appended.
+	added := &Target{Address: "sink3.example.net:9437", Public: testKey(3)}
+	checkError(t, Store(tomlFile, append(loaded, added)))
+
+	loaded, err = Read(tomlFile)
+	checkError(t, err)
+	if len(loaded) != 3 || loaded[0].Counter != 13 || !bytes.Equal(loaded[2].Public, added.Public) {
+		t.Fatalf("targets weren't updated: %+v", loaded)
+	}
+
+	// A key left behind by a store that failed is reused, but
+	// a different one isn't replaced.
+	orphan := &Target{Address: "sink4.example.net:9437", Public: testKey(4)}
+	checkError(t, os.WriteFile(filepath.Join(dir, keyFileName(orphan.Address)),
+		pem.EncodeToMemory(&pem.Block{Type: "CURVE25519 PUBLIC KEY", Bytes: orphan.Public}), 0644))
+	checkError(t, Store(tomlFile, append(loaded, orphan)))
+
+	other := &Target{Address: "sink5.example.net:9437", Public: testKey(5)}
+	checkError(t, os.WriteFile(filepath.Join(dir, keyFileName(other.Address)),
+		pem.EncodeToMemory(&pem.Block{Type: "CURVE25519 PUBLIC KEY", Bytes: testKey(6)}), 0644))
+	if err = Store(tomlFile, append(loaded, orphan, other)); err == nil {
+		t.Fatal("a different key file was replaced")
+	}
+
+	loaded, err = Read(tomlFile)
+	checkError(t, err)
+	if len(loaded) != 4 || !bytes.Equal(loaded[3].Public, orphan.Public) {
+		t.Fatalf("the orphaned key wasn't reused: %+v", loaded)
+	}
+
+	if err = Store(tomlFile, loaded[1:]); err != ErrStaticTarget {
+		t.Fatalf("expected %v, have %v", ErrStaticTarget, err)
+	}
+}
+
+func TestTOMLFingerprint(t *testing.T) {
+	dir, err := os.MkdirTemp("", "target")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	tomlFile := filepath.Join(dir, "targets.toml")
+	checkError(t, Store(tomlFile, []*Target{{Address: "sink:9437", Public: testKey(4)}}))
+
+	// Refer to the written key by its fingerprint rather than its
+	// path.
+	refer := func(fingerprint string) {
+		checkError(t, os.WriteFile(tomlFile, []byte(`
+[[target]]
+address = "sink:9437"
+public_key = "`+fingerprint+`"
+`), 0644))
+	}
+
+	refer(util.Fingerprint(testKey(4)))
+	loaded, err := Read(tomlFile)
+	checkError(t, err)
+	if !bytes.Equal(loaded[0].Public, testKey(4)) {
+		t.Fatal("key wasn't found by its fingerprint")
+	}
+
+	refer(util.Fingerprint(testKey(5)))
+	if _, err = Read(tomlFile); err == nil {
+		t.Fatal("an unknown fingerprint was accepted")
+	}
+}
+
+func TestTOMLSessionKEM(t *testing.T) {
+	dir, err := os.MkdirTemp("", "target")
+	checkError(t, err)
+	defer os.RemoveAll(dir)
+
+	tomlFile := filepath.Join(dir, "targets.toml")
+	checkError(t, os.WriteFile(tomlFile, []byte(`
+[[target]]
+address = "sink:9437"
+public_key = "sink.pub"
+session = true
+kem_public_key = "sink.kem.pub"
+`), 0644))
+
+	if _, err = Read(tomlFile); !errors.Is(err, ErrSessionKEM) {
+		t.Fatalf("expected %v, have %v", ErrSessionKEM, err)
+	}
+}
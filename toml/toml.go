@@ -0,0 +1,57 @@
+// Package toml decodes entropyshare's TOML configuration files, using
+// github.com/BurntSushi/toml.
+//
+// Values are decoded into structs whose fields are named by a toml
+// tag, or else by the field name. A key with no field to decode it
+// into is an error, so that misspelt settings are caught.
+package toml
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Unmarshal decodes a TOML document into v, which must be a pointer
+// to a struct.
+func Unmarshal(in []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("toml: can't decode into %T", v)
+	}
+
+	md, err := toml.Decode(string(in), v)
+	if err != nil {
+		return err
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		return fmt.Errorf("toml: unknown key %s", undecoded[0])
+	}
+	return nil
+}
+
+// Quote returns s as a TOML basic string.
+func Quote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, `\u%04x`, r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,131 @@
+package toml
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func checkError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+type testOutput struct {
+	Type   string `toml:"type"`
+	Credit int    `toml:"credit"`
+}
+
+type testConfig struct {
+	Name    string       `toml:"name"`
+	Path    string       `toml:"path"`
+	Count   int64        `toml:"count"`
+	Rate    float64      `toml:"rate"`
+	Enabled bool         `toml:"enabled"`
+	Tags    []string     `toml:"tags"`
+	Outputs []testOutput `toml:"outputs"`
+	Relay   *struct {
+		Targets string `toml:"targets"`
+	} `toml:"relay"`
+	Skipped string `toml:"-"`
+}
+
+const testDocument = `# A comment on its own line.
+name = "entropy \"sink\"\t\u00e9"  # a trailing comment
+path = 'C:\keys\decrypt.key'
+count = 1_024
+rate = 7.5
+enabled = true
+tags = [
+	"a",   # comments are allowed in arrays
+	"b",
+]
+
+[[outputs]]
+type = "random"
+credit = 4
+
+[[outputs]]
+type = "fifo"
+
+[relay]
+targets = "targets.toml"
+`
+
+func TestUnmarshal(t *testing.T) {
+	var cfg testConfig
+	checkError(t, Unmarshal([]byte(testDocument), &cfg))
+
+	if cfg.Name != "entropy \"sink\"\t\u00e9" {
+		t.Fatalf("bad basic string %q", cfg.Name)
+	}
+	if cfg.Path != `C:\keys\decrypt.key` {
+		t.Fatalf("bad literal string %q", cfg.Path)
+	}
+	if cfg.Count != 1024 || cfg.Rate != 7.5 || !cfg.Enabled {
+		t.Fatalf("bad values: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Tags, []string{"a", "b"}) {
+		t.Fatalf("bad array %v", cfg.Tags)
+	}
+
+	expected := []testOutput{{"random", 4}, {"fifo", 0}}
+	if !reflect.DeepEqual(cfg.Outputs, expected) {
+		t.Fatalf("expected outputs %v, have %v", expected, cfg.Outputs)
+	}
+	if cfg.Relay == nil || cfg.Relay.Targets != "targets.toml" {
+		t.Fatalf("bad table %+v", cfg.Relay)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	invalid := []struct {
+		doc  string
+		line int
+	}{
+		{"unknown = 1", 0},
+		{"name = 1", 0},
+		{"count = \"1\"", 0},
+		{"\nname = \"unterminated", 2},
+		{"name = \"a\"\nname = \"b\"", 2},
+		{"[relay]\n[relay]", 2},
+		{"name = \"a\" trailing", 1},
+		{"name =", 1},
+		{"tags = [\"a\" \"b\"]", 1},
+		{"name = \"\\q\"", 1},
+	}
+
+	for _, tc := range invalid {
+		var cfg testConfig
+		err := Unmarshal([]byte(tc.doc), &cfg)
+		if err == nil {
+			t.Fatalf("%q was accepted", tc.doc)
+		}
+
+		if tc.line != 0 && !strings.Contains(err.Error(), fmt.Sprintf("line %d", tc.line)) {
+			t.Fatalf("%q: expected an error on line %d, have %v", tc.doc, tc.line, err)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, s := range []string{"", "plain", `"quoted"`, `back\slash`, "tab\tnew\nline\x01"} {
+		var cfg testConfig
+		checkError(t, Unmarshal([]byte("name = "+Quote(s)), &cfg))
+		if cfg.Name != s {
+			t.Fatalf("expected %q, have %q", s, cfg.Name)
+		}
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	f.Add([]byte(testDocument))
+	f.Add([]byte("[[outputs]]\ntype = \"random\"\n[relay]\n"))
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		var cfg testConfig
+		Unmarshal(in, &cfg)
+	})
+}
@@ -2,10 +2,19 @@ package util
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kisom/entropyshare/seal"
 )
 
 func ParseCertificate(path string) *x509.Certificate {
@@ -28,49 +37,203 @@ func ParseCertificate(path string) *x509.Certificate {
 	return cert
 }
 
-func ParsePrivateKey(path string) *rsa.PrivateKey {
+// PassphraseSpec describes where the passphrase for sealed private
+// keys is read from, in the form taken by seal.ReadPassphrase. By
+// default, it is read from the terminal.
+var PassphraseSpec string
+
+var passphrase struct {
+	lock sync.Mutex
+	p    seal.Passphrase
+}
+
+// getPassphrase reads the passphrase for sealed private keys. It is
+// only read once, however many keys are opened.
+func getPassphrase() (seal.Passphrase, error) {
+	passphrase.lock.Lock()
+	defer passphrase.lock.Unlock()
+
+	if passphrase.p == nil {
+		p, err := seal.ReadPassphrase(PassphraseSpec, false)
+		if err != nil {
+			return nil, err
+		}
+		passphrase.p = p
+	}
+	return passphrase.p, nil
+}
+
+// ReadPrivateKey reads a private key file, which may hold a raw key,
+// a PEM-armoured key, or a sealed key; a sealed key is opened with
+// the passphrase described by PassphraseSpec. An armoured or sealed
+// key must be of one of the given PEM types.
+func ReadPrivateKey(path string, keyTypes ...string) ([]byte, error) {
 	in, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return nil, err
 	}
 
-	if p, _ := pem.Decode(in); p != nil {
-		if p.Type != "PRIVATE KEY" && p.Type != "RSA PRIVATE KEY" {
-			log.Fatalf("invalid private key (type is %s)",
-				p.Type)
+	var keyType string
+	if seal.IsSealedKey(in) {
+		p, err := getPassphrase()
+		if err != nil {
+			return nil, err
 		}
-		in = p.Bytes
+
+		keyType, in, err = seal.OpenKey(p, in)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	} else if p, _ := pem.Decode(in); p != nil {
+		keyType, in = p.Type, p.Bytes
+	} else {
+		return in, nil
 	}
-	priv, err := x509.ParsePKCS1PrivateKey(in)
-	if err != nil {
-		log.Fatalf("failed to parse certificate: %v", err)
+
+	for _, t := range keyTypes {
+		if keyType == t {
+			return in, nil
+		}
 	}
-	return priv
+	return nil, fmt.Errorf("invalid private key (type is %s)", keyType)
 }
 
-func ParsePublicKey(path string) *rsa.PublicKey {
+// ReadPublicKey reads a public key file, which may hold a raw key or
+// a PEM-armoured key of one of the given types.
+func ReadPublicKey(path string, keyTypes ...string) ([]byte, error) {
 	in, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return nil, err
 	}
 
-	if p, _ := pem.Decode(in); p != nil {
-		if p.Type != "PUBLIC KEY" && p.Type != "RSA PUBLIC KEY" {
-			log.Fatalf("invalid public key (type is %s)",
-				p.Type)
+	p, _ := pem.Decode(in)
+	if p == nil {
+		return in, nil
+	}
+
+	for _, t := range keyTypes {
+		if p.Type == t {
+			return p.Bytes, nil
 		}
-		in = p.Bytes
 	}
+	return nil, fmt.Errorf("invalid public key (type is %s)", p.Type)
+}
+
+// FingerprintPrefix begins a key fingerprint.
+const FingerprintPrefix = "sha256:"
+
+// Fingerprint returns the fingerprint of a key: the SHA-256 digest of
+// its raw or DER bytes, in hex, following FingerprintPrefix.
+func Fingerprint(key []byte) string {
+	digest := sha256.Sum256(key)
+	return FingerprintPrefix + hex.EncodeToString(digest[:])
+}
+
+// ResolvePath returns path relative to dir, unless it is absolute.
+func ResolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// FindPublicKey reads the public key that ref names. A ref is either
+// the path to a key file, or the fingerprint of one of the public keys
+// of the given types in dir.
+func FindPublicKey(ref, dir string, keyTypes ...string) ([]byte, error) {
+	if !strings.HasPrefix(ref, FingerprintPrefix) {
+		return ReadPublicKey(ResolvePath(dir, ref), keyTypes...)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		key, err := ReadPublicKey(filepath.Join(dir, fi.Name()), keyTypes...)
+		if err == nil && Fingerprint(key) == strings.ToLower(ref) {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no key in %s has the fingerprint %s", dir, ref)
+}
+
+// ReadSigner reads an RSA signature key, as ReadPrivateKey does.
+func ReadSigner(path string) (*rsa.PrivateKey, error) {
+	in, err := ReadPrivateKey(path, "PRIVATE KEY", "RSA PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	priv, err := x509.ParsePKCS1PrivateKey(in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	return priv, nil
+}
+
+// ReadSignerPublic reads an RSA signature public key in PKIX form.
+func ReadSignerPublic(path string) (*rsa.PublicKey, error) {
+	in, err := ReadPublicKey(path, "PUBLIC KEY", "RSA PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
 	pub, err := x509.ParsePKIXPublicKey(in)
 	if err != nil {
-		log.Fatalf("failed to parse certificate: %v", err)
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
 	}
 
-	switch pub := pub.(type) {
-	case *rsa.PublicKey:
-		return pub
-	default:
-		log.Fatalf("only RSA public keys are supported")
-		return nil
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("only RSA public keys are supported")
+	}
+	return rsaPub, nil
+}
+
+// WritePrivateKey writes a private key of the given PEM type to
+// path. If passphrase isn't nil, the key is sealed with it, and is
+// always armoured.
+func WritePrivateKey(path, keyType string, key []byte, armour bool, passphrase seal.Passphrase) error {
+	out := key
+	if passphrase != nil {
+		var err error
+		out, err = seal.SealKey(passphrase, keyType, key)
+		if err != nil {
+			return err
+		}
+	} else if armour {
+		out = pem.EncodeToMemory(&pem.Block{Type: keyType, Bytes: key})
+	}
+	return ioutil.WriteFile(path, out, 0600)
+}
+
+// WritePublicKey writes a public key of the given PEM type to path.
+func WritePublicKey(path, keyType string, key []byte, armour bool) error {
+	out := key
+	if armour {
+		out = pem.EncodeToMemory(&pem.Block{Type: keyType, Bytes: key})
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+func ParsePrivateKey(path string) *rsa.PrivateKey {
+	priv, err := ReadSigner(path)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return priv
+}
+
+func ParsePublicKey(path string) *rsa.PublicKey {
+	pub, err := ReadSignerPublic(path)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
+	return pub
 }